@@ -0,0 +1,324 @@
+/*
+Copyright [2014] - [2024] The Last.Backend authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rabbitmq
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	AuditDirectionPublish = "publish"
+	AuditDirectionConsume = "consume"
+
+	auditRedacted        = "[REDACTED]"
+	defaultAuditMaxSize  = 100 << 20
+	defaultAuditMaxFiles = 5
+)
+
+// AuditRecord is a line of the audit file
+type AuditRecord struct {
+	Timestamp time.Time              `json:"timestamp"`
+	Direction string                 `json:"direction"`
+	Exchange  string                 `json:"exchange"`
+	Event     string                 `json:"event"`
+	Headers   map[string]interface{} `json:"headers,omitempty"`
+	// Payload is written base64 encoded, so it is replayed byte for byte
+	Payload []byte `json:"payload,omitempty"`
+	// PayloadRedacted is set for consumed encrypted messages, whose payload is not written
+	PayloadRedacted bool `json:"payload_redacted,omitempty"`
+}
+
+// auditTap appends records to a JSONL file and rotates it by size:
+// the current file is renamed to file.1, file.1 to file.2 and so on.
+type auditTap struct {
+	mtx      sync.Mutex
+	path     string
+	maxSize  int64
+	maxFiles int
+	redact   map[string]struct{}
+	file     *os.File
+	size     int64
+}
+
+func newAuditTap(path string, maxSize int64, maxFiles int, redact string) (*auditTap, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	a := &auditTap{
+		path:     path,
+		maxSize:  maxSize,
+		maxFiles: maxFiles,
+		redact:   make(map[string]struct{}),
+	}
+
+	if a.maxSize <= 0 {
+		a.maxSize = defaultAuditMaxSize
+	}
+	if a.maxFiles <= 0 {
+		a.maxFiles = defaultAuditMaxFiles
+	}
+
+	for _, f := range strings.Split(redact, ",") {
+		if f = strings.TrimSpace(f); f != "" {
+			a.redact[strings.ToLower(f)] = struct{}{}
+		}
+	}
+
+	if err := a.open(); err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+func (a *auditTap) open() error {
+	f, err := os.OpenFile(a.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	a.file = f
+	a.size = info.Size()
+	return nil
+}
+
+func (a *auditTap) rotate() error {
+	if err := a.file.Close(); err != nil {
+		return err
+	}
+
+	for i := a.maxFiles - 1; i > 0; i-- {
+		src := fmt.Sprintf("%s.%d", a.path, i)
+		if _, err := os.Stat(src); err == nil {
+			if err := os.Rename(src, fmt.Sprintf("%s.%d", a.path, i+1)); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := os.Rename(a.path, a.path+".1"); err != nil {
+		return err
+	}
+
+	return a.open()
+}
+
+func (a *auditTap) record(direction, exchange, event string, headers map[string]interface{}, payload []byte) error {
+	if a == nil {
+		return nil
+	}
+
+	r := AuditRecord{
+		Timestamp: time.Now().UTC(),
+		Direction: direction,
+		Exchange:  exchange,
+		Event:     event,
+		Headers:   a.redactHeaders(headers),
+	}
+
+	// consumed encrypted payloads are decrypted by now, they must not end up in the file
+	if _, ok := headers[headerEncryptionKeyID]; ok && direction == AuditDirectionConsume {
+		r.PayloadRedacted = true
+	} else {
+		r.Payload = a.redactPayload(payload)
+	}
+
+	line, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	if a.size > 0 && a.size+int64(len(line)) > a.maxSize {
+		if err := a.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := a.file.Write(line)
+	a.size += int64(n)
+	return err
+}
+
+func (a *auditTap) Close() error {
+	if a == nil {
+		return nil
+	}
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	return a.file.Close()
+}
+
+func (a *auditTap) redactHeaders(headers map[string]interface{}) map[string]interface{} {
+	if len(headers) == 0 {
+		return nil
+	}
+	h := make(map[string]interface{}, len(headers))
+	for k, v := range headers {
+		if _, ok := a.redact[strings.ToLower(k)]; ok {
+			v = auditRedacted
+		}
+		h[k] = v
+	}
+	return h
+}
+
+// redactPayload redacts fields of JSON payloads, other payloads are kept as is
+func (a *auditTap) redactPayload(payload []byte) []byte {
+	if len(a.redact) == 0 || !json.Valid(payload) {
+		return payload
+	}
+
+	var v interface{}
+	if err := json.Unmarshal(payload, &v); err != nil {
+		return payload
+	}
+
+	b, err := json.Marshal(a.redactValue(v))
+	if err != nil {
+		return payload
+	}
+	return b
+}
+
+// redactValue replaces the redacted fields at any depth of the payload
+func (a *auditTap) redactValue(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for k, val := range t {
+			if _, ok := a.redact[strings.ToLower(k)]; ok {
+				t[k] = auditRedacted
+				continue
+			}
+			t[k] = a.redactValue(val)
+		}
+	case []interface{}:
+		for i, val := range t {
+			t[i] = a.redactValue(val)
+		}
+	}
+	return v
+}
+
+// AuditPublisher is what ReplayAudit publishes the records into, Plugin implements it
+type AuditPublisher interface {
+	DeclareExchange(name string) error
+	PublishTo(ctx context.Context, exchange, event string, payload []byte, opts *PublishOptions) error
+}
+
+// ReplayOptions configures ReplayAudit
+type ReplayOptions struct {
+	// Direction selects the records to replay, publish by default
+	Direction string
+	// Exchange overrides the recorded exchange
+	Exchange string
+}
+
+// ReplayAudit reads an audit file and publishes its records in order,
+// usually into a plugin created with NewTestPlugin. Redacted fields are
+// published as recorded, records without a payload are skipped.
+// It returns the number of published records.
+func ReplayAudit(ctx context.Context, p AuditPublisher, path string, opts *ReplayOptions) (int, error) {
+	if opts == nil {
+		opts = new(ReplayOptions)
+	}
+
+	direction := opts.Direction
+	if direction == "" {
+		direction = AuditDirectionPublish
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	var (
+		count     int
+		exchanges = make(map[string]struct{})
+		scanner   = bufio.NewScanner(f)
+	)
+
+	scanner.Buffer(make([]byte, 64*1024), 64<<20)
+
+	for line := 1; scanner.Scan(); line++ {
+		r := AuditRecord{}
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			return count, errors.Wrapf(err, "%s:%d", path, line)
+		}
+
+		if r.Direction != direction || r.PayloadRedacted {
+			continue
+		}
+
+		exchange := r.Exchange
+		if opts.Exchange != "" {
+			exchange = opts.Exchange
+		}
+
+		if _, ok := exchanges[exchange]; !ok {
+			if err := p.DeclareExchange(exchange); err != nil {
+				return count, err
+			}
+			exchanges[exchange] = struct{}{}
+		}
+
+		if err := p.PublishTo(ctx, exchange, r.Event, r.Payload, &PublishOptions{Headers: userHeaders(r.Headers)}); err != nil {
+			return count, errors.Wrapf(err, "%s:%d", path, line)
+		}
+		count++
+	}
+
+	return count, scanner.Err()
+}
+
+// userHeaders drops the headers set by the plugin itself,
+// they are produced again when the message is published
+func userHeaders(headers map[string]interface{}) map[string]interface{} {
+	h := make(map[string]interface{}, len(headers))
+	for k, v := range headers {
+		switch {
+		case strings.HasPrefix(k, cloudEventsHeaderPrefix),
+			k == headerSchemaVersion,
+			k == headerEncryptionKeyID,
+			k == headerRejectionReason:
+			continue
+		}
+		h[k] = v
+	}
+	return h
+}
@@ -0,0 +1,257 @@
+/*
+Copyright [2014] - [2024] The Last.Backend authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rabbitmq
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type published struct {
+	exchange, event string
+	payload         []byte
+	headers         map[string]interface{}
+}
+
+// fakePublisher records the replayed messages
+type fakePublisher struct {
+	declared  []string
+	published []published
+}
+
+func (f *fakePublisher) DeclareExchange(name string) error {
+	f.declared = append(f.declared, name)
+	return nil
+}
+
+func (f *fakePublisher) PublishTo(_ context.Context, exchange, event string, payload []byte, opts *PublishOptions) error {
+	f.published = append(f.published, published{exchange: exchange, event: event, payload: payload, headers: opts.Headers})
+	return nil
+}
+
+func readAudit(t *testing.T, path string) []AuditRecord {
+	t.Helper()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var records []AuditRecord
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		r := AuditRecord{}
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, r)
+	}
+	return records
+}
+
+func TestAuditRecord(t *testing.T) {
+	tests := []struct {
+		name         string
+		redact       string
+		direction    string
+		headers      map[string]interface{}
+		payload      []byte
+		wantPayload  []byte
+		wantRedacted bool
+		wantHeader   interface{}
+	}{
+		{
+			name: "json is kept byte for byte", direction: AuditDirectionPublish,
+			payload: []byte(`{ "b": 1, "a": [1, 2] }`), wantPayload: []byte(`{ "b": 1, "a": [1, 2] }`),
+		},
+		{
+			name: "binary", direction: AuditDirectionPublish,
+			payload: []byte{0, 1, 255}, wantPayload: []byte{0, 1, 255},
+		},
+		{
+			name: "redacted fields", direction: AuditDirectionPublish, redact: "password, Authorization",
+			headers: map[string]interface{}{"authorization": "secret"},
+			payload: []byte(`{"user":{"password":"secret"}}`), wantPayload: []byte(`{"user":{"password":"[REDACTED]"}}`),
+			wantHeader: auditRedacted,
+		},
+		{
+			name: "redaction of binary", direction: AuditDirectionPublish, redact: "password",
+			payload: []byte{0, 1, 255}, wantPayload: []byte{0, 1, 255},
+		},
+		{
+			name: "consumed encrypted", direction: AuditDirectionConsume,
+			headers: map[string]interface{}{headerEncryptionKeyID: "k1"},
+			payload: []byte(`{"card":"4242"}`), wantRedacted: true,
+		},
+		{
+			name: "published encrypted", direction: AuditDirectionPublish,
+			headers: map[string]interface{}{headerEncryptionKeyID: "k1"},
+			payload: []byte(`{"card":"4242"}`), wantPayload: []byte(`{"card":"4242"}`),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "audit.jsonl")
+			a, err := newAuditTap(path, 0, 0, tt.redact)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := a.record(tt.direction, "orders", "created", tt.headers, tt.payload); err != nil {
+				t.Fatal(err)
+			}
+			if err := a.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			records := readAudit(t, path)
+			if len(records) != 1 {
+				t.Fatalf("got %d records, want 1", len(records))
+			}
+			r := records[0]
+			if r.PayloadRedacted != tt.wantRedacted {
+				t.Errorf("payload redacted: got %t, want %t", r.PayloadRedacted, tt.wantRedacted)
+			}
+			if !bytes.Equal(r.Payload, tt.wantPayload) {
+				t.Errorf("payload: got %q, want %q", r.Payload, tt.wantPayload)
+			}
+			if tt.wantHeader != nil && r.Headers["authorization"] != tt.wantHeader {
+				t.Errorf("header: got %v, want %v", r.Headers["authorization"], tt.wantHeader)
+			}
+		})
+	}
+}
+
+func TestAuditRotate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	a, err := newAuditTap(path, 200, 2, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 10; i++ {
+		if err := a.record(AuditDirectionPublish, "orders", "created", nil, []byte(`{"id":1}`)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := a.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{path, path + ".1", path + ".2"} {
+		info, err := os.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() > 200 {
+			t.Errorf("%s has %d bytes, want at most 200", name, info.Size())
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("got %v for the file over AUDIT_MAX_FILES, want it removed", err)
+	}
+}
+
+func TestReplayAudit(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	a, err := newAuditTap(path, 0, 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	records := []struct {
+		direction, exchange, event string
+		headers                    map[string]interface{}
+		payload                    []byte
+	}{
+		{AuditDirectionPublish, "orders", "created", map[string]interface{}{"x-trace": "1", headerSchemaVersion: int32(2)}, []byte(`{ "id": 1 }`)},
+		{AuditDirectionConsume, "users", "created", nil, []byte(`{"id":2}`)},
+		{AuditDirectionPublish, "orders", "paid", map[string]interface{}{"ce-id": "3"}, []byte{0, 255}},
+		{AuditDirectionConsume, "users", "deleted", map[string]interface{}{headerEncryptionKeyID: "k1"}, []byte(`{"id":4}`)},
+	}
+	for _, r := range records {
+		if err := a.record(r.direction, r.exchange, r.event, r.headers, r.payload); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := a.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		opts *ReplayOptions
+		want []published
+	}{
+		{
+			name: "published",
+			want: []published{
+				{exchange: "orders", event: "created", payload: []byte(`{ "id": 1 }`), headers: map[string]interface{}{"x-trace": "1"}},
+				{exchange: "orders", event: "paid", payload: []byte{0, 255}},
+			},
+		},
+		{
+			name: "consumed without redacted payloads",
+			opts: &ReplayOptions{Direction: AuditDirectionConsume},
+			want: []published{{exchange: "users", event: "created", payload: []byte(`{"id":2}`)}},
+		},
+		{
+			name: "exchange override",
+			opts: &ReplayOptions{Exchange: "replay"},
+			want: []published{
+				{exchange: "replay", event: "created", payload: []byte(`{ "id": 1 }`), headers: map[string]interface{}{"x-trace": "1"}},
+				{exchange: "replay", event: "paid", payload: []byte{0, 255}},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := new(fakePublisher)
+			n, err := ReplayAudit(context.Background(), p, path, tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != len(tt.want) || len(p.published) != len(tt.want) {
+				t.Fatalf("got %d records, want %d", n, len(tt.want))
+			}
+			for i, want := range tt.want {
+				got := p.published[i]
+				if got.exchange != want.exchange || got.event != want.event || !bytes.Equal(got.payload, want.payload) {
+					t.Errorf("record %d: got %s %s %q, want %s %s %q", i, got.exchange, got.event, got.payload, want.exchange, want.event, want.payload)
+				}
+				if len(got.headers) != len(want.headers) {
+					t.Errorf("record %d: got headers %v, want %v", i, got.headers, want.headers)
+				}
+				for k, v := range want.headers {
+					if got.headers[k] != v {
+						t.Errorf("record %d: got headers %v, want %v", i, got.headers, want.headers)
+					}
+				}
+			}
+			if len(p.declared) != 1 {
+				t.Errorf("declared %v, want every exchange once", p.declared)
+			}
+		})
+	}
+}
@@ -21,8 +21,10 @@ import (
 	"crypto/tls"
 	"encoding/json"
 	"fmt"
+	"strings"
 	"sync"
 
+	"github.com/getsentry/sentry-go"
 	"github.com/lastbackend/toolkit/pkg/runtime"
 	"github.com/pkg/errors"
 	amqp "github.com/rabbitmq/amqp091-go"
@@ -53,7 +55,11 @@ type broker struct {
 	prefetchGlobal bool
 	exchange       Exchange
 
-	handlers map[string][]CallHandler
+	handlers map[string][]CloudEventHandler
+	schemas  *schemaRegistry
+	keys     *keyring
+	audit    *auditTap
+	sentry   SentryClient
 
 	wg sync.WaitGroup
 }
@@ -70,13 +76,18 @@ func newBroker(runtime runtime.Runtime, opts Config) *broker {
 		exchange = *opts.DefaultExchange
 	}
 
-	return &broker{
+	b := &broker{
 		runtime:   runtime,
 		endpoints: []string{opts.DSN},
 		opts:      opts,
 		exchange:  exchange,
-		handlers:  make(map[string][]CallHandler, 0),
+		handlers:  make(map[string][]CloudEventHandler, 0),
+		schemas:   newSchemaRegistry(),
 	}
+
+	b.conn = newConnection(runtime, exchange, b.endpoints, opts.PrefetchCount, opts.PrefetchGlobal)
+
+	return b
 }
 
 func (r *broker) Ack(ctx context.Context) error {
@@ -105,22 +116,96 @@ func (r *broker) RejectAndRequeue(ctx context.Context) error {
 
 func (r *broker) Publish(ctx context.Context, exchange, event string, payload []byte, opts *PublishOptions) error {
 
-	e := message{
-		Event:   event,
-		Payload: string(payload),
+	m, err := r.publishing(exchange, event, payload, opts)
+	if err != nil {
+		return err
 	}
 
-	body, err := json.Marshal(e)
-	if err != nil {
+	if r.conn == nil {
+		return errors.New("connection is nil")
+	}
+
+	if err := r.conn.Publish(ctx, exchange, "*", m); err != nil {
 		return err
 	}
 
+	r.tap(AuditDirectionPublish, exchange, event, opts, payload)
+
+	return nil
+}
+
+func (r *broker) tap(direction, exchange, event string, opts *PublishOptions, payload []byte) {
+	var headers map[string]interface{}
+	if opts != nil {
+		headers = opts.Headers
+	}
+	if err := r.audit.record(direction, exchange, event, headers, payload); err != nil {
+		r.runtime.Log().Errorf("rabbitmq: can not write audit record: %v", err)
+	}
+}
+
+// PublishBatch publishes the events over a dedicated channel in confirm mode.
+// Confirmations are awaited once all events are sent, instead of one round trip
+// per event. The returned slice holds the result of every event by its index.
+func (r *broker) PublishBatch(ctx context.Context, exchange string, events []BatchEvent) ([]error, error) {
+	ch, err := r.Channel()
+	if err != nil {
+		return nil, err
+	}
+	defer ch.Close()
+
+	if err := ch.Confirm(false); err != nil {
+		return nil, err
+	}
+
+	results := make([]error, len(events))
+	confirms := make([]*amqp.DeferredConfirmation, len(events))
+
+	for i, e := range events {
+		m, err := r.publishing(exchange, e.Event, e.Payload, e.Options)
+		if err != nil {
+			results[i] = err
+			continue
+		}
+
+		confirms[i], err = ch.PublishWithDeferredConfirmWithContext(ctx, exchange, "*", false, false, m)
+		if err != nil {
+			// the channel can not be used after a failed publish, the rest of the batch fails with it
+			for j := i; j < len(events); j++ {
+				if results[j] == nil {
+					results[j] = err
+				}
+			}
+			break
+		}
+	}
+
+	for i, dc := range confirms {
+		if dc == nil {
+			continue
+		}
+		ok, err := dc.WaitContext(ctx)
+		switch {
+		case err != nil:
+			results[i] = err
+		case !ok:
+			results[i] = errors.New("message nacked by broker")
+		default:
+			r.tap(AuditDirectionPublish, exchange, events[i].Event, events[i].Options, events[i].Payload)
+		}
+	}
+
+	return results, nil
+}
+
+// publishing builds the AMQP message of the event
+func (r *broker) publishing(exchange, event string, payload []byte, opts *PublishOptions) (amqp.Publishing, error) {
+
 	if opts == nil {
 		opts = new(PublishOptions)
 	}
 
 	m := amqp.Publishing{
-		Body:    body,
 		Type:    fmt.Sprintf("%s:%s", exchange, event),
 		Headers: amqp.Table{},
 	}
@@ -131,14 +216,67 @@ func (r *broker) Publish(ctx context.Context, exchange, event string, payload []
 		}
 	}
 
-	if r.conn == nil {
-		return errors.New("connection is nil")
+	if err := r.schemas.validatePublish(exchange, event, payload, m.Headers); err != nil {
+		return m, err
+	}
+
+	mode := opts.CloudEvents
+	if mode == CloudEventsDisabled {
+		mode = CloudEventsMode(strings.ToLower(r.opts.CloudEvents))
+	}
+
+	if mode == CloudEventsDisabled {
+		e := message{
+			Event:   event,
+			Payload: string(payload),
+		}
+
+		body, err := json.Marshal(e)
+		if err != nil {
+			return m, err
+		}
+		m.Body = body
+	} else {
+		// the exchange is named after the publishing service, so it is the event source
+		if err := encodeCloudEvent(newCloudEvent(exchange, event, payload, opts), mode, &m); err != nil {
+			return m, err
+		}
 	}
 
-	return r.conn.Publish(ctx, exchange, "*", m)
+	compression := opts.Compression
+	if compression == CompressionNone {
+		compression = Compression(strings.ToLower(r.opts.Compression))
+	}
+
+	threshold := r.opts.CompressionThreshold
+	if threshold <= 0 {
+		threshold = defaultCompressionThreshold
+	}
+
+	if compression != CompressionNone && len(m.Body) >= threshold {
+		body, err := compress(compression, m.Body)
+		if err != nil {
+			return m, err
+		}
+		m.Body = body
+		m.ContentEncoding = string(compression)
+	}
+
+	// encryption goes last, since the ciphertext does not compress
+	if err := r.keys.encrypt(&m); err != nil {
+		return m, err
+	}
+
+	return m, nil
 }
 
 func (r *broker) Subscribe(exchange, queue, event string, handler CallHandler, opts *SubscribeOptions) (Subscriber, error) {
+	return r.SubscribeCloudEvents(exchange, queue, event, func(ctx context.Context, e CloudEvent) {
+		handler(ctx, e.Data)
+	}, opts)
+}
+
+func (r *broker) SubscribeCloudEvents(exchange, queue, event string, handler CloudEventHandler, opts *SubscribeOptions) (Subscriber, error) {
 	if r.conn == nil {
 		return nil, errors.New("not connected")
 	}
@@ -148,7 +286,7 @@ func (r *broker) Subscribe(exchange, queue, event string, handler CallHandler, o
 	r.mtx.Lock()
 	key := fmt.Sprintf("%s:%s", exchange, event)
 	if _, ok := r.handlers[key]; !ok {
-		r.handlers[key] = make([]CallHandler, 0)
+		r.handlers[key] = make([]CloudEventHandler, 0)
 	}
 
 	handlerIndex = len(r.handlers[key])
@@ -159,42 +297,105 @@ func (r *broker) Subscribe(exchange, queue, event string, handler CallHandler, o
 		opts = new(SubscribeOptions)
 	}
 
+	// requeueing a failed message needs it unacknowledged until the handlers return
+	autoAck := !opts.ManualAck && !opts.RequeueOnError && opts.RateLimit <= 0 && opts.CircuitBreaker == nil
+
+	rejectQueue := opts.RejectQueue
+	if rejectQueue == "" {
+		rejectQueue = fmt.Sprintf("%s:rejected", queue)
+	}
+
 	c := consumer{
 		runtime:      r.runtime,
 		exchange:     exchange,
 		queue:        queue,
 		key:          "*",
-		autoAck:      true,
+		autoAck:      autoAck,
 		broker:       r,
 		headers:      opts.Headers,
 		durableQueue: opts.DurableQueue,
-		fn: func(msg amqp.Delivery) {
-			ctx := context.Background()
-			e := message{}
-			json.Unmarshal(msg.Body, &e)
+		done:         make(chan struct{}),
+		limiter:      newRateLimiter(opts.RateLimit, opts.RateBurst),
+		breaker:      newCircuitBreaker(opts.CircuitBreaker),
+		fn: func(msg amqp.Delivery) error {
+			d := &delivery{msg: msg, autoAck: autoAck}
+
+			if err := r.keys.decrypt(&msg); err != nil {
+				r.runtime.Log().Errorf("rabbitmq: can not decrypt message %s: %v", msg.Type, err)
+				r.moveTo(rejectQueue, d, err)
+				return nil
+			}
 
-			var (
-				handlers []CallHandler
-				ok       bool
-			)
+			if msg.ContentEncoding != "" {
+				limit := r.opts.MaxMessageSize
+				if limit <= 0 {
+					limit = defaultMaxMessageSize
+				}
+				body, err := decompress(msg.ContentEncoding, msg.Body, limit)
+				if err != nil {
+					r.runtime.Log().Errorf("rabbitmq: can not decompress message %s: %v", msg.Type, err)
+					r.moveTo(rejectQueue, d, err)
+					return nil
+				}
+				msg.Body = body
+			}
 
-			r.mtx.Lock()
-			handlers, ok = r.handlers[msg.Type]
-			if !ok {
-				return
+			e, err := decodeDelivery(msg)
+			if err != nil {
+				r.runtime.Log().Errorf("rabbitmq: can not decode message %s: %v", msg.Type, err)
+				r.moveTo(rejectQueue, d, err)
+				return nil
 			}
-			r.mtx.Unlock()
+
+			handlers := r.handlersOf(msg.Exchange, e)
+			if len(handlers) == 0 {
+				err := errors.Errorf("no handler of %s from %s", e.Type, e.Source)
+				r.runtime.Log().Errorf("rabbitmq: can not handle message %s: %v", msg.Type, err)
+				r.moveTo(rejectQueue, d, err)
+				return nil
+			}
+
+			// invalid payloads are not handler failures, they are moved
+			// to the reject queue and do not trip the circuit breaker
+			if e.Data, err = r.schemas.validateConsume(msg.Exchange, e.Type, e.Data, msg.Headers); err != nil {
+				r.runtime.Log().Errorf("rabbitmq: invalid message %s: %v", msg.Type, err)
+				r.moveTo(rejectQueue, d, err)
+				return nil
+			}
+
+			r.tap(AuditDirectionConsume, msg.Exchange, e.Type, &PublishOptions{Headers: msg.Headers}, e.Data)
 
 			headers := make(map[string]string)
 			for k, v := range msg.Headers {
 				headers[k], _ = v.(string)
 			}
 
-			ctx = context.WithValue(ctx, "headers", headers)
+			ctx := context.WithValue(context.Background(), "headers", headers)
+			ctx = context.WithValue(ctx, ack{}, d.ack)
+			ctx = context.WithValue(ctx, reject{}, d.reject)
 
+			hub := r.deliveryHub(queue, msg, e)
+			if hub != nil {
+				ctx = sentry.SetHubOnContext(ctx, hub)
+			}
+
+			panicked := false
 			for _, h := range handlers {
-				h(ctx, []byte(e.Payload))
+				if r.call(ctx, hub, d, opts.RequeueOnError, rejectQueue, h, e) {
+					panicked = true
+				}
+			}
+
+			if d.failed {
+				err := errors.Errorf("rabbitmq: message %s rejected by handler", msg.Type)
+				// panics are reported by call with the stack trace
+				if hub != nil && !panicked {
+					hub.CaptureException(err)
+				}
+				return err
 			}
+
+			return d.ack(false)
 		},
 	}
 
@@ -212,10 +413,111 @@ func (r *broker) Subscribe(exchange, queue, event string, handler CallHandler, o
 	return &c, nil
 }
 
+// handlersOf returns the handlers of the decoded event, matched by its source
+// or, for producers using their own source, by the exchange it was delivered from
+func (r *broker) handlersOf(exchange string, e CloudEvent) []CloudEventHandler {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	handlers := r.handlers[fmt.Sprintf("%s:%s", e.Source, e.Type)]
+	if len(handlers) == 0 {
+		handlers = r.handlers[fmt.Sprintf("%s:%s", exchange, e.Type)]
+	}
+	// unsubscribe removes handlers in place
+	return append([]CloudEventHandler(nil), handlers...)
+}
+
 func (r *broker) Connected() error {
 	return r.conn.Connected()
 }
 
+func (r *broker) State() ConnectionState {
+	return r.conn.State()
+}
+
+func (r *broker) OnStateChange(fn StateChangeHandler) {
+	r.conn.OnStateChange(fn)
+}
+
+// moveTo settles the delivery by moving it into the queue with the reason,
+// the message is dropped if it can not be moved
+func (r *broker) moveTo(queue string, d *delivery, reason error) {
+	if err := r.rejectTo(queue, d.msg, reason.Error()); err != nil {
+		r.runtime.Log().Errorf("rabbitmq: can not move message %s to %s: %v", d.msg.Type, queue, err)
+		d.reject(false)
+		return
+	}
+	d.ack(false)
+}
+
+// rejectTo republishes the original message into the durable queue with
+// the rejection reason in the headers
+func (r *broker) rejectTo(queue string, msg amqp.Delivery, reason string) error {
+	ch, err := r.Channel()
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+
+	if _, err := ch.QueueDeclare(queue, true, false, false, false, nil); err != nil {
+		return err
+	}
+
+	headers := amqp.Table{}
+	for k, v := range msg.Headers {
+		headers[k] = v
+	}
+	headers[headerRejectionReason] = reason
+
+	return ch.PublishWithContext(context.Background(), "", queue, false, false, amqp.Publishing{
+		Headers:         headers,
+		ContentType:     msg.ContentType,
+		ContentEncoding: msg.ContentEncoding,
+		DeliveryMode:    amqp.Persistent,
+		MessageId:       msg.MessageId,
+		Timestamp:       msg.Timestamp,
+		Type:            msg.Type,
+		Body:            msg.Body,
+	})
+}
+
+// declareExchange makes sure the exchange exists, an existing exchange is kept as is
+func (r *broker) declareExchange(name string) error {
+	ch, err := r.Channel()
+	if err != nil {
+		return err
+	}
+
+	// a failed passive declare closes the channel
+	if err := ch.ExchangeDeclarePassive(name, "fanout", true, false, false, false, nil); err == nil {
+		return ch.Close()
+	}
+
+	if ch, err = r.Channel(); err != nil {
+		return err
+	}
+	defer ch.Close()
+
+	return ch.ExchangeDeclare(name, "fanout", true, false, false, false, nil)
+}
+
+// QueueStats inspects the queue with a passive declare on a dedicated channel,
+// since the broker closes the channel if the queue does not exist.
+func (r *broker) QueueStats(queue string) (QueueStats, error) {
+	ch, err := r.Channel()
+	if err != nil {
+		return QueueStats{}, err
+	}
+	defer ch.Close()
+
+	q, err := ch.QueueDeclarePassive(queue, false, false, false, false, nil)
+	if err != nil {
+		return QueueStats{}, err
+	}
+
+	return QueueStats{Name: q.Name, Messages: q.Messages, Consumers: q.Consumers}, nil
+}
+
 func (r *broker) Channel() (*amqp.Channel, error) {
 	return r.conn.Channel()
 }
@@ -225,6 +527,18 @@ func (r *broker) Connect() error {
 		r.conn = newConnection(r.runtime, r.exchange, r.endpoints, r.opts.PrefetchCount, r.opts.PrefetchGlobal)
 	}
 
+	keys, err := newKeyring(r.opts.EncryptionKeys, r.opts.EncryptionKeyID, r.opts.EncryptionRequired)
+	if err != nil {
+		return err
+	}
+	r.keys = keys
+
+	if r.audit == nil {
+		if r.audit, err = newAuditTap(r.opts.AuditFile, r.opts.AuditMaxSize, r.opts.AuditMaxFiles, r.opts.AuditRedact); err != nil {
+			return err
+		}
+	}
+
 	conf := defaultAmqpConfig
 
 	if r.opts.TLSVerify {
@@ -251,5 +565,9 @@ func (r *broker) Disconnect() error {
 
 	r.wg.Wait()
 
+	if aerr := r.audit.Close(); err == nil {
+		err = aerr
+	}
+
 	return err
 }
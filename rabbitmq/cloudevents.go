@@ -0,0 +1,353 @@
+/*
+Copyright [2014] - [2024] The Last.Backend authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rabbitmq
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	cloudEventsSpecVersion  = "1.0"
+	cloudEventsHeaderPrefix = "ce-"
+	cloudEventsContentType  = "application/cloudevents+json"
+	defaultDataContentType  = "application/json"
+)
+
+// CloudEventsMode selects how events are encoded on the wire.
+type CloudEventsMode string
+
+const (
+	// CloudEventsDisabled keeps the {event,payload} JSON envelope.
+	CloudEventsDisabled CloudEventsMode = ""
+	// CloudEventsBinary puts the event attributes into ce- headers and the data into the body.
+	CloudEventsBinary CloudEventsMode = "binary"
+	// CloudEventsStructured puts the whole event, attributes and data, into a JSON body.
+	CloudEventsStructured CloudEventsMode = "structured"
+)
+
+// CloudEvent is a CloudEvents 1.0 event.
+// Events published with the legacy envelope are converted on consume,
+// so handlers get a CloudEvent regardless of how the producer encoded it.
+type CloudEvent struct {
+	ID              string
+	Source          string
+	SpecVersion     string
+	Type            string
+	DataContentType string
+	DataSchema      string
+	Subject         string
+	Time            time.Time
+	Extensions      map[string]interface{}
+	Data            []byte
+}
+
+// CloudEventHandler is a subscription handler which gets the decoded CloudEvent.
+type CloudEventHandler func(ctx context.Context, event CloudEvent)
+
+func newCloudEvent(source, event string, payload []byte, opts *PublishOptions) CloudEvent {
+	e := CloudEvent{
+		ID:              uuid.NewString(),
+		Source:          source,
+		SpecVersion:     cloudEventsSpecVersion,
+		Type:            event,
+		DataContentType: opts.ContentType,
+		Subject:         opts.Subject,
+		Time:            time.Now().UTC(),
+		Extensions:      opts.Extensions,
+		Data:            payload,
+	}
+
+	if e.DataContentType == "" {
+		e.DataContentType = defaultDataContentType
+	}
+
+	return e
+}
+
+// isJSON reports whether the data content type is JSON,
+// in which case structured mode embeds data as is instead of base64.
+func (e CloudEvent) isJSON() bool {
+	ct := strings.ToLower(e.DataContentType)
+	return ct == "" || strings.HasPrefix(ct, "application/json") || strings.HasSuffix(strings.SplitN(ct, ";", 2)[0], "+json")
+}
+
+func (e CloudEvent) MarshalJSON() ([]byte, error) {
+	m := make(map[string]interface{}, len(e.Extensions)+9)
+	for k, v := range e.Extensions {
+		m[k] = v
+	}
+
+	m["id"] = e.ID
+	m["source"] = e.Source
+	m["specversion"] = e.SpecVersion
+	m["type"] = e.Type
+	if e.DataContentType != "" {
+		m["datacontenttype"] = e.DataContentType
+	}
+	if e.DataSchema != "" {
+		m["dataschema"] = e.DataSchema
+	}
+	if e.Subject != "" {
+		m["subject"] = e.Subject
+	}
+	if !e.Time.IsZero() {
+		m["time"] = e.Time.Format(time.RFC3339Nano)
+	}
+
+	if e.Data != nil {
+		if e.isJSON() && json.Valid(e.Data) {
+			m["data"] = json.RawMessage(e.Data)
+		} else {
+			m["data_base64"] = base64.StdEncoding.EncodeToString(e.Data)
+		}
+	}
+
+	return json.Marshal(m)
+}
+
+func (e *CloudEvent) UnmarshalJSON(data []byte) error {
+	m := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(data, &m); err != nil {
+		return err
+	}
+
+	str := func(key string) (string, error) {
+		raw, ok := m[key]
+		if !ok {
+			return "", nil
+		}
+		delete(m, key)
+		var s string
+		if err := json.Unmarshal(raw, &s); err != nil {
+			return "", errors.Wrapf(err, "cloudevents: invalid %s attribute", key)
+		}
+		return s, nil
+	}
+
+	var err error
+	if e.ID, err = str("id"); err != nil {
+		return err
+	}
+	if e.Source, err = str("source"); err != nil {
+		return err
+	}
+	if e.SpecVersion, err = str("specversion"); err != nil {
+		return err
+	}
+	if e.Type, err = str("type"); err != nil {
+		return err
+	}
+	if e.DataContentType, err = str("datacontenttype"); err != nil {
+		return err
+	}
+	if e.DataSchema, err = str("dataschema"); err != nil {
+		return err
+	}
+	if e.Subject, err = str("subject"); err != nil {
+		return err
+	}
+
+	t, err := str("time")
+	if err != nil {
+		return err
+	}
+	if t != "" {
+		if e.Time, err = time.Parse(time.RFC3339Nano, t); err != nil {
+			return errors.Wrap(err, "cloudevents: invalid time attribute")
+		}
+	}
+
+	if raw, ok := m["data"]; ok {
+		delete(m, "data")
+		var s string
+		if !e.isJSON() && json.Unmarshal(raw, &s) == nil {
+			e.Data = []byte(s)
+		} else {
+			e.Data = raw
+		}
+	}
+
+	b64, err := str("data_base64")
+	if err != nil {
+		return err
+	}
+	if b64 != "" {
+		if e.Data, err = base64.StdEncoding.DecodeString(b64); err != nil {
+			return errors.Wrap(err, "cloudevents: invalid data_base64")
+		}
+	}
+
+	for k, raw := range m {
+		var v interface{}
+		if err := json.Unmarshal(raw, &v); err != nil {
+			return err
+		}
+		if e.Extensions == nil {
+			e.Extensions = make(map[string]interface{})
+		}
+		e.Extensions[k] = v
+	}
+
+	return e.validate()
+}
+
+func (e CloudEvent) validate() error {
+	switch {
+	case e.ID == "":
+		return errors.New("cloudevents: id attribute is required")
+	case e.Source == "":
+		return errors.New("cloudevents: source attribute is required")
+	case e.Type == "":
+		return errors.New("cloudevents: type attribute is required")
+	case e.SpecVersion != cloudEventsSpecVersion:
+		return errors.Errorf("cloudevents: unsupported specversion %q", e.SpecVersion)
+	}
+	return nil
+}
+
+// encodeCloudEvent fills msg according to the CloudEvents AMQP binding in the given mode
+func encodeCloudEvent(e CloudEvent, mode CloudEventsMode, msg *amqp.Publishing) error {
+	msg.MessageId = e.ID
+	msg.Timestamp = e.Time
+
+	switch mode {
+	case CloudEventsBinary:
+		msg.Headers[cloudEventsHeaderPrefix+"id"] = e.ID
+		msg.Headers[cloudEventsHeaderPrefix+"source"] = e.Source
+		msg.Headers[cloudEventsHeaderPrefix+"specversion"] = e.SpecVersion
+		msg.Headers[cloudEventsHeaderPrefix+"type"] = e.Type
+		msg.Headers[cloudEventsHeaderPrefix+"time"] = e.Time.Format(time.RFC3339Nano)
+		if e.DataSchema != "" {
+			msg.Headers[cloudEventsHeaderPrefix+"dataschema"] = e.DataSchema
+		}
+		if e.Subject != "" {
+			msg.Headers[cloudEventsHeaderPrefix+"subject"] = e.Subject
+		}
+		for k, v := range e.Extensions {
+			msg.Headers[cloudEventsHeaderPrefix+k] = v
+		}
+		msg.ContentType = e.DataContentType
+		msg.Body = e.Data
+	case CloudEventsStructured:
+		body, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		msg.ContentType = cloudEventsContentType
+		msg.Body = body
+	default:
+		return errors.Errorf("cloudevents: unknown mode %q", mode)
+	}
+
+	return nil
+}
+
+// decodeDelivery converts any supported message encoding into a CloudEvent:
+// binary mode (ce- headers), structured mode (application/cloudevents+json)
+// and the legacy {event,payload} envelope.
+func decodeDelivery(msg amqp.Delivery) (CloudEvent, error) {
+	if _, ok := msg.Headers[cloudEventsHeaderPrefix+"specversion"]; ok {
+		return decodeBinaryCloudEvent(msg)
+	}
+
+	if strings.HasPrefix(msg.ContentType, cloudEventsContentType) {
+		e := CloudEvent{}
+		if err := json.Unmarshal(msg.Body, &e); err != nil {
+			return e, err
+		}
+		return e, nil
+	}
+
+	m := message{}
+	if err := json.Unmarshal(msg.Body, &m); err != nil {
+		return CloudEvent{}, err
+	}
+
+	e := CloudEvent{
+		ID:              msg.MessageId,
+		Source:          msg.Exchange,
+		SpecVersion:     cloudEventsSpecVersion,
+		Type:            m.Event,
+		DataContentType: defaultDataContentType,
+		Time:            msg.Timestamp,
+		Data:            []byte(m.Payload),
+	}
+
+	return e, nil
+}
+
+func decodeBinaryCloudEvent(msg amqp.Delivery) (CloudEvent, error) {
+	e := CloudEvent{
+		DataContentType: msg.ContentType,
+		Data:            msg.Body,
+	}
+
+	for k, v := range msg.Headers {
+		if !strings.HasPrefix(k, cloudEventsHeaderPrefix) {
+			continue
+		}
+
+		name := strings.TrimPrefix(k, cloudEventsHeaderPrefix)
+		s, _ := v.(string)
+
+		switch name {
+		case "id":
+			e.ID = s
+		case "source":
+			e.Source = s
+		case "specversion":
+			e.SpecVersion = s
+		case "type":
+			e.Type = s
+		case "dataschema":
+			e.DataSchema = s
+		case "subject":
+			e.Subject = s
+		case "time":
+			t, err := time.Parse(time.RFC3339Nano, s)
+			if err != nil {
+				return e, errors.Wrap(err, "cloudevents: invalid time attribute")
+			}
+			e.Time = t
+		default:
+			if e.Extensions == nil {
+				e.Extensions = make(map[string]interface{})
+			}
+			e.Extensions[name] = v
+		}
+	}
+
+	return e, e.validate()
+}
+
+func parseCloudEventsMode(mode string) (CloudEventsMode, error) {
+	switch m := CloudEventsMode(strings.ToLower(mode)); m {
+	case CloudEventsDisabled, CloudEventsBinary, CloudEventsStructured:
+		return m, nil
+	default:
+		return "", fmt.Errorf("unknown cloudevents mode %q, expected %q or %q", mode, CloudEventsBinary, CloudEventsStructured)
+	}
+}
@@ -0,0 +1,220 @@
+/*
+Copyright [2014] - [2024] The Last.Backend authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rabbitmq
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestCloudEventRoundTrip(t *testing.T) {
+	tests := []struct {
+		name        string
+		mode        CloudEventsMode
+		contentType string
+		data        []byte
+		extensions  map[string]interface{}
+	}{
+		{name: "binary json", mode: CloudEventsBinary, data: []byte(`{"id":1}`)},
+		{name: "binary bytes", mode: CloudEventsBinary, contentType: "application/octet-stream", data: []byte{0, 1, 2, 255}},
+		{name: "binary extensions", mode: CloudEventsBinary, data: []byte(`{}`), extensions: map[string]interface{}{"tenant": "acme"}},
+		{name: "structured json", mode: CloudEventsStructured, data: []byte(`{"id":1,"tags":["a","b"]}`)},
+		{name: "structured text", mode: CloudEventsStructured, contentType: "text/plain", data: []byte("hello")},
+		{name: "structured bytes", mode: CloudEventsStructured, contentType: "application/octet-stream", data: []byte{0, 1, 2, 255}},
+		{name: "structured invalid json", mode: CloudEventsStructured, data: []byte(`{"id":`)},
+		{name: "structured extensions", mode: CloudEventsStructured, data: []byte(`{}`), extensions: map[string]interface{}{"tenant": "acme"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := &PublishOptions{ContentType: tt.contentType, Subject: "orders/42", Extensions: tt.extensions}
+			in := newCloudEvent("orders", "created", tt.data, opts)
+
+			msg := amqp.Publishing{Headers: amqp.Table{}}
+			if err := encodeCloudEvent(in, tt.mode, &msg); err != nil {
+				t.Fatalf("encode: %v", err)
+			}
+
+			out, err := decodeDelivery(amqp.Delivery{
+				Headers:     msg.Headers,
+				ContentType: msg.ContentType,
+				Body:        msg.Body,
+				Exchange:    "orders",
+			})
+			if err != nil {
+				t.Fatalf("decode: %v", err)
+			}
+
+			if out.ID != in.ID || out.Source != in.Source || out.Type != in.Type || out.Subject != in.Subject {
+				t.Errorf("attributes: got %+v, want %+v", out, in)
+			}
+			if out.DataContentType != in.DataContentType {
+				t.Errorf("content type: got %q, want %q", out.DataContentType, in.DataContentType)
+			}
+			if !out.Time.Equal(in.Time) {
+				t.Errorf("time: got %s, want %s", out.Time, in.Time)
+			}
+			if !bytes.Equal(out.Data, in.Data) {
+				t.Errorf("data: got %q, want %q", out.Data, in.Data)
+			}
+			for k, v := range tt.extensions {
+				if out.Extensions[k] != v {
+					t.Errorf("extension %s: got %v, want %v", k, out.Extensions[k], v)
+				}
+			}
+		})
+	}
+}
+
+func TestDecodeDelivery(t *testing.T) {
+	ts := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	tests := []struct {
+		name    string
+		msg     amqp.Delivery
+		want    CloudEvent
+		wantErr bool
+	}{
+		{
+			name: "envelope",
+			msg: amqp.Delivery{
+				Exchange:  "orders",
+				MessageId: "1",
+				Timestamp: ts,
+				Body:      []byte(`{"event":"created","payload":"{\"id\":1}"}`),
+			},
+			want: CloudEvent{ID: "1", Source: "orders", Type: "created", Time: ts, Data: []byte(`{"id":1}`)},
+		},
+		{
+			name: "binary",
+			msg: amqp.Delivery{
+				Exchange: "orders",
+				Headers: amqp.Table{
+					"ce-id":          "2",
+					"ce-source":      "https://example.com/orders",
+					"ce-specversion": "1.0",
+					"ce-type":        "com.example.created",
+					"ce-time":        ts.Format(time.RFC3339Nano),
+				},
+				Body: []byte(`{}`),
+			},
+			want: CloudEvent{ID: "2", Source: "https://example.com/orders", Type: "com.example.created", Time: ts, Data: []byte(`{}`)},
+		},
+		{
+			name: "structured",
+			msg: amqp.Delivery{
+				ContentType: "application/cloudevents+json; charset=utf-8",
+				Body:        []byte(`{"id":"3","source":"orders","specversion":"1.0","type":"created","data":{"id":3}}`),
+			},
+			want: CloudEvent{ID: "3", Source: "orders", Type: "created", Data: []byte(`{"id":3}`)},
+		},
+		{
+			name: "binary without source",
+			msg: amqp.Delivery{
+				Headers: amqp.Table{"ce-id": "4", "ce-specversion": "1.0", "ce-type": "created"},
+			},
+			wantErr: true,
+		},
+		{
+			name: "binary unsupported specversion",
+			msg: amqp.Delivery{
+				Headers: amqp.Table{"ce-id": "5", "ce-source": "orders", "ce-specversion": "0.3", "ce-type": "created"},
+			},
+			wantErr: true,
+		},
+		{
+			name: "binary invalid time",
+			msg: amqp.Delivery{
+				Headers: amqp.Table{"ce-id": "6", "ce-source": "orders", "ce-specversion": "1.0", "ce-type": "created", "ce-time": "yesterday"},
+			},
+			wantErr: true,
+		},
+		{
+			name: "structured without id",
+			msg: amqp.Delivery{
+				ContentType: cloudEventsContentType,
+				Body:        []byte(`{"source":"orders","specversion":"1.0","type":"created"}`),
+			},
+			wantErr: true,
+		},
+		{
+			name: "structured invalid data_base64",
+			msg: amqp.Delivery{
+				ContentType: cloudEventsContentType,
+				Body:        []byte(`{"id":"7","source":"orders","specversion":"1.0","type":"created","data_base64":"%%%"}`),
+			},
+			wantErr: true,
+		},
+		{
+			name:    "envelope invalid json",
+			msg:     amqp.Delivery{Body: []byte(`{"event":`)},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decodeDelivery(tt.msg)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error: got %v, want error %t", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if got.ID != tt.want.ID || got.Source != tt.want.Source || got.Type != tt.want.Type || !got.Time.Equal(tt.want.Time) {
+				t.Errorf("attributes: got %+v, want %+v", got, tt.want)
+			}
+			if !bytes.Equal(got.Data, tt.want.Data) {
+				t.Errorf("data: got %q, want %q", got.Data, tt.want.Data)
+			}
+		})
+	}
+}
+
+func TestCloudEventMarshalJSON(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		data        []byte
+		key         string
+	}{
+		{name: "json is embedded", contentType: "application/json", data: []byte(`{"id":1}`), key: "data"},
+		{name: "json suffix is embedded", contentType: "application/vnd.order+json; charset=utf-8", data: []byte(`[1]`), key: "data"},
+		{name: "invalid json is base64", contentType: "application/json", data: []byte(`{`), key: "data_base64"},
+		{name: "text is base64", contentType: "text/plain", data: []byte(`hello`), key: "data_base64"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, err := json.Marshal(CloudEvent{ID: "1", Source: "s", SpecVersion: "1.0", Type: "t", DataContentType: tt.contentType, Data: tt.data})
+			if err != nil {
+				t.Fatal(err)
+			}
+			m := make(map[string]json.RawMessage)
+			if err := json.Unmarshal(body, &m); err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := m[tt.key]; !ok {
+				t.Errorf("%s is missing in %s", tt.key, body)
+			}
+		})
+	}
+}
@@ -0,0 +1,148 @@
+/*
+Copyright [2014] - [2024] The Last.Backend authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rabbitmq
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultCompressionThreshold = 1024
+	defaultMaxMessageSize       = 16 << 20
+)
+
+// Compression is the algorithm used to compress published payloads.
+// The value is sent as the message ContentEncoding.
+type Compression string
+
+const (
+	CompressionNone Compression = ""
+	CompressionGzip Compression = "gzip"
+	CompressionZstd Compression = "zstd"
+)
+
+var (
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdErr     error
+
+	// zstdDecoders holds a decoder per maximum message size
+	zstdDecoders sync.Map
+)
+
+// errMessageTooLarge is returned when a payload decompresses over the maximum message size
+var errMessageTooLarge = errors.New("decompressed message exceeds the maximum message size")
+
+// zstd encoder and decoders are safe for concurrent EncodeAll/DecodeAll calls,
+// so a single encoder is shared by all publishers and a decoder by the consumers with the same limit.
+func zstdEncoderOf() (*zstd.Encoder, error) {
+	zstdOnce.Do(func() {
+		zstdEncoder, zstdErr = zstd.NewWriter(nil)
+	})
+	return zstdEncoder, zstdErr
+}
+
+func zstdDecoderOf(limit int64) (*zstd.Decoder, error) {
+	if dec, ok := zstdDecoders.Load(limit); ok {
+		return dec.(*zstd.Decoder), nil
+	}
+	dec, err := zstd.NewReader(nil, zstd.WithDecoderMaxMemory(uint64(limit)))
+	if err != nil {
+		return nil, err
+	}
+	if prev, loaded := zstdDecoders.LoadOrStore(limit, dec); loaded {
+		dec.Close()
+		return prev.(*zstd.Decoder), nil
+	}
+	return dec, nil
+}
+
+func parseCompression(c string) (Compression, error) {
+	switch v := Compression(strings.ToLower(c)); v {
+	case CompressionNone, CompressionGzip, CompressionZstd:
+		return v, nil
+	default:
+		return "", errors.Errorf("unknown compression %q, expected %q or %q", c, CompressionGzip, CompressionZstd)
+	}
+}
+
+func compress(c Compression, body []byte) ([]byte, error) {
+	switch c {
+	case CompressionGzip:
+		buf := new(bytes.Buffer)
+		w := gzip.NewWriter(buf)
+		if _, err := w.Write(body); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case CompressionZstd:
+		enc, err := zstdEncoderOf()
+		if err != nil {
+			return nil, err
+		}
+		return enc.EncodeAll(body, make([]byte, 0, len(body)/2)), nil
+	default:
+		return nil, errors.Errorf("unsupported compression %q", c)
+	}
+}
+
+// decompress decodes the body according to the message ContentEncoding.
+// Messages without encoding are returned as is, so compressed and
+// uncompressed producers can publish into the same exchange.
+// Payloads decompressing over limit bytes fail with errMessageTooLarge.
+func decompress(encoding string, body []byte, limit int64) ([]byte, error) {
+	switch Compression(strings.ToLower(encoding)) {
+	case CompressionNone:
+		return body, nil
+	case CompressionGzip:
+		r, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		out, err := io.ReadAll(io.LimitReader(r, limit+1))
+		if err != nil {
+			return nil, err
+		}
+		if int64(len(out)) > limit {
+			return nil, errMessageTooLarge
+		}
+		return out, nil
+	case CompressionZstd:
+		dec, err := zstdDecoderOf(limit)
+		if err != nil {
+			return nil, err
+		}
+		out, err := dec.DecodeAll(body, nil)
+		if errors.Is(err, zstd.ErrDecoderSizeExceeded) {
+			return nil, errMessageTooLarge
+		}
+		return out, err
+	default:
+		return nil, errors.Errorf("unsupported content encoding %q", encoding)
+	}
+}
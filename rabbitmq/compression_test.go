@@ -0,0 +1,132 @@
+/*
+Copyright [2014] - [2024] The Last.Backend authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rabbitmq
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestCompressionRoundTrip(t *testing.T) {
+	payloads := map[string][]byte{
+		"empty":      {},
+		"text":       []byte("hello"),
+		"repetitive": bytes.Repeat([]byte(`{"id":1}`), 4096),
+		"binary":     {0, 1, 2, 255},
+	}
+
+	for _, c := range []Compression{CompressionGzip, CompressionZstd} {
+		for name, payload := range payloads {
+			t.Run(string(c)+" "+name, func(t *testing.T) {
+				body, err := compress(c, payload)
+				if err != nil {
+					t.Fatalf("compress: %v", err)
+				}
+				out, err := decompress(string(c), body, defaultMaxMessageSize)
+				if err != nil {
+					t.Fatalf("decompress: %v", err)
+				}
+				if !bytes.Equal(out, payload) {
+					t.Errorf("got %d bytes, want %d", len(out), len(payload))
+				}
+			})
+		}
+	}
+}
+
+func TestDecompressLimit(t *testing.T) {
+	payload := bytes.Repeat([]byte("a"), 64<<10)
+
+	tests := []struct {
+		name    string
+		c       Compression
+		limit   int64
+		wantErr error
+	}{
+		{name: "gzip under the limit", c: CompressionGzip, limit: 128 << 10},
+		{name: "gzip at the limit", c: CompressionGzip, limit: 64 << 10},
+		{name: "gzip over the limit", c: CompressionGzip, limit: 64<<10 - 1, wantErr: errMessageTooLarge},
+		{name: "zstd under the limit", c: CompressionZstd, limit: 128 << 10},
+		{name: "zstd at the limit", c: CompressionZstd, limit: 64 << 10},
+		{name: "zstd over the limit", c: CompressionZstd, limit: 32 << 10, wantErr: errMessageTooLarge},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, err := compress(tt.c, payload)
+			if err != nil {
+				t.Fatalf("compress: %v", err)
+			}
+			out, err := decompress(string(tt.c), body, tt.limit)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("error: got %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && len(out) != len(payload) {
+				t.Errorf("got %d bytes, want %d", len(out), len(payload))
+			}
+		})
+	}
+}
+
+func TestDecompressEncoding(t *testing.T) {
+	tests := []struct {
+		name     string
+		encoding string
+		body     []byte
+		wantErr  bool
+	}{
+		{name: "none is passed as is", encoding: "", body: []byte("plain")},
+		{name: "unknown encoding", encoding: "br", body: []byte("plain"), wantErr: true},
+		{name: "corrupt gzip", encoding: "gzip", body: []byte("plain"), wantErr: true},
+		{name: "corrupt zstd", encoding: "zstd", body: []byte("plain"), wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := decompress(tt.encoding, tt.body, defaultMaxMessageSize)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error: got %v, want error %t", err, tt.wantErr)
+			}
+			if err == nil && !bytes.Equal(out, tt.body) {
+				t.Errorf("got %q, want %q", out, tt.body)
+			}
+		})
+	}
+}
+
+func TestParseCompression(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    Compression
+		wantErr bool
+	}{
+		{in: "", want: CompressionNone},
+		{in: "GZIP", want: CompressionGzip},
+		{in: "zstd", want: CompressionZstd},
+		{in: "lz4", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := parseCompression(tt.in)
+			if (err != nil) != tt.wantErr || got != tt.want {
+				t.Errorf("got %q, %v, want %q, error %t", got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
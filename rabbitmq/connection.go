@@ -60,9 +60,10 @@ type amqpConn struct {
 	prefetchCount   int
 	prefetchGlobal  bool
 
-	err       error
-	connected bool
-	close     chan bool
+	err           error
+	state         ConnectionState
+	stateHandlers []StateChangeHandler
+	close         chan bool
 
 	waitConnection chan struct{}
 }
@@ -96,12 +97,14 @@ func newConnection(runtime runtime.Runtime, ex Exchange, urls []string, prefetch
 }
 
 func (a *amqpConn) connect(secure bool, config *amqp.Config) error {
+	a.setState(StateConnecting, nil)
+
 	if err := a.tryConnect(secure, config); err != nil {
+		a.setState(StateClosed, err)
 		return err
 	}
 
-	a.connected = true
-	a.err = nil
+	a.setState(StateConnected, nil)
 
 	go a.reconnect(secure, config)
 
@@ -111,18 +114,28 @@ func (a *amqpConn) connect(secure bool, config *amqp.Config) error {
 func (a *amqpConn) reconnect(secure bool, config *amqp.Config) {
 
 	for {
-		if !a.connected {
+		select {
+		case <-a.close:
+			return
+		default:
+		}
+
+		if !a.isConnected() {
 			if err := a.tryConnect(secure, config); err != nil {
-				time.Sleep(5 * time.Second)
+				a.runtime.Log().Error(err)
+				select {
+				case <-a.close:
+					return
+				case <-time.After(5 * time.Second):
+				}
 				continue
 			}
 
-			a.Lock()
-			a.connected = true
-			a.err = nil
-			a.Unlock()
+			a.setState(StateConnected, nil)
 
+			a.Lock()
 			close(a.waitConnection)
+			a.Unlock()
 		}
 
 		notifyClose := make(chan *amqp.Error)
@@ -130,28 +143,34 @@ func (a *amqpConn) reconnect(secure bool, config *amqp.Config) {
 		chanNotifyClose := make(chan *amqp.Error)
 		channel := a.exchangeChannel.channel
 		channel.NotifyClose(chanNotifyClose)
+		notifyBlocked := a.conn.NotifyBlocked(make(chan amqp.Blocking, 1))
 
 		for notifyClose != nil || chanNotifyClose != nil {
 			select {
+			case b, ok := <-notifyBlocked:
+				if !ok {
+					notifyBlocked = nil
+					continue
+				}
+				// the connection is being replaced, its flow control does not matter anymore
+				if s := a.State(); s == StateReconnecting || s == StateClosed {
+					continue
+				}
+				if b.Active {
+					a.setState(StateBlocked, errors.Errorf("connection blocked: %s", b.Reason))
+				} else {
+					a.setState(StateConnected, nil)
+				}
 			case err := <-chanNotifyClose:
 				a.runtime.Log().Error(err)
-
-				a.Lock()
-				a.connected = false
-				a.err = err
-				a.waitConnection = make(chan struct{})
-				a.Unlock()
-
+				a.lost(err)
 				chanNotifyClose = nil
+				// the exchange channel is opened with the connection, closing
+				// the connection makes the loop reconnect both
+				_ = a.conn.Close()
 			case err := <-notifyClose:
 				a.runtime.Log().Error(err)
-
-				a.Lock()
-				a.connected = false
-				a.err = err
-				a.waitConnection = make(chan struct{})
-				a.Unlock()
-
+				a.lost(err)
 				notifyClose = nil
 			case <-a.close:
 				return
@@ -160,14 +179,76 @@ func (a *amqpConn) reconnect(secure bool, config *amqp.Config) {
 	}
 }
 
-func (a *amqpConn) Connect(secure bool, config *amqp.Config) error {
+// lost marks the connection as lost and makes consumers wait for the reconnect
+func (a *amqpConn) lost(err *amqp.Error) {
+	var cause error = errors.New("connection lost")
+	if err != nil {
+		cause = err
+	}
+
+	a.Lock()
+	if a.state != StateReconnecting && a.state != StateClosed {
+		a.waitConnection = make(chan struct{})
+	}
+	a.Unlock()
+
+	a.setState(StateReconnecting, cause)
+}
+
+// setState switches the connection state and notifies the state handlers
+// registered with OnStateChange. Handlers are called outside the lock.
+func (a *amqpConn) setState(state ConnectionState, err error) {
 	a.Lock()
-	if a.connected {
+	prev := a.state
+	if prev == StateClosed && state != StateConnecting {
 		a.Unlock()
-		return nil
+		return
 	}
+	a.state = state
+	a.err = err
+	handlers := make([]StateChangeHandler, len(a.stateHandlers))
+	copy(handlers, a.stateHandlers)
 	a.Unlock()
 
+	if prev == state {
+		return
+	}
+
+	for _, fn := range handlers {
+		fn(prev, state, err)
+	}
+}
+
+func (a *amqpConn) isConnected() bool {
+	a.Lock()
+	defer a.Unlock()
+	return a.state == StateConnected || a.state == StateBlocked
+}
+
+// connection returns a channel which is closed while the connection is available
+func (a *amqpConn) connection() <-chan struct{} {
+	a.Lock()
+	defer a.Unlock()
+	return a.waitConnection
+}
+
+func (a *amqpConn) OnStateChange(fn StateChangeHandler) {
+	a.Lock()
+	defer a.Unlock()
+	a.stateHandlers = append(a.stateHandlers, fn)
+}
+
+func (a *amqpConn) State() ConnectionState {
+	a.Lock()
+	defer a.Unlock()
+	return a.state
+}
+
+func (a *amqpConn) Connect(secure bool, config *amqp.Config) error {
+	if a.isConnected() {
+		return nil
+	}
+
 	select {
 	case <-a.close:
 		a.close = make(chan bool)
@@ -177,8 +258,20 @@ func (a *amqpConn) Connect(secure bool, config *amqp.Config) error {
 	return a.connect(secure, config)
 }
 
+// Connected returns nil if the connection is usable, and the reason otherwise
 func (a *amqpConn) Connected() error {
-	return a.err
+	a.Lock()
+	defer a.Unlock()
+
+	switch a.state {
+	case StateConnected, StateBlocked:
+		return nil
+	default:
+		if a.err != nil {
+			return a.err
+		}
+		return errors.Errorf("connection is %s", a.state)
+	}
 }
 
 func (a *amqpConn) Close() error {
@@ -191,15 +284,14 @@ func (a *amqpConn) Close() error {
 		return nil
 	default:
 		close(a.close)
-		a.connected = false
-		a.err = errors.New("connection closed")
+		a.setState(StateClosed, errors.New("connection closed"))
 	}
 
 	return a.conn.Close()
 }
 
 func (a *amqpConn) Channel() (*amqp.Channel, error) {
-	if !a.connected {
+	if !a.isConnected() {
 		return nil, errors.New("connection closed")
 	}
 	return a.conn.Channel()
@@ -17,16 +17,18 @@ limitations under the License.
 package rabbitmq
 
 import (
+	"context"
 	"sync"
 	"time"
 
 	"github.com/lastbackend/toolkit/pkg/runtime"
 	amqp "github.com/rabbitmq/amqp091-go"
+	"golang.org/x/time/rate"
 )
 
 type consumer struct {
 	runtime      runtime.Runtime
-	done         bool
+	done         chan struct{}
 	mtx          sync.Mutex
 	exchange     string
 	queue        string
@@ -35,16 +37,55 @@ type consumer struct {
 	autoAck      bool
 	broker       *broker
 	ch           *amqpChannel
-	fn           func(msg amqp.Delivery)
+	fn           func(msg amqp.Delivery) error
 	headers      map[string]interface{}
 	queueArgs    map[string]interface{}
 	unsubscribe  func()
+	limiter      *rate.Limiter
+	breaker      *circuitBreaker
+}
+
+// delivery tracks how the handlers settled a message.
+// Its ack and reject methods are passed to the handlers through the context.
+type delivery struct {
+	msg     amqp.Delivery
+	autoAck bool
+	settled bool
+	failed  bool
+}
+
+func (d *delivery) ack(multiple bool) error {
+	if d.settled {
+		return nil
+	}
+	d.settled = true
+	if d.autoAck {
+		return nil
+	}
+	return d.msg.Ack(multiple)
+}
+
+func (d *delivery) reject(requeue bool) error {
+	d.failed = true
+	if d.settled {
+		return nil
+	}
+	d.settled = true
+	if d.autoAck {
+		return nil
+	}
+	return d.msg.Reject(requeue)
 }
 
 func (c *consumer) Unsubscribe() error {
 	c.mtx.Lock()
 	defer c.mtx.Unlock()
-	c.done = true
+
+	select {
+	case <-c.done:
+	default:
+		close(c.done)
+	}
 
 	if c.ch != nil {
 		return c.ch.Close()
@@ -64,21 +105,37 @@ func (c *consumer) consume() {
 	expFactor := time.Duration(2)
 	delay := minDelay
 
+	// cancels rate limiter waits on unsubscribe and shutdown
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-c.done:
+		case <-c.broker.conn.close:
+		case <-ctx.Done():
+		}
+		cancel()
+	}()
+
 	for {
-		if c.done {
+		select {
+		case <-c.done:
 			return
+		default:
 		}
 
 		select {
+		case <-c.done:
+			return
 		case <-c.broker.conn.close:
 			return
-		case <-c.broker.conn.waitConnection:
+		case <-c.broker.conn.connection():
 		case <-time.After(time.Second):
 			continue
 		}
 
 		c.broker.mtx.Lock()
-		if !c.broker.conn.connected {
+		if !c.broker.conn.isConnected() {
 			c.broker.mtx.Unlock()
 			time.Sleep(1 * time.Second)
 			continue
@@ -114,10 +171,47 @@ func (c *consumer) consume() {
 		c.ch = ch
 		c.mtx.Unlock()
 
-		for d := range sub {
-			c.broker.wg.Add(1)
-			c.fn(d)
-			c.broker.wg.Done()
+		if c.deliver(ctx, sub) {
+			continue
+		}
+
+		// the breaker is open: closing the channel cancels the consumer and
+		// returns prefetched unacknowledged messages to the queue
+		ch.Close()
+		c.runtime.Log().Warnf("rabbitmq: consumer of %s paused for %s after handler failures", c.queue, c.breaker.coolDown)
+
+		coolDown := time.NewTimer(c.breaker.coolDown)
+		select {
+		case <-c.done:
+			coolDown.Stop()
+			return
+		case <-c.broker.conn.close:
+			coolDown.Stop()
+			return
+		case <-coolDown.C:
+		}
+	}
+}
+
+// deliver passes messages to the handler until the channel is closed,
+// it returns false if the circuit breaker opened
+func (c *consumer) deliver(ctx context.Context, sub <-chan amqp.Delivery) bool {
+	for d := range sub {
+		if c.limiter != nil {
+			if err := c.limiter.Wait(ctx); err != nil {
+				// the consumer is stopping, hand the message back to the queue
+				_ = d.Nack(false, true)
+				return true
+			}
+		}
+
+		c.broker.wg.Add(1)
+		err := c.fn(d)
+		c.broker.wg.Done()
+
+		if c.breaker != nil && !c.breaker.report(err == nil) {
+			return false
 		}
 	}
+	return true
 }
@@ -0,0 +1,154 @@
+/*
+Copyright [2014] - [2024] The Last.Backend authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rabbitmq
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"io"
+	"strings"
+
+	"github.com/pkg/errors"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	headerEncryptionKeyID = "x-encryption-key-id"
+)
+
+// keyring holds the AES-GCM keys used for payload encryption.
+// Messages are encrypted with the active key only, while all keys can decrypt,
+// so a key is rotated by adding the new one, switching the active id and
+// removing the old key once no messages encrypted with it are left.
+type keyring struct {
+	active   string
+	required bool
+	keys     map[string]cipher.AEAD
+}
+
+// newKeyring parses keys in the id:base64key,id:base64key form,
+// it returns nil when no keys are configured
+func newKeyring(keys, active string, required bool) (*keyring, error) {
+	keys = strings.TrimSpace(keys)
+	if keys == "" {
+		if active != "" {
+			return nil, errors.Errorf("encryption key %s is not configured", active)
+		}
+		if required {
+			return nil, errors.New("encryption is required, but no keys are configured")
+		}
+		return nil, nil
+	}
+
+	k := &keyring{
+		active:   active,
+		required: required,
+		keys:     make(map[string]cipher.AEAD),
+	}
+
+	for _, pair := range strings.Split(keys, ",") {
+		parts := strings.SplitN(strings.TrimSpace(pair), ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, errors.New("encryption keys must be in the id:base64key format")
+		}
+
+		secret, err := base64.StdEncoding.DecodeString(parts[1])
+		if err != nil {
+			return nil, errors.Wrapf(err, "encryption key %s", parts[0])
+		}
+
+		// aes.NewCipher selects AES-128, AES-192 or AES-256 by the key length
+		block, err := aes.NewCipher(secret)
+		if err != nil {
+			return nil, errors.Wrapf(err, "encryption key %s", parts[0])
+		}
+
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, errors.Wrapf(err, "encryption key %s", parts[0])
+		}
+
+		k.keys[parts[0]] = aead
+	}
+
+	if k.active != "" {
+		if _, ok := k.keys[k.active]; !ok {
+			return nil, errors.Errorf("encryption key %s is not configured", k.active)
+		}
+	}
+
+	return k, nil
+}
+
+// encrypt seals the body with the active key, the nonce is prepended to the ciphertext.
+// The message type is authenticated too, so a payload can not be replayed as another event.
+func (k *keyring) encrypt(m *amqp.Publishing) error {
+	if k == nil || k.active == "" {
+		return nil
+	}
+
+	aead := k.keys[k.active]
+
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(m.Body)+aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return err
+	}
+
+	m.Body = aead.Seal(nonce, nonce, m.Body, []byte(m.Type))
+	m.Headers[headerEncryptionKeyID] = k.active
+
+	return nil
+}
+
+// decrypt opens the body of an encrypted message, messages without
+// the key id header are passed as is unless encryption is required
+func (k *keyring) decrypt(msg *amqp.Delivery) error {
+	v, ok := msg.Headers[headerEncryptionKeyID]
+	if !ok {
+		if k != nil && k.required {
+			return errors.New("message is not encrypted")
+		}
+		return nil
+	}
+
+	id, _ := v.(string)
+
+	if k == nil {
+		return errors.Errorf("message is encrypted with key %q, but encryption is not configured", id)
+	}
+
+	aead, ok := k.keys[id]
+	if !ok {
+		return errors.Errorf("message is encrypted with unknown key %q", id)
+	}
+
+	if len(msg.Body) < aead.NonceSize() {
+		return errors.New("encrypted message is too short")
+	}
+
+	nonce, ciphertext := msg.Body[:aead.NonceSize()], msg.Body[aead.NonceSize():]
+
+	body, err := aead.Open(nil, nonce, ciphertext, []byte(msg.Type))
+	if err != nil {
+		return errors.Wrapf(err, "can not decrypt message with key %q", id)
+	}
+
+	msg.Body = body
+	return nil
+}
@@ -0,0 +1,164 @@
+/*
+Copyright [2014] - [2024] The Last.Backend authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rabbitmq
+
+import (
+	"bytes"
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func testKey(size int, b byte) string {
+	return base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{b}, size))
+}
+
+func TestNewKeyring(t *testing.T) {
+	tests := []struct {
+		name     string
+		keys     string
+		active   string
+		required bool
+		wantNil  bool
+		wantErr  bool
+	}{
+		{name: "disabled", wantNil: true},
+		{name: "aes-128", keys: "k1:" + testKey(16, 1), active: "k1"},
+		{name: "aes-192", keys: "k1:" + testKey(24, 1), active: "k1"},
+		{name: "aes-256", keys: "k1:" + testKey(32, 1), active: "k1"},
+		{name: "decrypt only", keys: "k1:" + testKey(32, 1)},
+		{name: "rotation", keys: "k1:" + testKey(32, 1) + ", k2:" + testKey(32, 2), active: "k2"},
+		{name: "required", keys: "k1:" + testKey(32, 1), required: true},
+		{name: "required without keys", required: true, wantErr: true},
+		{name: "active without keys", active: "k1", wantErr: true},
+		{name: "unknown active", keys: "k1:" + testKey(32, 1), active: "k2", wantErr: true},
+		{name: "missing id", keys: ":" + testKey(32, 1), wantErr: true},
+		{name: "missing key", keys: "k1", wantErr: true},
+		{name: "invalid base64", keys: "k1:%%%", wantErr: true},
+		{name: "invalid size", keys: "k1:" + testKey(20, 1), wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			k, err := newKeyring(tt.keys, tt.active, tt.required)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error: got %v, want error %t", err, tt.wantErr)
+			}
+			if err == nil && (k == nil) != tt.wantNil {
+				t.Errorf("got %v, want nil %t", k, tt.wantNil)
+			}
+		})
+	}
+}
+
+func TestKeyringDecrypt(t *testing.T) {
+	k1 := "k1:" + testKey(32, 1)
+	k2 := "k2:" + testKey(32, 2)
+
+	tests := []struct {
+		name string
+		// encrypt and decrypt are the keyrings of the publisher and the consumer, in the newKeyring form
+		encrypt, active string
+		decrypt         string
+		required        bool
+		// tamper changes the message after encryption
+		tamper  func(m *amqp.Delivery)
+		wantErr string
+	}{
+		{name: "same key", encrypt: k1, active: "k1", decrypt: k1},
+		{name: "rotated key", encrypt: k1, active: "k1", decrypt: k2 + "," + k1},
+		{name: "plain message", decrypt: k1},
+		{name: "plain message to a plain consumer"},
+		{name: "plain message required", decrypt: k1, required: true, wantErr: "not encrypted"},
+		{name: "removed key", encrypt: k1, active: "k1", decrypt: k2, wantErr: "unknown key"},
+		{name: "encryption not configured", encrypt: k1, active: "k1", wantErr: "not configured"},
+		{
+			name: "other type", encrypt: k1, active: "k1", decrypt: k1,
+			tamper:  func(m *amqp.Delivery) { m.Type = "orders:deleted" },
+			wantErr: "can not decrypt",
+		},
+		{
+			name: "modified body", encrypt: k1, active: "k1", decrypt: k1,
+			tamper:  func(m *amqp.Delivery) { m.Body[len(m.Body)-1] ^= 1 },
+			wantErr: "can not decrypt",
+		},
+		{
+			name: "short body", encrypt: k1, active: "k1", decrypt: k1,
+			tamper:  func(m *amqp.Delivery) { m.Body = m.Body[:4] },
+			wantErr: "too short",
+		},
+	}
+
+	payload := []byte(`{"id":1}`)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pub, err := newKeyring(tt.encrypt, tt.active, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sub, err := newKeyring(tt.decrypt, "", tt.required)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			m := amqp.Publishing{Type: "orders:created", Headers: amqp.Table{}, Body: append([]byte(nil), payload...)}
+			if err := pub.encrypt(&m); err != nil {
+				t.Fatalf("encrypt: %v", err)
+			}
+			if tt.active != "" && bytes.Contains(m.Body, payload) {
+				t.Fatal("the payload is not encrypted")
+			}
+
+			d := amqp.Delivery{Type: m.Type, Headers: m.Headers, Body: m.Body}
+			if tt.tamper != nil {
+				tt.tamper(&d)
+			}
+
+			err = sub.decrypt(&d)
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Fatalf("decrypt: %v", err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Fatalf("error: got %v, want %q", err, tt.wantErr)
+			case err == nil && !bytes.Equal(d.Body, payload):
+				t.Errorf("got %q, want %q", d.Body, payload)
+			}
+		})
+	}
+}
+
+func TestKeyringNonce(t *testing.T) {
+	k, err := newKeyring("k1:"+testKey(32, 1), "k1", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seal := func() []byte {
+		m := amqp.Publishing{Type: "orders:created", Headers: amqp.Table{}, Body: []byte("payload")}
+		if err := k.encrypt(&m); err != nil {
+			t.Fatal(err)
+		}
+		return m.Body
+	}
+
+	if bytes.Equal(seal(), seal()) {
+		t.Error("the same payload is sealed into the same ciphertext")
+	}
+}
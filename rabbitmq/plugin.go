@@ -25,6 +25,7 @@ import (
 	"github.com/lastbackend/toolkit/pkg/runtime"
 	"github.com/lastbackend/toolkit/pkg/runtime/logger"
 	"github.com/lastbackend/toolkit/pkg/tools/probes"
+	"github.com/pkg/errors"
 	amqp "github.com/rabbitmq/amqp091-go"
 	"github.com/testcontainers/testcontainers-go"
 	"github.com/testcontainers/testcontainers-go/wait"
@@ -41,12 +42,39 @@ const (
 
 type Plugin interface {
 	Publish(ctx context.Context, event string, payload []byte, opts *PublishOptions) error
+	// PublishBatch publishes the events over one channel with a single confirmation wait.
+	// The returned slice holds the result of every event by its index, the error is
+	// returned when the batch could not be started at all.
+	PublishBatch(ctx context.Context, events []BatchEvent) ([]error, error)
+	// PublishTo publishes the event into the exchange of another service, it is used to replay audit records
+	PublishTo(ctx context.Context, exchange, event string, payload []byte, opts *PublishOptions) error
+	// DeclareExchange declares the exchange of a service if it does not exist
+	DeclareExchange(name string) error
 	Subscribe(service, event string, handler CallHandler, opts *SubscribeOptions) (Subscriber, error)
+	// SubscribeCloudEvents subscribes to the event and passes the decoded CloudEvent to the handler
+	SubscribeCloudEvents(service, event string, handler CloudEventHandler, opts *SubscribeOptions) (Subscriber, error)
 	Channel() (*amqp.Channel, error)
+	// RegisterSchema registers the schema of an event of the service. Published payloads
+	// which do not match it are refused, consumed ones are moved to the reject queue.
+	RegisterSchema(service, event string, schema Schema) error
+	// QueueStats returns the number of ready messages and consumers of the queue
+	QueueStats(queue string) (QueueStats, error)
+	// Ack acknowledges the message passed to the handler with ctx
+	Ack(ctx context.Context) error
+	// Reject rejects the message passed to the handler with ctx and marks the handler as failed
+	Reject(ctx context.Context) error
+	// RejectAndRequeue is Reject which puts the message back to the queue
+	RejectAndRequeue(ctx context.Context) error
+	// State returns the current state of the broker connection
+	State() ConnectionState
+	// OnStateChange registers a handler called on every connection state transition
+	OnStateChange(fn StateChangeHandler)
 }
 
 type Options struct {
 	Name string
+	// Sentry reports handler panics and failures, usually the sentry plugin
+	Sentry SentryClient
 }
 
 type Config struct {
@@ -65,6 +93,24 @@ type Config struct {
 	PrefetchCount  int  `env:"PREFETCH_COUNT"  comment:"Limit the number of unacknowledged messages on a channel (or connection) when consuming"`
 	PrefetchGlobal bool `env:"PREFETCH_GLOBAL"  comment:"Set prefetch limit number globally"`
 
+	Compression          string `env:"COMPRESSION" comment:"Compress published payloads: gzip or zstd. Consumers decompress by content encoding regardless of this setting"`
+	CompressionThreshold int    `env:"COMPRESSION_THRESHOLD" envDefault:"1024" comment:"Minimum payload size in bytes to be compressed (default: 1024)"`
+	MaxMessageSize       int64  `env:"MAX_MESSAGE_SIZE" envDefault:"16777216" comment:"Maximum size in bytes of a decompressed payload, larger messages are rejected (default: 16MB)"`
+
+	QueueMaxBacklog       int  `env:"QUEUE_MAX_BACKLOG" comment:"Fail the readiness probe when a subscribed queue holds more ready messages, 0 disables the check"`
+	QueueRequireConsumers bool `env:"QUEUE_REQUIRE_CONSUMERS" comment:"Fail the readiness probe when a subscribed queue has no consumers"`
+
+	EncryptionKeys     string `env:"ENCRYPTION_KEYS" comment:"AES keys (16, 24 or 32 bytes) used to decrypt payloads, in the id:base64key,id:base64key form"`
+	EncryptionKeyID    string `env:"ENCRYPTION_KEY_ID" comment:"Id of the key from ENCRYPTION_KEYS used to encrypt published payloads, empty disables encryption"`
+	EncryptionRequired bool   `env:"ENCRYPTION_REQUIRED" comment:"Move consumed messages without the x-encryption-key-id header to the reject queue, requires ENCRYPTION_KEYS"`
+
+	AuditFile     string `env:"AUDIT_FILE" comment:"Append every published and consumed message to this JSONL file, empty disables the audit"`
+	AuditMaxSize  int64  `env:"AUDIT_MAX_SIZE" envDefault:"104857600" comment:"Size in bytes at which the audit file is rotated (default: 100MB)"`
+	AuditMaxFiles int    `env:"AUDIT_MAX_FILES" envDefault:"5" comment:"Number of rotated audit files to keep (default: 5)"`
+	AuditRedact   string `env:"AUDIT_REDACT" comment:"Comma separated header and payload field names written to the audit file as [REDACTED]"`
+
+	CloudEvents string `env:"CLOUDEVENTS" comment:"Publish events as CloudEvents 1.0: binary (ce- headers) or structured (application/cloudevents+json). Empty keeps the {event,payload} envelope"`
+
 	DefaultExchange *Exchange
 }
 
@@ -82,7 +128,11 @@ type plugin struct {
 
 	opts Config
 
-	broker *broker
+	broker        *broker
+	stateHandlers []StateChangeHandler
+	queues        map[string]struct{}
+	schemas       *schemaRegistry
+	sentry        SentryClient
 }
 
 func NewPlugin(runtime runtime.Runtime, opts *Options) Plugin {
@@ -95,6 +145,8 @@ func NewPlugin(runtime runtime.Runtime, opts *Options) Plugin {
 	if p.prefix == "" {
 		p.prefix = defaultPrefix
 	}
+	p.schemas = newSchemaRegistry()
+	p.sentry = opts.Sentry
 
 	if err := runtime.Config().Parse(&p.opts, p.prefix); err != nil {
 		return nil
@@ -174,6 +226,7 @@ func NewTestPlugin(ctx context.Context, cfg TestConfig) (Plugin, error) {
 	}
 
 	p.broker = newBroker(p.runtime, p.opts)
+	p.schemas = p.broker.schemas
 
 	if err := p.broker.Connect(); err != nil {
 		return nil, err
@@ -200,7 +253,22 @@ func (p *plugin) PreStart(ctx context.Context) error {
 		Durable: true,
 	}
 
+	if _, err := parseCloudEventsMode(p.opts.CloudEvents); err != nil {
+		return fmt.Errorf("%s_CLOUDEVENTS: %v", p.prefix, err)
+	}
+
+	if _, err := parseCompression(p.opts.Compression); err != nil {
+		return fmt.Errorf("%s_COMPRESSION: %v", p.prefix, err)
+	}
+
+	p.Lock()
 	p.broker = newBroker(p.runtime, p.opts)
+	p.broker.schemas = p.schemas
+	p.broker.sentry = p.sentry
+	for _, fn := range p.stateHandlers {
+		p.broker.OnStateChange(fn)
+	}
+	p.Unlock()
 
 	if err := p.broker.Connect(); err != nil {
 		return err
@@ -209,6 +277,11 @@ func (p *plugin) PreStart(ctx context.Context) error {
 	p.runtime.Tools().Probes().RegisterCheck(p.prefix, probes.ReadinessProbe, checkRabbitMQ(p.broker, 1*time.Second))
 	p.runtime.Tools().Probes().RegisterCheck(p.prefix, probes.LivenessProbe, checkRabbitMQ(p.broker, 1*time.Second))
 
+	if p.opts.QueueMaxBacklog > 0 || p.opts.QueueRequireConsumers {
+		p.runtime.Tools().Probes().RegisterCheck(fmt.Sprintf("%s_queues", p.prefix), probes.ReadinessProbe,
+			checkQueues(p.broker, p.subscribedQueues, p.opts.QueueMaxBacklog, p.opts.QueueRequireConsumers))
+	}
+
 	return nil
 }
 
@@ -220,15 +293,122 @@ func (p *plugin) Publish(ctx context.Context, event string, payload []byte, opts
 	return p.broker.Publish(ctx, p.service, event, payload, opts)
 }
 
+func (p *plugin) PublishTo(ctx context.Context, exchange, event string, payload []byte, opts *PublishOptions) error {
+	if p.broker == nil {
+		return errors.New("plugin is not started")
+	}
+	return p.broker.Publish(ctx, exchange, event, payload, opts)
+}
+
+func (p *plugin) DeclareExchange(name string) error {
+	if p.broker == nil {
+		return errors.New("plugin is not started")
+	}
+	return p.broker.declareExchange(name)
+}
+
+func (p *plugin) PublishBatch(ctx context.Context, events []BatchEvent) ([]error, error) {
+	return p.broker.PublishBatch(ctx, p.service, events)
+}
+
 func (p *plugin) Subscribe(service, event string, handler CallHandler, opts *SubscribeOptions) (Subscriber, error) {
 	queue := fmt.Sprintf("%s:events", service)
+	p.addQueue(queue)
 	return p.broker.Subscribe(service, queue, event, handler, opts)
 }
 
+func (p *plugin) SubscribeCloudEvents(service, event string, handler CloudEventHandler, opts *SubscribeOptions) (Subscriber, error) {
+	queue := fmt.Sprintf("%s:events", service)
+	p.addQueue(queue)
+	return p.broker.SubscribeCloudEvents(service, queue, event, handler, opts)
+}
+
+func (p *plugin) RegisterSchema(service, event string, schema Schema) error {
+	return p.schemas.Register(service, event, schema)
+}
+
+func (p *plugin) QueueStats(queue string) (QueueStats, error) {
+	return p.broker.QueueStats(queue)
+}
+
+func (p *plugin) addQueue(queue string) {
+	p.Lock()
+	defer p.Unlock()
+	if p.queues == nil {
+		p.queues = make(map[string]struct{})
+	}
+	p.queues[queue] = struct{}{}
+}
+
+func (p *plugin) subscribedQueues() []string {
+	p.RLock()
+	defer p.RUnlock()
+	queues := make([]string, 0, len(p.queues))
+	for q := range p.queues {
+		queues = append(queues, q)
+	}
+	return queues
+}
+
 func (p *plugin) Channel() (*amqp.Channel, error) {
 	return p.broker.Channel()
 }
 
+func (p *plugin) Ack(ctx context.Context) error {
+	return p.broker.Ack(ctx)
+}
+
+func (p *plugin) Reject(ctx context.Context) error {
+	return p.broker.Reject(ctx)
+}
+
+func (p *plugin) RejectAndRequeue(ctx context.Context) error {
+	return p.broker.RejectAndRequeue(ctx)
+}
+
+func (p *plugin) State() ConnectionState {
+	p.RLock()
+	defer p.RUnlock()
+	if p.broker == nil {
+		return StateConnecting
+	}
+	return p.broker.State()
+}
+
+// OnStateChange can be called before PreStart, the handlers are attached
+// to the connection once the broker is created.
+func (p *plugin) OnStateChange(fn StateChangeHandler) {
+	p.Lock()
+	defer p.Unlock()
+	p.stateHandlers = append(p.stateHandlers, fn)
+	if p.broker != nil {
+		p.broker.OnStateChange(fn)
+	}
+}
+
+func checkQueues(broker *broker, queues func() []string, maxBacklog int, requireConsumers bool) probes.HandleFunc {
+	return func() error {
+		if broker == nil {
+			return fmt.Errorf("connection is nil")
+		}
+
+		for _, queue := range queues() {
+			stats, err := broker.QueueStats(queue)
+			if err != nil {
+				return fmt.Errorf("failed to inspect queue %s: %v", queue, err)
+			}
+			if requireConsumers && stats.Consumers == 0 {
+				return fmt.Errorf("queue %s has no consumers", queue)
+			}
+			if maxBacklog > 0 && stats.Messages > maxBacklog {
+				return fmt.Errorf("queue %s backlog %d exceeds %d messages", queue, stats.Messages, maxBacklog)
+			}
+		}
+
+		return nil
+	}
+}
+
 func checkRabbitMQ(broker *broker, timeout time.Duration) probes.HandleFunc {
 	return func() error {
 		correlationID := "readiness_check"
@@ -239,6 +419,10 @@ func checkRabbitMQ(broker *broker, timeout time.Duration) probes.HandleFunc {
 			return fmt.Errorf("connection is nil")
 		}
 
+		if err := broker.Connected(); err != nil {
+			return err
+		}
+
 		channel, err := broker.Channel()
 		if err != nil {
 			return err
@@ -0,0 +1,217 @@
+/*
+Copyright [2014] - [2024] The Last.Backend authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rabbitmq
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+
+	"github.com/pkg/errors"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/santhosh-tekuri/jsonschema/v5"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+const (
+	headerSchemaVersion   = "x-schema-version"
+	headerRejectionReason = "x-rejection-reason"
+
+	// schemaResource is the in-memory url of a compiled JSON Schema
+	schemaResource = "mem:///event.schema.json"
+)
+
+// ErrInvalidPayload is returned by Publish when the payload does not match the event schema
+var ErrInvalidPayload = errors.New("payload does not match the event schema")
+
+// Validator checks an event payload against a schema
+type Validator interface {
+	Validate(payload []byte) error
+}
+
+// ValidatorFunc adapts a function to the Validator interface
+type ValidatorFunc func(payload []byte) error
+
+func (fn ValidatorFunc) Validate(payload []byte) error {
+	return fn(payload)
+}
+
+// Upcaster transforms a payload of an older schema version into the current shape
+type Upcaster func(version int, payload []byte) ([]byte, error)
+
+// Schema describes the contract of an event
+type Schema struct {
+	// Validator checks published and consumed payloads
+	Validator Validator
+	// Version is the current schema version, it is sent in the x-schema-version header
+	Version int
+	// Upcast is called for consumed payloads with a lower version before they are validated
+	Upcast Upcaster
+}
+
+// JSONSchema compiles a JSON Schema document into a Validator
+func JSONSchema(schema []byte) (Validator, error) {
+	c := jsonschema.NewCompiler()
+	if err := c.AddResource(schemaResource, bytes.NewReader(schema)); err != nil {
+		return nil, err
+	}
+
+	s, err := c.Compile(schemaResource)
+	if err != nil {
+		return nil, err
+	}
+
+	return ValidatorFunc(func(payload []byte) error {
+		var v interface{}
+		if err := json.Unmarshal(payload, &v); err != nil {
+			return err
+		}
+		return s.Validate(v)
+	}), nil
+}
+
+// ProtoSchema returns a Validator for payloads in the protobuf binary format
+func ProtoSchema(desc protoreflect.MessageDescriptor) Validator {
+	return ValidatorFunc(func(payload []byte) error {
+		msg := dynamicpb.NewMessage(desc)
+		if err := proto.Unmarshal(payload, msg); err != nil {
+			return err
+		}
+		return proto.CheckInitialized(msg)
+	})
+}
+
+// ProtoJSONSchema returns a Validator for payloads in the protobuf JSON format
+func ProtoJSONSchema(desc protoreflect.MessageDescriptor) Validator {
+	return ValidatorFunc(func(payload []byte) error {
+		msg := dynamicpb.NewMessage(desc)
+		if err := protojson.Unmarshal(payload, msg); err != nil {
+			return err
+		}
+		return proto.CheckInitialized(msg)
+	})
+}
+
+// schemaRegistry keeps the schemas by exchange:event, the same key as the handlers
+type schemaRegistry struct {
+	mtx     sync.RWMutex
+	schemas map[string]Schema
+}
+
+func newSchemaRegistry() *schemaRegistry {
+	return &schemaRegistry{schemas: make(map[string]Schema)}
+}
+
+func (r *schemaRegistry) Register(exchange, event string, schema Schema) error {
+	if schema.Validator == nil {
+		return errors.Errorf("schema validator for event %s:%s is nil", exchange, event)
+	}
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.schemas[fmt.Sprintf("%s:%s", exchange, event)] = schema
+	return nil
+}
+
+func (r *schemaRegistry) get(exchange, event string) (Schema, bool) {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	s, ok := r.schemas[fmt.Sprintf("%s:%s", exchange, event)]
+	return s, ok
+}
+
+// validatePublish validates an outgoing payload and stamps the schema version
+func (r *schemaRegistry) validatePublish(exchange, event string, payload []byte, headers amqp.Table) error {
+	s, ok := r.get(exchange, event)
+	if !ok {
+		return nil
+	}
+
+	if err := s.Validator.Validate(payload); err != nil {
+		return errors.Wrapf(ErrInvalidPayload, "event %s: %v", event, err)
+	}
+
+	headers[headerSchemaVersion] = int32(s.Version)
+	return nil
+}
+
+// validateConsume upcasts an incoming payload to the current version and validates it.
+// Messages without the version header are treated as the current version.
+func (r *schemaRegistry) validateConsume(exchange, event string, payload []byte, headers amqp.Table) ([]byte, error) {
+	s, ok := r.get(exchange, event)
+	if !ok {
+		return payload, nil
+	}
+
+	version := s.Version
+	if v, ok := headers[headerSchemaVersion]; ok {
+		var err error
+		if version, err = headerInt(v); err != nil {
+			return nil, errors.Wrapf(err, "invalid %s header", headerSchemaVersion)
+		}
+	}
+
+	switch {
+	case version > s.Version:
+		return nil, errors.Errorf("schema version %d of event %s is newer than the supported version %d", version, event, s.Version)
+	case version < s.Version:
+		if s.Upcast == nil {
+			return nil, errors.Errorf("schema version %d of event %s can not be upcast to version %d", version, event, s.Version)
+		}
+		up, err := s.Upcast(version, payload)
+		if err != nil {
+			return nil, errors.Wrapf(err, "upcast event %s from version %d", event, version)
+		}
+		payload = up
+	}
+
+	if err := s.Validator.Validate(payload); err != nil {
+		return nil, errors.Wrapf(err, "event %s version %d does not match the schema", event, s.Version)
+	}
+
+	return payload, nil
+}
+
+func headerInt(v interface{}) (int, error) {
+	switch n := v.(type) {
+	case int:
+		return n, nil
+	case int8:
+		return int(n), nil
+	case int16:
+		return int(n), nil
+	case int32:
+		return int(n), nil
+	case int64:
+		return int(n), nil
+	case uint8:
+		return int(n), nil
+	case uint16:
+		return int(n), nil
+	case uint32:
+		return int(n), nil
+	case string:
+		return strconv.Atoi(n)
+	default:
+		return 0, errors.Errorf("unexpected type %T", v)
+	}
+}
@@ -0,0 +1,143 @@
+/*
+Copyright [2014] - [2024] The Last.Backend authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rabbitmq
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const orderSchema = `{
+	"type": "object",
+	"required": ["id", "total"],
+	"properties": {
+		"id": {"type": "integer"},
+		"total": {"type": "number"}
+	}
+}`
+
+func newOrderRegistry(t *testing.T) *schemaRegistry {
+	t.Helper()
+
+	v, err := JSONSchema([]byte(orderSchema))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := newSchemaRegistry()
+	err = r.Register("orders", "created", Schema{
+		Validator: v,
+		Version:   2,
+		// version 1 named the total amount
+		Upcast: func(version int, payload []byte) ([]byte, error) {
+			m := make(map[string]interface{})
+			if err := json.Unmarshal(payload, &m); err != nil {
+				return nil, err
+			}
+			m["total"] = m["amount"]
+			delete(m, "amount")
+			return json.Marshal(m)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestSchemaValidatePublish(t *testing.T) {
+	r := newOrderRegistry(t)
+
+	tests := []struct {
+		name        string
+		exchange    string
+		event       string
+		payload     string
+		wantErr     bool
+		wantVersion bool
+	}{
+		{name: "valid", exchange: "orders", event: "created", payload: `{"id":1,"total":9.5}`, wantVersion: true},
+		{name: "invalid", exchange: "orders", event: "created", payload: `{"id":"1"}`, wantErr: true},
+		{name: "not json", exchange: "orders", event: "created", payload: `{`, wantErr: true},
+		{name: "other event", exchange: "orders", event: "deleted", payload: `{`},
+		{name: "other exchange", exchange: "users", event: "created", payload: `{`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			headers := amqp.Table{}
+			err := r.validatePublish(tt.exchange, tt.event, []byte(tt.payload), headers)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error: got %v, want error %t", err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, ErrInvalidPayload) {
+				t.Errorf("got %v, want ErrInvalidPayload", err)
+			}
+			if _, ok := headers[headerSchemaVersion]; ok != tt.wantVersion {
+				t.Errorf("version header: got %v, want %t", headers, tt.wantVersion)
+			}
+		})
+	}
+}
+
+func TestSchemaValidateConsume(t *testing.T) {
+	r := newOrderRegistry(t)
+
+	tests := []struct {
+		name     string
+		exchange string
+		version  interface{}
+		payload  string
+		want     string
+		wantErr  bool
+	}{
+		{name: "current version", exchange: "orders", version: int32(2), payload: `{"id":1,"total":9.5}`, want: `{"id":1,"total":9.5}`},
+		{name: "without version", exchange: "orders", payload: `{"id":1,"total":9.5}`, want: `{"id":1,"total":9.5}`},
+		{name: "string version", exchange: "orders", version: "2", payload: `{"id":1,"total":9.5}`, want: `{"id":1,"total":9.5}`},
+		{name: "upcast", exchange: "orders", version: int64(1), payload: `{"id":1,"amount":9.5}`, want: `{"id":1,"total":9.5}`},
+		{name: "newer version", exchange: "orders", version: int32(3), payload: `{"id":1,"total":9.5}`, wantErr: true},
+		{name: "invalid version", exchange: "orders", version: 2.5, payload: `{"id":1,"total":9.5}`, wantErr: true},
+		{name: "invalid", exchange: "orders", version: int32(2), payload: `{"id":1}`, wantErr: true},
+		{name: "invalid after upcast", exchange: "orders", version: int32(1), payload: `{"id":1}`, wantErr: true},
+		{name: "other exchange", exchange: "users", version: int32(9), payload: `{`, want: `{`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			headers := amqp.Table{}
+			if tt.version != nil {
+				headers[headerSchemaVersion] = tt.version
+			}
+			got, err := r.validateConsume(tt.exchange, "created", []byte(tt.payload), headers)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error: got %v, want error %t", err, tt.wantErr)
+			}
+			if err == nil && string(got) != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSchemaRegisterWithoutValidator(t *testing.T) {
+	if err := newSchemaRegistry().Register("orders", "created", Schema{}); err == nil {
+		t.Error("got nil, want an error for a schema without a validator")
+	}
+}
@@ -0,0 +1,95 @@
+/*
+Copyright [2014] - [2024] The Last.Backend authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rabbitmq
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+
+	"github.com/getsentry/sentry-go"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// SentryClient provides the hub errors are reported to,
+// it is implemented by the sentry plugin.
+type SentryClient interface {
+	Client() *sentry.Hub
+}
+
+// deliveryHub returns a hub cloned for the delivery, with the message details in its scope.
+// The hub is looked up on every delivery, since the sentry plugin creates it in PreStart.
+func (r *broker) deliveryHub(queue string, msg amqp.Delivery, e CloudEvent) *sentry.Hub {
+	if r.sentry == nil {
+		return nil
+	}
+
+	hub := r.sentry.Client()
+	if hub == nil {
+		return nil
+	}
+	hub = hub.Clone()
+
+	headers := make(sentry.Context, len(msg.Headers))
+	for k, v := range msg.Headers {
+		headers[k] = v
+	}
+
+	hub.ConfigureScope(func(scope *sentry.Scope) {
+		scope.SetTag("rabbitmq.event", e.Type)
+		scope.SetTag("rabbitmq.queue", queue)
+		scope.SetTag("rabbitmq.exchange", msg.Exchange)
+		scope.SetTag("rabbitmq.message_id", msg.MessageId)
+		scope.SetContext("rabbitmq.headers", headers)
+	})
+
+	return hub
+}
+
+// call runs the handler and recovers its panic, so a faulty handler does not
+// take the consumer goroutine and the process down. The panicked message is
+// rejected and requeued if the subscription has RequeueOnError set. A message
+// acknowledged on receive can not be requeued, it is copied to the reject queue.
+func (r *broker) call(ctx context.Context, hub *sentry.Hub, d *delivery, requeue bool, rejectQueue string, h CloudEventHandler, e CloudEvent) (panicked bool) {
+	defer func() {
+		rec := recover()
+		if rec == nil {
+			return
+		}
+		panicked = true
+
+		r.runtime.Log().Errorf("rabbitmq: handler of %s panicked: %v\n%s", d.msg.Type, rec, debug.Stack())
+
+		if hub != nil {
+			hub.RecoverWithContext(ctx, rec)
+		}
+
+		if d.autoAck && !d.settled {
+			r.runtime.Log().Warnf("rabbitmq: message %s was acknowledged on receive and can not be requeued, moving it to %s", d.msg.Type, rejectQueue)
+			r.moveTo(rejectQueue, d, fmt.Errorf("handler panicked: %v", rec))
+			d.failed = true
+			return
+		}
+
+		if err := d.reject(requeue); err != nil {
+			r.runtime.Log().Errorf("rabbitmq: can not reject message %s: %v", d.msg.Type, err)
+		}
+	}()
+
+	h(ctx, e)
+	return false
+}
@@ -0,0 +1,57 @@
+/*
+Copyright [2014] - [2024] The Last.Backend authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rabbitmq
+
+// ConnectionState describes the lifecycle of the broker connection.
+type ConnectionState int
+
+const (
+	// StateConnecting is the state before the first connection attempt completes.
+	StateConnecting ConnectionState = iota
+	// StateConnected means the connection and the exchange channel are ready.
+	StateConnected
+	// StateBlocked means the broker sent connection.blocked (flow control);
+	// the connection is alive but publishes will stall until it is unblocked.
+	StateBlocked
+	// StateReconnecting means the connection was lost and is being re-established.
+	StateReconnecting
+	// StateClosed means the connection was closed and will not be re-established.
+	StateClosed
+)
+
+func (s ConnectionState) String() string {
+	switch s {
+	case StateConnecting:
+		return "connecting"
+	case StateConnected:
+		return "connected"
+	case StateBlocked:
+		return "blocked"
+	case StateReconnecting:
+		return "reconnecting"
+	case StateClosed:
+		return "closed"
+	default:
+		return "unknown"
+	}
+}
+
+// StateChangeHandler is called on every connection state transition.
+// err holds the cause of the transition if there is one (connection error,
+// blocking reason), and is nil otherwise.
+// Handlers are called synchronously from the connection goroutine and must not block.
+type StateChangeHandler func(from, to ConnectionState, err error)
@@ -0,0 +1,95 @@
+/*
+Copyright [2014] - [2024] The Last.Backend authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rabbitmq
+
+import (
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+const (
+	defaultCircuitBreakerFailures = 5
+	defaultCircuitBreakerCoolDown = 30 * time.Second
+)
+
+// CircuitBreakerOptions configures pausing of a subscription after handler failures.
+// A handler fails when it calls Reject or RejectAndRequeue on the delivery context.
+type CircuitBreakerOptions struct {
+	// Failures is the number of consecutive failures which opens the breaker (default: 5)
+	Failures int
+	// CoolDown is how long consumption stays paused before it is retried (default: 30s)
+	CoolDown time.Duration
+}
+
+// circuitBreaker is used from the consumer goroutine only, so it needs no locking.
+// After the cool-down the breaker is half-open: the first failure opens it
+// again, the first success closes it.
+type circuitBreaker struct {
+	threshold int
+	coolDown  time.Duration
+	failures  int
+	halfOpen  bool
+}
+
+func newCircuitBreaker(opts *CircuitBreakerOptions) *circuitBreaker {
+	if opts == nil {
+		return nil
+	}
+
+	b := &circuitBreaker{
+		threshold: opts.Failures,
+		coolDown:  opts.CoolDown,
+	}
+
+	if b.threshold <= 0 {
+		b.threshold = defaultCircuitBreakerFailures
+	}
+	if b.coolDown <= 0 {
+		b.coolDown = defaultCircuitBreakerCoolDown
+	}
+
+	return b
+}
+
+// report records a handler result and returns false if the breaker opened
+func (b *circuitBreaker) report(ok bool) bool {
+	if ok {
+		b.failures = 0
+		b.halfOpen = false
+		return true
+	}
+
+	b.failures++
+	if b.halfOpen || b.failures >= b.threshold {
+		b.failures = 0
+		b.halfOpen = true
+		return false
+	}
+
+	return true
+}
+
+func newRateLimiter(limit float64, burst int) *rate.Limiter {
+	if limit <= 0 {
+		return nil
+	}
+	if burst <= 0 {
+		burst = 1
+	}
+	return rate.NewLimiter(rate.Limit(limit), burst)
+}
@@ -0,0 +1,104 @@
+/*
+Copyright [2014] - [2024] The Last.Backend authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rabbitmq
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	tests := []struct {
+		name     string
+		failures int
+		results  []bool
+		// opened holds the indexes of the results which open the breaker
+		opened []int
+	}{
+		{name: "successes", failures: 2, results: []bool{true, true, true}},
+		{name: "opens at the threshold", failures: 2, results: []bool{false, false}, opened: []int{1}},
+		{name: "success resets the count", failures: 2, results: []bool{false, true, false, true}},
+		{name: "half-open fails at once", failures: 3, results: []bool{false, false, false, false}, opened: []int{2, 3}},
+		{name: "half-open closes on success", failures: 3, results: []bool{false, false, false, true, false, false, false}, opened: []int{2, 6}},
+		{name: "default threshold", results: []bool{false, false, false, false, false}, opened: []int{4}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newCircuitBreaker(&CircuitBreakerOptions{Failures: tt.failures})
+
+			var opened []int
+			for i, ok := range tt.results {
+				if !b.report(ok) {
+					opened = append(opened, i)
+				}
+			}
+
+			if len(opened) != len(tt.opened) {
+				t.Fatalf("opened at %v, want %v", opened, tt.opened)
+			}
+			for i := range opened {
+				if opened[i] != tt.opened[i] {
+					t.Fatalf("opened at %v, want %v", opened, tt.opened)
+				}
+			}
+		})
+	}
+}
+
+func TestNewCircuitBreakerDefaults(t *testing.T) {
+	if b := newCircuitBreaker(nil); b != nil {
+		t.Errorf("got %+v for nil options, want nil", b)
+	}
+
+	b := newCircuitBreaker(&CircuitBreakerOptions{})
+	if b.threshold != defaultCircuitBreakerFailures || b.coolDown != defaultCircuitBreakerCoolDown {
+		t.Errorf("got %d, %s, want %d, %s", b.threshold, b.coolDown, defaultCircuitBreakerFailures, defaultCircuitBreakerCoolDown)
+	}
+
+	b = newCircuitBreaker(&CircuitBreakerOptions{Failures: 1, CoolDown: time.Second})
+	if b.threshold != 1 || b.coolDown != time.Second {
+		t.Errorf("got %d, %s, want 1, 1s", b.threshold, b.coolDown)
+	}
+}
+
+func TestNewRateLimiter(t *testing.T) {
+	tests := []struct {
+		name      string
+		limit     float64
+		burst     int
+		wantNil   bool
+		wantBurst int
+	}{
+		{name: "disabled", limit: 0, wantNil: true},
+		{name: "negative", limit: -1, wantNil: true},
+		{name: "default burst", limit: 10, wantBurst: 1},
+		{name: "burst", limit: 10, burst: 5, wantBurst: 5},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newRateLimiter(tt.limit, tt.burst)
+			if (l == nil) != tt.wantNil {
+				t.Fatalf("got %v, want nil %t", l, tt.wantNil)
+			}
+			if l != nil && l.Burst() != tt.wantBurst {
+				t.Errorf("burst: got %d, want %d", l.Burst(), tt.wantBurst)
+			}
+		})
+	}
+}
@@ -34,12 +34,56 @@ type Message struct {
 
 type PublishOptions struct {
 	Headers map[string]interface{}
+
+	// CloudEvents overrides the plugin CLOUDEVENTS mode for this message
+	CloudEvents CloudEventsMode
+	// ContentType is the CloudEvents datacontenttype, application/json by default
+	ContentType string
+	// Subject is the CloudEvents subject attribute
+	Subject string
+	// Extensions are CloudEvents extension attributes
+	Extensions map[string]interface{}
+
+	// Compression overrides the plugin COMPRESSION algorithm for this message
+	Compression Compression
+}
+
+// BatchEvent is an event published with PublishBatch
+type BatchEvent struct {
+	Event   string
+	Payload []byte
+	Options *PublishOptions
 }
 
 type SubscribeOptions struct {
 	DurableQueue   bool
 	RequeueOnError bool
 	Headers        map[string]interface{}
+
+	// ManualAck acknowledges messages after the handlers return instead of on receive,
+	// so the prefetch count bounds the number of in-flight messages.
+	// Handlers can settle a message themselves with Ack, Reject or RejectAndRequeue.
+	// It is enabled implicitly by RequeueOnError, RateLimit and CircuitBreaker.
+	ManualAck bool
+	// RateLimit is the maximum number of handler invocations per second, 0 disables the limit
+	RateLimit float64
+	// RateBurst is the token bucket size of the rate limit (default: 1)
+	RateBurst int
+	// CircuitBreaker cancels the consumer after sustained handler failures
+	// and resumes it after a cool-down
+	CircuitBreaker *CircuitBreakerOptions
+	// RejectQueue receives messages which do not match the event schema,
+	// with the reason in the x-rejection-reason header (default: <queue>:rejected)
+	RejectQueue string
+}
+
+// QueueStats is the queue state reported by the broker
+type QueueStats struct {
+	Name string
+	// Messages is the number of messages ready for delivery, unacknowledged ones are not counted
+	Messages int
+	// Consumers is the number of consumers attached to the queue
+	Consumers int
 }
 
 type Subscriber interface {
@@ -0,0 +1,407 @@
+/*
+Copyright [2014] - [2024] The Last.Backend authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package cache implements a typed cache on top of the redis plugin client.
+//
+//	user, err := cache.GetOrLoad(ctx, redisPlugin.Cache(), "user:"+id, time.Hour,
+//		func(ctx context.Context) (*User, error) {
+//			return repo.User(ctx, id)
+//		}, "users")
+//
+// Concurrent loads of a key are collapsed into one call of the loader, and entries
+// are refreshed in background shortly before they expire, so a popular key does
+// not send every caller to the loader at once.
+package cache
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"math"
+	"math/rand"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/sync/singleflight"
+)
+
+// ErrNotFound is returned for missing keys. Loaders return it to cache the absence of a value.
+var ErrNotFound = errors.New("cache: not found")
+
+const (
+	kindValue   byte = 1
+	kindMissing byte = 2
+
+	// headerSize is the kind, the load duration and the expiration of an entry
+	headerSize = 17
+
+	defaultLocalTTL    = time.Minute
+	defaultLoadTimeout = 10 * time.Second
+)
+
+// tagScript adds the key to the tag set and extends the set to outlive the key
+var tagScript = redis.NewScript(`
+redis.call("sadd", KEYS[1], ARGV[1])
+local ttl = tonumber(ARGV[2])
+if ttl == 0 then
+	redis.call("persist", KEYS[1])
+	return 1
+end
+local current = redis.call("pttl", KEYS[1])
+if current == -1 and redis.call("scard", KEYS[1]) == 1 or current >= 0 and current < ttl then
+	redis.call("pexpire", KEYS[1], ttl)
+end
+return 1`)
+
+type Options struct {
+	// Namespace prefixes the keys, the redis plugin sets it to the service name
+	Namespace string
+	// Codec encodes the values, default is JSON
+	Codec Codec
+	// NegativeTTL is how long ErrNotFound returned by a loader is cached, 0 disables negative caching
+	NegativeTTL time.Duration
+	// Beta scales the probabilistic early refresh, default is 1, values above 1 refresh earlier.
+	// A negative value disables the early refresh.
+	Beta float64
+	// LocalSize enables the in-process tier holding up to the number of entries.
+	// The tier of every instance is invalidated over pub/sub, so all instances
+	// sharing the namespace should enable it.
+	LocalSize int
+	// LocalTTL bounds the time entries are kept in the in-process tier, default is a minute
+	LocalTTL time.Duration
+	// LoadTimeout bounds a loader call, default is 10 seconds. The loader is shared by
+	// concurrent callers, so it does not stop when the caller which started it gives up.
+	LoadTimeout time.Duration
+}
+
+type Cache struct {
+	client  redis.UniversalClient
+	opts    Options
+	local   *local
+	group   singleflight.Group
+	channel string
+	ps      *redis.PubSub
+}
+
+type entry struct {
+	missing bool
+	// delta is the duration of the load, the longer loads are refreshed earlier
+	delta   time.Duration
+	expires time.Time
+	data    []byte
+}
+
+// New returns a cache, it subscribes to invalidations when the in-process tier is enabled
+func New(client redis.UniversalClient, opts *Options) *Cache {
+	c := &Cache{client: client}
+	if opts != nil {
+		c.opts = *opts
+	}
+	if c.opts.Codec == nil {
+		c.opts.Codec = JSON
+	}
+	if c.opts.Beta == 0 {
+		c.opts.Beta = 1
+	}
+	if c.opts.LocalTTL <= 0 {
+		c.opts.LocalTTL = defaultLocalTTL
+	}
+	if c.opts.LoadTimeout <= 0 {
+		c.opts.LoadTimeout = defaultLoadTimeout
+	}
+
+	c.channel = c.key("cache:invalidate")
+
+	if c.opts.LocalSize > 0 {
+		c.local = newLocal(c.opts.LocalSize, c.opts.LocalTTL)
+		c.ps = client.Subscribe(context.Background(), c.channel)
+
+		ch := c.ps.Channel()
+		go func() {
+			for msg := range ch {
+				c.local.delete(strings.Split(msg.Payload, "\n")...)
+			}
+		}()
+	}
+
+	return c
+}
+
+// Close stops receiving invalidations of the in-process tier
+func (c *Cache) Close() error {
+	if c.ps != nil {
+		return c.ps.Close()
+	}
+	return nil
+}
+
+// Get returns the cached value of the key, or ErrNotFound
+func Get[T any](ctx context.Context, c *Cache, key string) (T, error) {
+	var v T
+
+	e, ok, err := c.get(ctx, c.key(key))
+	if err != nil {
+		return v, err
+	}
+	if !ok || e.missing {
+		return v, ErrNotFound
+	}
+
+	err = c.opts.Codec.Unmarshal(e.data, &v)
+	return v, err
+}
+
+// Set caches the value for the ttl, 0 keeps it until it is deleted or invalidated by its tags
+func Set[T any](ctx context.Context, c *Cache, key string, value T, ttl time.Duration, tags ...string) error {
+	data, err := c.opts.Codec.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return c.set(ctx, c.key(key), entry{data: data}, ttl, tags)
+}
+
+// GetOrLoad returns the cached value of the key, or calls the loader and caches its result.
+// Concurrent calls for the same key share one loader call.
+func GetOrLoad[T any](ctx context.Context, c *Cache, key string, ttl time.Duration, loader func(ctx context.Context) (T, error), tags ...string) (T, error) {
+	var v T
+
+	load := func(ctx context.Context) ([]byte, error) {
+		v, err := loader(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return c.opts.Codec.Marshal(v)
+	}
+
+	k := c.key(key)
+	e, ok, err := c.get(ctx, k)
+	if err != nil {
+		return v, err
+	}
+
+	if ok {
+		if c.early(e) {
+			go c.load(context.WithoutCancel(ctx), k, ttl, load, tags) // nolint:errcheck
+		}
+	} else if e, err = c.load(ctx, k, ttl, load, tags); err != nil {
+		return v, err
+	}
+
+	if e.missing {
+		return v, ErrNotFound
+	}
+
+	err = c.opts.Codec.Unmarshal(e.data, &v)
+	return v, err
+}
+
+// Delete removes the keys
+func (c *Cache) Delete(ctx context.Context, keys ...string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+
+	full := make([]string, len(keys))
+	for i, key := range keys {
+		full[i] = c.key(key)
+	}
+
+	return c.delete(ctx, full)
+}
+
+// InvalidateTags removes the keys set with any of the tags
+func (c *Cache) InvalidateTags(ctx context.Context, tags ...string) error {
+	for _, tag := range tags {
+		tk := c.tagKey(tag)
+
+		keys, err := c.client.SMembers(ctx, tk).Result()
+		if err != nil {
+			return err
+		}
+
+		if err := c.delete(ctx, append(keys, tk)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Cache) key(key string) string {
+	if c.opts.Namespace == "" {
+		return key
+	}
+	return c.opts.Namespace + ":" + key
+}
+
+func (c *Cache) tagKey(tag string) string {
+	return c.key("tag#" + tag)
+}
+
+func (c *Cache) get(ctx context.Context, key string) (entry, bool, error) {
+	var generation uint64
+	if c.local != nil {
+		if data, ok := c.local.get(key); ok {
+			e, err := decodeEntry(data)
+			return e, err == nil, err
+		}
+		generation = c.local.generation(key)
+	}
+
+	data, err := c.client.Get(ctx, key).Bytes()
+	if err == redis.Nil {
+		return entry{}, false, nil
+	}
+	if err != nil {
+		return entry{}, false, err
+	}
+
+	e, err := decodeEntry(data)
+	if err != nil {
+		return entry{}, false, err
+	}
+
+	if c.local != nil {
+		switch ttl := time.Until(e.expires); {
+		case e.expires.IsZero():
+			c.local.set(key, data, 0, generation)
+		case ttl > 0:
+			c.local.set(key, data, ttl, generation)
+		}
+	}
+
+	return e, true, nil
+}
+
+func (c *Cache) set(ctx context.Context, key string, e entry, ttl time.Duration, tags []string) error {
+	if ttl > 0 {
+		e.expires = time.Now().Add(ttl)
+	}
+	data := encodeEntry(e)
+
+	_, err := c.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, key, data, ttl)
+		for _, tag := range tags {
+			tagScript.Eval(ctx, pipe, []string{c.tagKey(tag)}, key, ttl.Milliseconds())
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if c.local != nil {
+		c.local.delete(key)
+		return c.client.Publish(ctx, c.channel, key).Err()
+	}
+	return nil
+}
+
+func (c *Cache) delete(ctx context.Context, keys []string) error {
+	_, err := c.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		// deleted one by one, the keys may be in different slots of a cluster
+		for _, key := range keys {
+			pipe.Del(ctx, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if c.local != nil {
+		c.local.delete(keys...)
+		return c.client.Publish(ctx, c.channel, strings.Join(keys, "\n")).Err()
+	}
+	return nil
+}
+
+// load calls the loader once for concurrent callers and caches its result.
+// The loader runs detached from the caller, bounded by the load timeout.
+func (c *Cache) load(ctx context.Context, key string, ttl time.Duration, load func(ctx context.Context) ([]byte, error), tags []string) (entry, error) {
+	ch := c.group.DoChan(key, func() (interface{}, error) {
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), c.opts.LoadTimeout)
+		defer cancel()
+
+		start := time.Now()
+		data, err := load(ctx)
+
+		e, ttl := entry{data: data, delta: time.Since(start)}, ttl
+		switch {
+		case errors.Is(err, ErrNotFound) && c.opts.NegativeTTL > 0:
+			e, ttl = entry{missing: true}, c.opts.NegativeTTL
+		case err != nil:
+			return nil, err
+		}
+
+		// the loaded value is returned even when it can not be cached
+		_ = c.set(ctx, key, e, ttl, tags)
+		return e, nil
+	})
+
+	select {
+	case <-ctx.Done():
+		return entry{}, ctx.Err()
+	case res := <-ch:
+		if res.Err != nil {
+			return entry{}, res.Err
+		}
+		return res.Val.(entry), nil
+	}
+}
+
+// early decides to refresh the entry before it expires, with a probability growing
+// as the expiration approaches and with the load duration (XFetch)
+func (c *Cache) early(e entry) bool {
+	if c.opts.Beta < 0 || e.missing || e.delta <= 0 || e.expires.IsZero() {
+		return false
+	}
+	gap := -float64(e.delta) * c.opts.Beta * math.Log(1-rand.Float64())
+	return time.Now().Add(time.Duration(gap)).After(e.expires)
+}
+
+func encodeEntry(e entry) []byte {
+	data := make([]byte, headerSize+len(e.data))
+
+	data[0] = kindValue
+	if e.missing {
+		data[0] = kindMissing
+	}
+	binary.BigEndian.PutUint64(data[1:9], uint64(e.delta.Milliseconds()))
+	if !e.expires.IsZero() {
+		binary.BigEndian.PutUint64(data[9:17], uint64(e.expires.UnixMilli()))
+	}
+	copy(data[headerSize:], e.data)
+
+	return data
+}
+
+func decodeEntry(data []byte) (entry, error) {
+	if len(data) < headerSize || (data[0] != kindValue && data[0] != kindMissing) {
+		return entry{}, errors.New("cache: malformed entry")
+	}
+
+	e := entry{
+		missing: data[0] == kindMissing,
+		delta:   time.Duration(binary.BigEndian.Uint64(data[1:9])) * time.Millisecond,
+		data:    data[headerSize:],
+	}
+	if exp := binary.BigEndian.Uint64(data[9:17]); exp > 0 {
+		e.expires = time.UnixMilli(int64(exp))
+	}
+
+	return e, nil
+}
@@ -0,0 +1,381 @@
+/*
+Copyright [2014] - [2024] The Last.Backend authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cache
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func newCache(t *testing.T, opts *Options) (*miniredis.Miniredis, *Cache) {
+	t.Helper()
+	s := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: s.Addr()})
+	c := New(client, opts)
+	t.Cleanup(func() {
+		_ = c.Close()
+		_ = client.Close()
+	})
+	return s, c
+}
+
+func TestTagScript(t *testing.T) {
+	ctx := context.Background()
+
+	type set struct {
+		key string
+		ttl time.Duration
+	}
+
+	tests := []struct {
+		name string
+		sets []set
+		// want is the ttl of the tag set, 0 for a persistent set
+		want time.Duration
+	}{
+		{name: "first key", sets: []set{{"a", time.Minute}}, want: time.Minute},
+		{name: "longer key extends", sets: []set{{"a", time.Minute}, {"b", time.Hour}}, want: time.Hour},
+		{name: "shorter key keeps", sets: []set{{"a", time.Hour}, {"b", time.Minute}}, want: time.Hour},
+		{name: "persistent key persists", sets: []set{{"a", time.Minute}, {"b", 0}}, want: 0},
+		{name: "persistent set is kept", sets: []set{{"a", 0}, {"b", time.Minute}}, want: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, c := newCache(t, &Options{Namespace: "svc"})
+
+			for _, set := range tt.sets {
+				if err := Set(ctx, c, set.key, 1, set.ttl, "users"); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			members, err := s.SMembers("svc:tag#users")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(members) != len(tt.sets) {
+				t.Errorf("tag members: got %v, want %d keys", members, len(tt.sets))
+			}
+			if got := s.TTL("svc:tag#users"); got != tt.want {
+				t.Errorf("tag ttl: got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInvalidateTags(t *testing.T) {
+	ctx := context.Background()
+	s, c := newCache(t, &Options{Namespace: "svc"})
+
+	values := []struct {
+		key  string
+		tags []string
+	}{
+		{key: "user:1", tags: []string{"users"}},
+		{key: "user:2", tags: []string{"users", "admins"}},
+		{key: "order:1", tags: []string{"orders"}},
+	}
+	for _, v := range values {
+		if err := Set(ctx, c, v.key, v.key, time.Minute, v.tags...); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := c.InvalidateTags(ctx, "users"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		key  string
+		want bool
+	}{
+		{key: "svc:user:1"},
+		{key: "svc:user:2"},
+		{key: "svc:tag#users"},
+		{key: "svc:order:1", want: true},
+		{key: "svc:tag#orders", want: true},
+	}
+	for _, tt := range tests {
+		if got := s.Exists(tt.key); got != tt.want {
+			t.Errorf("%s exists: got %t, want %t", tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestGetOrLoad(t *testing.T) {
+	ctx := context.Background()
+	errLoad := errors.New("load failed")
+
+	tests := []struct {
+		name    string
+		opts    *Options
+		loader  func(ctx context.Context) (string, error)
+		want    string
+		wantErr error
+		// wantCached is the cached value the second call returns without the loader
+		wantCached bool
+	}{
+		{
+			name:       "value",
+			loader:     func(context.Context) (string, error) { return "v", nil },
+			want:       "v",
+			wantCached: true,
+		},
+		{
+			name:    "error is not cached",
+			loader:  func(context.Context) (string, error) { return "", errLoad },
+			wantErr: errLoad,
+		},
+		{
+			name:    "not found without negative ttl",
+			loader:  func(context.Context) (string, error) { return "", ErrNotFound },
+			wantErr: ErrNotFound,
+		},
+		{
+			name:       "not found with negative ttl",
+			opts:       &Options{NegativeTTL: time.Minute},
+			loader:     func(context.Context) (string, error) { return "", ErrNotFound },
+			wantErr:    ErrNotFound,
+			wantCached: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, c := newCache(t, tt.opts)
+
+			var calls int32
+			loader := func(ctx context.Context) (string, error) {
+				atomic.AddInt32(&calls, 1)
+				return tt.loader(ctx)
+			}
+
+			for i := 0; i < 2; i++ {
+				got, err := GetOrLoad(ctx, c, "key", time.Minute, loader)
+				if !errors.Is(err, tt.wantErr) || got != tt.want {
+					t.Fatalf("call %d: got %q, %v, want %q, %v", i, got, err, tt.want, tt.wantErr)
+				}
+			}
+
+			want := int32(2)
+			if tt.wantCached {
+				want = 1
+			}
+			if calls != want {
+				t.Errorf("loader called %d times, want %d", calls, want)
+			}
+		})
+	}
+}
+
+func TestGetOrLoadCollapsesLoads(t *testing.T) {
+	ctx := context.Background()
+	_, c := newCache(t, nil)
+
+	var calls int32
+	release := make(chan struct{})
+	loader := func(context.Context) (int, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return 42, nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if v, err := GetOrLoad(ctx, c, "key", time.Minute, loader); err != nil || v != 42 {
+				t.Errorf("got %d, %v, want 42", v, err)
+			}
+		}()
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if calls != 1 {
+		t.Errorf("loader called %d times, want 1", calls)
+	}
+}
+
+func TestGetOrLoadDetachesTheLoader(t *testing.T) {
+	_, c := newCache(t, &Options{LoadTimeout: time.Second})
+
+	started := make(chan struct{})
+	loaded := make(chan error, 1)
+	loader := func(ctx context.Context) (int, error) {
+		close(started)
+		time.Sleep(50 * time.Millisecond)
+		loaded <- ctx.Err()
+		return 42, nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-started
+		cancel()
+	}()
+
+	if _, err := GetOrLoad(ctx, c, "key", time.Minute, loader); !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, want the caller to give up with context.Canceled", err)
+	}
+	if err := <-loaded; err != nil {
+		t.Fatalf("the loader context is done with the caller: %v", err)
+	}
+
+	// the result of the detached load is cached
+	time.Sleep(50 * time.Millisecond)
+	if v, err := Get[int](context.Background(), c, "key"); err != nil || v != 42 {
+		t.Errorf("got %d, %v, want 42", v, err)
+	}
+}
+
+func TestGetOrLoadTimeout(t *testing.T) {
+	_, c := newCache(t, &Options{LoadTimeout: 20 * time.Millisecond})
+
+	loader := func(ctx context.Context) (int, error) {
+		<-ctx.Done()
+		return 0, ctx.Err()
+	}
+
+	if _, err := GetOrLoad(context.Background(), c, "key", time.Minute, loader); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, want context.DeadlineExceeded", err)
+	}
+}
+
+func TestLocalTier(t *testing.T) {
+	ctx := context.Background()
+	s, c := newCache(t, &Options{Namespace: "svc", LocalSize: 10})
+
+	// the values are written around the cache, so no invalidation is published
+	_ = s.Set("svc:key", string(encodeEntry(entry{data: []byte(`"v1"`)})))
+	if v, err := Get[string](ctx, c, "key"); err != nil || v != "v1" {
+		t.Fatalf("got %q, %v, want v1", v, err)
+	}
+
+	_ = s.Set("svc:key", string(encodeEntry(entry{data: []byte(`"v2"`)})))
+	if v, _ := Get[string](ctx, c, "key"); v != "v1" {
+		t.Fatalf("got %q, want v1 from the local tier", v)
+	}
+
+	// published until received, the subscription starts in background
+	deadline := time.Now().Add(time.Second)
+	for {
+		s.Publish("svc:cache:invalidate", "svc:key")
+		v, _ := Get[string](ctx, c, "key")
+		if v == "v2" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got %q after the invalidation, want v2", v)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestLocalGeneration(t *testing.T) {
+	tests := []struct {
+		name string
+		// invalidate deletes the key between taking the generation and the set
+		invalidate bool
+		want       bool
+	}{
+		{name: "not invalidated", want: true},
+		{name: "invalidated during the read", invalidate: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newLocal(10, time.Minute)
+
+			gen := l.generation("key")
+			if tt.invalidate {
+				l.delete("key")
+			}
+			l.set("key", []byte("v"), 0, gen)
+
+			if _, ok := l.get("key"); ok != tt.want {
+				t.Errorf("cached: got %t, want %t", ok, tt.want)
+			}
+		})
+	}
+}
+
+func TestLocalEviction(t *testing.T) {
+	l := newLocal(2, time.Minute)
+
+	for _, key := range []string{"a", "b"} {
+		l.set(key, []byte(key), 0, l.generation(key))
+	}
+	l.get("a")
+	l.set("c", []byte("c"), 0, l.generation("c"))
+
+	tests := []struct {
+		key  string
+		want bool
+	}{
+		{key: "a", want: true},
+		{key: "b"},
+		{key: "c", want: true},
+	}
+	for _, tt := range tests {
+		if _, ok := l.get(tt.key); ok != tt.want {
+			t.Errorf("%s cached: got %t, want %t", tt.key, ok, tt.want)
+		}
+	}
+}
+
+func TestEntryEncoding(t *testing.T) {
+	expires := time.UnixMilli(time.Now().Add(time.Hour).UnixMilli())
+
+	tests := []struct {
+		name string
+		e    entry
+	}{
+		{name: "value", e: entry{data: []byte(`"v"`), delta: 120 * time.Millisecond, expires: expires}},
+		{name: "persistent", e: entry{data: []byte(`1`)}},
+		{name: "missing", e: entry{missing: true, expires: expires}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decodeEntry(encodeEntry(tt.e))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.missing != tt.e.missing || got.delta != tt.e.delta || !got.expires.Equal(tt.e.expires) || string(got.data) != string(tt.e.data) {
+				t.Errorf("got %+v, want %+v", got, tt.e)
+			}
+		})
+	}
+
+	for _, data := range [][]byte{nil, []byte("short"), append([]byte{9}, make([]byte, headerSize)...)} {
+		if _, err := decodeEntry(data); err == nil {
+			t.Errorf("decoded malformed entry %q", data)
+		}
+	}
+}
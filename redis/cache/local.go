@@ -0,0 +1,131 @@
+/*
+Copyright [2014] - [2024] The Last.Backend authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cache
+
+import (
+	"container/list"
+	"hash/maphash"
+	"sync"
+	"time"
+)
+
+// generations is the number of invalidation counters the keys are spread over
+const generations = 256
+
+// local is the in-process tier, a LRU of encoded entries
+type local struct {
+	mtx   sync.Mutex
+	size  int
+	ttl   time.Duration
+	items map[string]*list.Element
+	lru   *list.List
+	// gens counts the invalidations of the keys hashed to each counter, an entry read
+	// from redis is kept only if no invalidation of its key arrived during the read
+	seed maphash.Seed
+	gens [generations]uint64
+}
+
+type localItem struct {
+	key     string
+	data    []byte
+	expires time.Time
+}
+
+func newLocal(size int, ttl time.Duration) *local {
+	return &local{
+		size:  size,
+		ttl:   ttl,
+		items: make(map[string]*list.Element, size),
+		lru:   list.New(),
+		seed:  maphash.MakeSeed(),
+	}
+}
+
+func (l *local) gen(key string) *uint64 {
+	return &l.gens[maphash.String(l.seed, key)%generations]
+}
+
+// generation returns the invalidation counter of the key, it is passed to set
+func (l *local) generation(key string) uint64 {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	return *l.gen(key)
+}
+
+func (l *local) get(key string) ([]byte, bool) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	el, ok := l.items[key]
+	if !ok {
+		return nil, false
+	}
+
+	item := el.Value.(*localItem)
+	if time.Now().After(item.expires) {
+		l.remove(el)
+		return nil, false
+	}
+
+	l.lru.MoveToFront(el)
+	return item.data, true
+}
+
+// set stores the entry for the local ttl, but not longer than it lives in redis.
+// The entry is dropped if the key was invalidated since the generation was taken.
+func (l *local) set(key string, data []byte, ttl time.Duration, generation uint64) {
+	if ttl <= 0 || ttl > l.ttl {
+		ttl = l.ttl
+	}
+
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	if *l.gen(key) != generation {
+		return
+	}
+
+	if el, ok := l.items[key]; ok {
+		item := el.Value.(*localItem)
+		item.data, item.expires = data, time.Now().Add(ttl)
+		l.lru.MoveToFront(el)
+		return
+	}
+
+	l.items[key] = l.lru.PushFront(&localItem{key: key, data: data, expires: time.Now().Add(ttl)})
+
+	for l.lru.Len() > l.size {
+		l.remove(l.lru.Back())
+	}
+}
+
+func (l *local) delete(keys ...string) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	for _, key := range keys {
+		*l.gen(key)++
+		if el, ok := l.items[key]; ok {
+			l.remove(el)
+		}
+	}
+}
+
+func (l *local) remove(el *list.Element) {
+	l.lru.Remove(el)
+	delete(l.items, el.Value.(*localItem).key)
+}
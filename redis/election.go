@@ -0,0 +1,291 @@
+/*
+Copyright [2014] - [2024] The Last.Backend authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package redis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/lastbackend/toolkit-plugins/redis/lock"
+	"github.com/lastbackend/toolkit/pkg/runtime/logger"
+	"github.com/redis/go-redis/v9"
+)
+
+// Election elects one leader among the instances of a service. The leader holds
+// a lease key and renews it, the other instances take it over once it expires.
+type Election interface {
+	// IsLeader reports whether this instance holds the lease
+	IsLeader() bool
+	// Term returns the fencing token of the current lease, it grows with every election, 0 when not the leader
+	Term() int64
+	// OnElected registers a callback called when this instance becomes the leader.
+	// It is called right away when this instance is already the leader.
+	OnElected(fn func())
+	// OnRevoked registers a callback called when this instance loses the leadership
+	OnRevoked(fn func())
+	// Run calls fn while this instance is the leader. The context of fn is canceled
+	// when the leadership is lost and fn is called again after the next election.
+	// Run returns when ctx is done, fn returns by itself or the election is resigned.
+	Run(ctx context.Context, fn func(ctx context.Context) error) error
+	// Resign releases the lease and stops campaigning, the election can not be used anymore
+	Resign(ctx context.Context) error
+}
+
+type electionOptions struct {
+	TTL   time.Duration
+	Renew time.Duration
+}
+
+type election struct {
+	log    logger.Logger
+	locker *lock.Locker
+	key    string
+	opts   electionOptions
+
+	mtx       sync.Mutex
+	lease     *lock.Lock
+	onElected []func()
+	onRevoked []func()
+	// elected is closed when this instance becomes the leader, lost when it loses the leadership
+	elected chan struct{}
+	lost    chan struct{}
+
+	stop     chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+	// resigned is called once on Resign
+	resigned func()
+}
+
+func newElection(log logger.Logger, client redis.UniversalClient, key string, opts electionOptions, resigned func()) *election {
+	e := &election{
+		log:      log,
+		locker:   lock.New(client),
+		key:      key,
+		opts:     opts,
+		resigned: resigned,
+		elected:  make(chan struct{}),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go e.campaign()
+	return e
+}
+
+func (e *election) IsLeader() bool {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	return e.lease != nil
+}
+
+func (e *election) Term() int64 {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	if e.lease == nil {
+		return 0
+	}
+	return e.lease.Token()
+}
+
+func (e *election) OnElected(fn func()) {
+	e.mtx.Lock()
+	e.onElected = append(e.onElected, fn)
+	// the campaign may have won before the callback was registered
+	leader := e.lease != nil
+	e.mtx.Unlock()
+
+	if leader {
+		fn()
+	}
+}
+
+func (e *election) OnRevoked(fn func()) {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	e.onRevoked = append(e.onRevoked, fn)
+}
+
+func (e *election) Run(ctx context.Context, fn func(ctx context.Context) error) error {
+	for {
+		lost, err := e.await(ctx)
+		if err != nil || lost == nil {
+			return err
+		}
+
+		fctx, cancel := context.WithCancel(ctx)
+		done := make(chan error, 1)
+		go func() {
+			done <- fn(fctx)
+		}()
+
+		select {
+		case err := <-done:
+			cancel()
+			return err
+		case <-lost:
+			cancel()
+			<-done
+			e.log.Warnf("redis: leadership of %s lost, waiting for the next election", e.key)
+		}
+	}
+}
+
+func (e *election) Resign(ctx context.Context) error {
+	e.stopOnce.Do(func() {
+		close(e.stop)
+		if e.resigned != nil {
+			e.resigned()
+		}
+	})
+
+	select {
+	case <-e.done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	e.mtx.Lock()
+	lease := e.lease
+	e.mtx.Unlock()
+
+	if lease == nil {
+		return nil
+	}
+
+	e.revoke()
+
+	if err := lease.Release(ctx); err != nil && !errors.Is(err, lock.ErrNotHeld) {
+		return err
+	}
+	return nil
+}
+
+// await blocks until this instance is the leader and returns the channel closed on the loss,
+// it returns a nil channel once the election is resigned
+func (e *election) await(ctx context.Context) (<-chan struct{}, error) {
+	for {
+		select {
+		case <-e.stop:
+			return nil, nil
+		default:
+		}
+
+		e.mtx.Lock()
+		if e.lease != nil {
+			lost := e.lost
+			e.mtx.Unlock()
+			return lost, nil
+		}
+		elected := e.elected
+		e.mtx.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-e.stop:
+			return nil, nil
+		case <-elected:
+		}
+	}
+}
+
+// campaign tries to take the lease while it is free and renews it while it is held
+func (e *election) campaign() {
+	defer close(e.done)
+
+	var renewed time.Time
+
+	for {
+		e.mtx.Lock()
+		lease := e.lease
+		e.mtx.Unlock()
+
+		ctx, cancel := context.WithTimeout(context.Background(), e.opts.Renew)
+
+		if lease == nil {
+			lease, err := e.locker.Obtain(ctx, e.key, e.opts.TTL, nil)
+			switch {
+			case err == nil:
+				renewed = time.Now()
+				e.elect(lease)
+			case !errors.Is(err, lock.ErrNotObtained):
+				e.log.Errorf("redis: can not campaign for %s: %v", e.key, err)
+			}
+		} else {
+			start := time.Now()
+			err := lease.Refresh(ctx, e.opts.TTL)
+			switch {
+			case err == nil:
+				renewed = start
+			case errors.Is(err, lock.ErrNotHeld):
+				e.log.Warnf("redis: lease of %s was taken over", e.key)
+				e.revoke()
+			case time.Now().Add(e.opts.Renew).After(renewed.Add(e.opts.TTL)):
+				// the lease expires before the next attempt, someone else may take it
+				e.log.Errorf("redis: can not renew lease of %s: %v", e.key, err)
+				e.revoke()
+			default:
+				e.log.Warnf("redis: can not renew lease of %s, retrying: %v", e.key, err)
+			}
+		}
+
+		cancel()
+
+		select {
+		case <-e.stop:
+			return
+		case <-time.After(e.opts.Renew):
+		}
+	}
+}
+
+func (e *election) elect(lease *lock.Lock) {
+	e.mtx.Lock()
+	e.lease = lease
+	e.lost = make(chan struct{})
+	close(e.elected)
+	callbacks := append([]func(){}, e.onElected...)
+	e.mtx.Unlock()
+
+	for _, fn := range callbacks {
+		fn()
+	}
+}
+
+func (e *election) revoke() {
+	e.mtx.Lock()
+	if e.lease == nil {
+		e.mtx.Unlock()
+		return
+	}
+	e.lease = nil
+	close(e.lost)
+	e.elected = make(chan struct{})
+	callbacks := append([]func(){}, e.onRevoked...)
+	e.mtx.Unlock()
+
+	for _, fn := range callbacks {
+		fn()
+	}
+}
+
+func electionKey(service, name string) string {
+	return fmt.Sprintf("%s:leader:%s", service, name)
+}
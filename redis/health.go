@@ -0,0 +1,273 @@
+/*
+Copyright [2014] - [2024] The Last.Backend authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package redis
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lastbackend/toolkit/pkg/runtime/logger"
+	"github.com/lastbackend/toolkit/pkg/tools/probes"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/redis/go-redis/v9"
+)
+
+// ClusterHealthPolicy decides which cluster failures fail the readiness, the others are reported as degraded
+type ClusterHealthPolicy string
+
+const (
+	// ClusterHealthAll fails on any unreachable node or a cluster state other than ok
+	ClusterHealthAll ClusterHealthPolicy = "all"
+	// ClusterHealthMasters fails on an unreachable master or a cluster state other than ok
+	ClusterHealthMasters ClusterHealthPolicy = "masters"
+	// ClusterHealthState fails only when the cluster reports a failed state
+	ClusterHealthState ClusterHealthPolicy = "state"
+)
+
+const (
+	roleMaster  = "master"
+	roleReplica = "replica"
+)
+
+func parseClusterHealthPolicy(policy string) (ClusterHealthPolicy, error) {
+	switch p := ClusterHealthPolicy(strings.ToLower(policy)); p {
+	case "", ClusterHealthMasters:
+		return ClusterHealthMasters, nil
+	case ClusterHealthAll, ClusterHealthState:
+		return p, nil
+	default:
+		return "", fmt.Errorf("unknown cluster health policy %q, expected %s, %s or %s", policy, ClusterHealthAll, ClusterHealthMasters, ClusterHealthState)
+	}
+}
+
+type nodeHealth struct {
+	addr    string
+	role    string
+	latency time.Duration
+	state   string
+	err     error
+}
+
+// clusterHealth visits every master and replica, a ping through the cluster client reaches one node only
+type clusterHealth struct {
+	client  *redis.ClusterClient
+	policy  ClusterHealthPolicy
+	timeout time.Duration
+	log     logger.Logger
+
+	up      *prometheus.GaugeVec
+	latency *prometheus.GaugeVec
+
+	mtx      sync.Mutex
+	degraded string
+}
+
+func newClusterHealth(client *redis.ClusterClient, policy ClusterHealthPolicy, timeout time.Duration, log logger.Logger) *clusterHealth {
+	return &clusterHealth{
+		client:  client,
+		policy:  policy,
+		timeout: timeout,
+		log:     log,
+	}
+}
+
+// register exposes the node state of the last check as metrics
+func (h *clusterHealth) register(name string, registerer prometheus.Registerer) error {
+	labels := prometheus.Labels{"client": name}
+
+	h.up = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name:        "redis_cluster_node_up",
+		Help:        "Whether the cluster node answered the last health check.",
+		ConstLabels: labels,
+	}, []string{"node", "role"})
+
+	h.latency = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name:        "redis_cluster_node_latency_seconds",
+		Help:        "Ping latency of the cluster node in the last health check.",
+		ConstLabels: labels,
+	}, []string{"node", "role"})
+
+	for _, c := range []prometheus.Collector{h.up, h.latency} {
+		if err := registerer.Register(c); err != nil {
+			return fmt.Errorf("can not register redis cluster metrics: %v", err)
+		}
+	}
+	return nil
+}
+
+func (h *clusterHealth) unregister(registerer prometheus.Registerer) {
+	if h.up == nil {
+		return
+	}
+	registerer.Unregister(h.up)
+	registerer.Unregister(h.latency)
+}
+
+func (h *clusterHealth) checker() probes.HandleFunc {
+	return func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
+		defer cancel()
+		return h.check(ctx)
+	}
+}
+
+func (h *clusterHealth) check(ctx context.Context) error {
+	nodes, err := h.visit(ctx)
+	if err != nil {
+		return err
+	}
+
+	if h.up != nil {
+		h.up.Reset()
+		h.latency.Reset()
+		for _, n := range nodes {
+			if n.err != nil {
+				h.up.WithLabelValues(n.addr, n.role).Set(0)
+				continue
+			}
+			h.up.WithLabelValues(n.addr, n.role).Set(1)
+			h.latency.WithLabelValues(n.addr, n.role).Set(n.latency.Seconds())
+		}
+	}
+
+	var failures, degraded []string
+	for _, n := range nodes {
+		var problem string
+		switch {
+		case n.err != nil:
+			problem = fmt.Sprintf("%s %s: %v", n.role, n.addr, n.err)
+		case n.state != "" && n.state != "ok":
+			problem = fmt.Sprintf("%s %s: cluster state %s", n.role, n.addr, n.state)
+		default:
+			continue
+		}
+
+		if h.fails(n) {
+			failures = append(failures, problem)
+		} else {
+			degraded = append(degraded, problem)
+		}
+	}
+
+	h.report(degraded)
+
+	if len(failures) > 0 {
+		return fmt.Errorf("redis cluster is unhealthy: %s", strings.Join(failures, "; "))
+	}
+	return nil
+}
+
+// fails reports whether the problem of the node fails the readiness under the policy
+func (h *clusterHealth) fails(n nodeHealth) bool {
+	if n.err == nil {
+		// the node answered, the cluster state is other than ok
+		return true
+	}
+	switch h.policy {
+	case ClusterHealthAll:
+		return true
+	case ClusterHealthMasters:
+		return n.role == roleMaster
+	default:
+		return false
+	}
+}
+
+// visit pings every node and reads the cluster state from the masters
+func (h *clusterHealth) visit(ctx context.Context) ([]nodeHealth, error) {
+	var (
+		mtx   sync.Mutex
+		nodes []nodeHealth
+	)
+
+	visit := func(role string) func(ctx context.Context, node *redis.Client) error {
+		return func(ctx context.Context, node *redis.Client) error {
+			n := nodeHealth{addr: node.Options().Addr, role: role}
+
+			start := time.Now()
+			n.err = node.Ping(ctx).Err()
+			n.latency = time.Since(start)
+
+			if n.err == nil && role == roleMaster {
+				info, err := node.ClusterInfo(ctx).Result()
+				if err != nil {
+					n.err = err
+				} else {
+					n.state = clusterState(info)
+				}
+			}
+
+			mtx.Lock()
+			nodes = append(nodes, n)
+			mtx.Unlock()
+			return nil
+		}
+	}
+
+	if err := h.client.ForEachMaster(ctx, visit(roleMaster)); err != nil {
+		return nil, err
+	}
+	if err := h.client.ForEachSlave(ctx, visit(roleReplica)); err != nil {
+		return nil, err
+	}
+
+	if len(nodes) == 0 {
+		return nil, fmt.Errorf("redis cluster has no known nodes")
+	}
+
+	sort.Slice(nodes, func(i, j int) bool {
+		if nodes[i].role != nodes[j].role {
+			return nodes[i].role == roleMaster
+		}
+		return nodes[i].addr < nodes[j].addr
+	})
+
+	return nodes, nil
+}
+
+// report logs the degraded nodes when they change, not on every probe
+func (h *clusterHealth) report(degraded []string) {
+	summary := strings.Join(degraded, "; ")
+
+	h.mtx.Lock()
+	changed := summary != h.degraded
+	h.degraded = summary
+	h.mtx.Unlock()
+
+	if !changed {
+		return
+	}
+	if summary == "" {
+		h.log.Warnf("redis: cluster is healthy again")
+		return
+	}
+	h.log.Warnf("redis: cluster is degraded: %s", summary)
+}
+
+// clusterState returns the cluster_state field of CLUSTER INFO
+func clusterState(info string) string {
+	for _, line := range strings.Split(info, "\n") {
+		if v, ok := strings.CutPrefix(strings.TrimSpace(line), "cluster_state:"); ok {
+			return v
+		}
+	}
+	return ""
+}
@@ -0,0 +1,306 @@
+/*
+Copyright [2014] - [2024] The Last.Backend authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package redis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	instrumentationName = "github.com/lastbackend/toolkit-plugins/redis"
+	// statementMaxLen bounds the captured arguments of large commands such as MSET
+	statementMaxLen = 256
+)
+
+// sensitiveCommands are captured without any argument
+var sensitiveCommands = map[string]bool{
+	"auth":    true,
+	"hello":   true,
+	"migrate": true,
+	"acl":     true,
+	"config":  true,
+}
+
+type instrumentationOptions struct {
+	Metrics bool
+	Tracing bool
+	// Args captures the command arguments in the spans, values are redacted
+	Args bool
+}
+
+// instrumentation is a redis.Hook recording the command metrics and spans
+type instrumentation struct {
+	opts   instrumentationOptions
+	tracer trace.Tracer
+
+	duration *prometheus.HistogramVec
+	errors   *prometheus.CounterVec
+	pool     *poolCollector
+}
+
+// newInstrumentation registers the metrics with the client name as a label,
+// so the metrics of several plugins do not collide
+func newInstrumentation(clients []redis.UniversalClient, name string, opts instrumentationOptions, registerer prometheus.Registerer) (*instrumentation, error) {
+	i := &instrumentation{
+		opts:   opts,
+		tracer: otel.Tracer(instrumentationName),
+	}
+
+	if !opts.Metrics {
+		return i, nil
+	}
+
+	labels := prometheus.Labels{"client": name}
+
+	i.duration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:        "redis_command_duration_seconds",
+		Help:        "Duration of redis commands, pipelines are reported as the pipeline command.",
+		ConstLabels: labels,
+		Buckets:     prometheus.ExponentialBuckets(0.0001, 2.5, 12),
+	}, []string{"command"})
+
+	i.errors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name:        "redis_command_errors_total",
+		Help:        "Number of failed redis commands, missing keys are not counted.",
+		ConstLabels: labels,
+	}, []string{"command"})
+
+	i.pool = newPoolCollector(clients, labels)
+
+	for _, c := range []prometheus.Collector{i.duration, i.errors, i.pool} {
+		if err := registerer.Register(c); err != nil {
+			return nil, fmt.Errorf("can not register redis metrics: %v", err)
+		}
+	}
+
+	return i, nil
+}
+
+func (i *instrumentation) DialHook(next redis.DialHook) redis.DialHook {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if !i.opts.Tracing {
+			return next(ctx, network, addr)
+		}
+
+		ctx, span := i.tracer.Start(ctx, "redis.dial", trace.WithSpanKind(trace.SpanKindClient),
+			trace.WithAttributes(attribute.String("db.system", "redis"), attribute.String("net.peer.name", addr)))
+		defer span.End()
+
+		conn, err := next(ctx, network, addr)
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		return conn, err
+	}
+}
+
+func (i *instrumentation) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		name := cmd.FullName()
+
+		var span trace.Span
+		if i.opts.Tracing {
+			attrs := []attribute.KeyValue{
+				attribute.String("db.system", "redis"),
+				attribute.String("db.operation", name),
+			}
+			if i.opts.Args {
+				attrs = append(attrs, attribute.String("db.statement", statement(cmd)))
+			}
+			ctx, span = i.tracer.Start(ctx, name, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attrs...))
+		}
+
+		start := time.Now()
+		err := next(ctx, cmd)
+		i.record(name, time.Since(start), err)
+
+		if span != nil {
+			fail(span, err)
+			span.End()
+		}
+		return err
+	}
+}
+
+func (i *instrumentation) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		var span trace.Span
+		if i.opts.Tracing {
+			names := make([]string, 0, len(cmds))
+			statements := make([]string, 0, len(cmds))
+			for _, cmd := range cmds {
+				names = append(names, cmd.FullName())
+				if i.opts.Args {
+					statements = append(statements, statement(cmd))
+				}
+			}
+
+			attrs := []attribute.KeyValue{
+				attribute.String("db.system", "redis"),
+				attribute.String("db.operation", "pipeline"),
+				attribute.StringSlice("db.redis.commands", names),
+				attribute.Int("db.redis.num_cmd", len(cmds)),
+			}
+			if i.opts.Args {
+				attrs = append(attrs, attribute.String("db.statement", strings.Join(statements, "\n")))
+			}
+			ctx, span = i.tracer.Start(ctx, "pipeline", trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attrs...))
+		}
+
+		start := time.Now()
+		err := next(ctx, cmds)
+		// the errors are counted by command, a connection error fails all of them
+		i.record("pipeline", time.Since(start), nil)
+		for _, cmd := range cmds {
+			i.record(cmd.FullName(), -1, cmd.Err())
+		}
+
+		if span != nil {
+			fail(span, err)
+			span.End()
+		}
+		return err
+	}
+}
+
+// record observes the duration unless it is negative and counts the error
+func (i *instrumentation) record(command string, duration time.Duration, err error) {
+	if !i.opts.Metrics {
+		return
+	}
+	if duration >= 0 {
+		i.duration.WithLabelValues(command).Observe(duration.Seconds())
+	}
+	if failed(err) {
+		i.errors.WithLabelValues(command).Inc()
+	}
+}
+
+func (i *instrumentation) unregister(registerer prometheus.Registerer) {
+	if !i.opts.Metrics {
+		return
+	}
+	registerer.Unregister(i.duration)
+	registerer.Unregister(i.errors)
+	registerer.Unregister(i.pool)
+}
+
+// failed reports whether the error is a failure, a missing key is a regular reply
+func failed(err error) bool {
+	return err != nil && !errors.Is(err, redis.Nil)
+}
+
+func fail(span trace.Span, err error) {
+	if failed(err) {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+}
+
+// statement renders the command with its first argument, usually the key,
+// and the other arguments redacted, e.g. "set user:1 ? ? ?"
+func statement(cmd redis.Cmder) string {
+	args := cmd.Args()
+	if len(args) == 0 {
+		return ""
+	}
+
+	name := strings.ToLower(fmt.Sprint(args[0]))
+
+	var b strings.Builder
+	b.WriteString(name)
+
+	for n, arg := range args[1:] {
+		if b.Len() >= statementMaxLen {
+			b.WriteString(" ...")
+			break
+		}
+		b.WriteByte(' ')
+		if n == 0 && !sensitiveCommands[name] {
+			b.WriteString(fmt.Sprint(arg))
+		} else {
+			b.WriteByte('?')
+		}
+	}
+
+	return b.String()
+}
+
+// poolCollector reports the connection pool stats at scrape time, summed over the clients
+type poolCollector struct {
+	clients []redis.UniversalClient
+
+	hits     *prometheus.Desc
+	misses   *prometheus.Desc
+	timeouts *prometheus.Desc
+	stale    *prometheus.Desc
+	total    *prometheus.Desc
+	idle     *prometheus.Desc
+}
+
+func newPoolCollector(clients []redis.UniversalClient, labels prometheus.Labels) *poolCollector {
+	return &poolCollector{
+		clients:  clients,
+		hits:     prometheus.NewDesc("redis_pool_hits_total", "Number of times a free connection was found in the pool.", nil, labels),
+		misses:   prometheus.NewDesc("redis_pool_misses_total", "Number of times a free connection was not found in the pool.", nil, labels),
+		timeouts: prometheus.NewDesc("redis_pool_timeouts_total", "Number of times waiting for a connection timed out.", nil, labels),
+		stale:    prometheus.NewDesc("redis_pool_stale_connections_total", "Number of stale connections removed from the pool.", nil, labels),
+		total:    prometheus.NewDesc("redis_pool_connections", "Number of connections in the pool.", nil, labels),
+		idle:     prometheus.NewDesc("redis_pool_idle_connections", "Number of idle connections in the pool.", nil, labels),
+	}
+}
+
+func (c *poolCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.hits
+	ch <- c.misses
+	ch <- c.timeouts
+	ch <- c.stale
+	ch <- c.total
+	ch <- c.idle
+}
+
+func (c *poolCollector) Collect(ch chan<- prometheus.Metric) {
+	stats := new(redis.PoolStats)
+	for _, client := range c.clients {
+		s := client.PoolStats()
+		stats.Hits += s.Hits
+		stats.Misses += s.Misses
+		stats.Timeouts += s.Timeouts
+		stats.StaleConns += s.StaleConns
+		stats.TotalConns += s.TotalConns
+		stats.IdleConns += s.IdleConns
+	}
+	ch <- prometheus.MustNewConstMetric(c.hits, prometheus.CounterValue, float64(stats.Hits))
+	ch <- prometheus.MustNewConstMetric(c.misses, prometheus.CounterValue, float64(stats.Misses))
+	ch <- prometheus.MustNewConstMetric(c.timeouts, prometheus.CounterValue, float64(stats.Timeouts))
+	ch <- prometheus.MustNewConstMetric(c.stale, prometheus.CounterValue, float64(stats.StaleConns))
+	ch <- prometheus.MustNewConstMetric(c.total, prometheus.GaugeValue, float64(stats.TotalConns))
+	ch <- prometheus.MustNewConstMetric(c.idle, prometheus.GaugeValue, float64(stats.IdleConns))
+}
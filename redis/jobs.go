@@ -0,0 +1,706 @@
+/*
+Copyright [2014] - [2024] The Last.Backend authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package redis
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	mrand "math/rand"
+	"runtime/debug"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/lastbackend/toolkit/pkg/runtime/logger"
+	"github.com/redis/go-redis/v9"
+	"github.com/robfig/cron/v3"
+)
+
+const jobsMaxBackoff = time.Hour
+
+// ErrDuplicateJob is returned by Enqueue with the id of the pending job holding the same unique key
+var ErrDuplicateJob = errors.New("job with the unique key is already enqueued")
+
+var (
+	// enqueueScript stores the job and schedules it, unless the unique key is taken
+	enqueueScript = redis.NewScript(`
+if ARGV[4] ~= "" then
+	local existing = redis.call("GET", KEYS[3])
+	if existing then
+		return {0, existing}
+	end
+	if tonumber(ARGV[4]) > 0 then
+		redis.call("SET", KEYS[3], ARGV[1], "PX", ARGV[4])
+	else
+		redis.call("SET", KEYS[3], ARGV[1])
+	end
+end
+redis.call("HSET", KEYS[1], ARGV[1], ARGV[2])
+redis.call("ZADD", KEYS[2], ARGV[3], ARGV[1])
+return {1, ARGV[1]}`)
+
+	// reserveScript moves the first due job of the scheduled keys in flight until the visibility deadline.
+	// The scheduled keys are those of the job types with a handler, the other types are left to other instances.
+	reserveScript = redis.NewScript(`
+local id, from, first
+for i = 4, #KEYS do
+	local due = redis.call("ZRANGEBYSCORE", KEYS[i], "-inf", ARGV[1], "WITHSCORES", "LIMIT", 0, 1)
+	if #due > 0 and (not first or tonumber(due[2]) < first) then
+		id, from, first = due[1], KEYS[i], tonumber(due[2])
+	end
+end
+if not id then
+	return false
+end
+redis.call("ZREM", from, id)
+local data = redis.call("HGET", KEYS[2], id)
+if not data then
+	return false
+end
+redis.call("ZADD", KEYS[1], ARGV[2], id)
+local attempt = redis.call("HINCRBY", KEYS[3], id, 1)
+return {id, data, attempt}`)
+
+	// ackScript removes the finished job and releases its unique key
+	ackScript = redis.NewScript(`
+if redis.call("ZREM", KEYS[1], ARGV[1]) == 0 then
+	return 0
+end
+redis.call("HDEL", KEYS[2], ARGV[1])
+redis.call("HDEL", KEYS[3], ARGV[1])
+if ARGV[2] == "1" and redis.call("GET", KEYS[4]) == ARGV[1] then
+	redis.call("DEL", KEYS[4])
+end
+return 1`)
+
+	// retryScript schedules the failed job again
+	retryScript = redis.NewScript(`
+if redis.call("ZREM", KEYS[1], ARGV[1]) == 0 then
+	return 0
+end
+redis.call("ZADD", KEYS[2], ARGV[2], ARGV[1])
+return 1`)
+
+	// buryScript moves the failed job to the dead jobs, the oldest dead jobs over the limit are removed
+	buryScript = redis.NewScript(`
+if redis.call("ZREM", KEYS[1], ARGV[1]) == 0 then
+	return 0
+end
+redis.call("ZADD", KEYS[2], ARGV[2], ARGV[1])
+redis.call("HSET", KEYS[3], ARGV[1], ARGV[3])
+redis.call("HDEL", KEYS[4], ARGV[1])
+if ARGV[4] == "1" and redis.call("GET", KEYS[5]) == ARGV[1] then
+	redis.call("DEL", KEYS[5])
+end
+local over = redis.call("ZCARD", KEYS[2]) - tonumber(ARGV[5])
+if over > 0 then
+	for _, id in ipairs(redis.call("ZPOPMIN", KEYS[2], over)) do
+		redis.call("HDEL", KEYS[3], id)
+	end
+end
+return 1`)
+
+	// requeueScript schedules the job of a stopped worker unless its visibility deadline was extended meanwhile
+	requeueScript = redis.NewScript(`
+local deadline = redis.call("ZSCORE", KEYS[1], ARGV[1])
+if not deadline or tonumber(deadline) > tonumber(ARGV[2]) then
+	return 0
+end
+redis.call("ZREM", KEYS[1], ARGV[1])
+redis.call("ZADD", KEYS[2], ARGV[2], ARGV[1])
+return 1`)
+
+	// retryDeadScript schedules a dead job again with a new attempt count
+	retryDeadScript = redis.NewScript(`
+if redis.call("ZREM", KEYS[1], ARGV[1]) == 0 then
+	return 0
+end
+redis.call("ZADD", KEYS[2], ARGV[2], ARGV[1])
+return 1`)
+)
+
+// Job is a unit of background work
+type Job struct {
+	ID      string `json:"id"`
+	Type    string `json:"type"`
+	Payload []byte `json:"payload"`
+	// Attempt is the number of the current attempt, starting with 1
+	Attempt    int       `json:"-"`
+	MaxRetries int       `json:"max_retries"`
+	EnqueuedAt time.Time `json:"enqueued_at"`
+	// LastError is the error of the last attempt of a dead job
+	LastError string `json:"last_error,omitempty"`
+
+	UniqueKey string `json:"unique_key,omitempty"`
+	// ReleaseUnique releases the unique key when the job succeeds or dies
+	ReleaseUnique bool `json:"release_unique,omitempty"`
+}
+
+// JobHandler handles a job, the job is retried when it returns an error or panics
+type JobHandler func(ctx context.Context, job *Job) error
+
+type JobOptions struct {
+	// Delay runs the job after the delay
+	Delay time.Duration
+	// At runs the job at the time, it takes precedence over Delay
+	At time.Time
+	// MaxRetries is the number of retries after failed attempts, 0 uses JOBS_MAX_RETRIES,
+	// a negative value disables retries
+	MaxRetries int
+	// UniqueKey refuses jobs with the same key while the job is pending or running
+	UniqueKey string
+	// UniqueFor keeps the unique key for the duration, regardless of the job state
+	UniqueFor time.Duration
+}
+
+// Jobs is a queue of delayed background jobs shared by the instances of the service
+type Jobs interface {
+	// Handle registers the handler of the job type. The instance reserves only the jobs
+	// of the types it handles, so instances may handle different types.
+	Handle(jobType string, handler JobHandler)
+	// Enqueue schedules a job and returns its id
+	Enqueue(ctx context.Context, jobType string, payload []byte, opts *JobOptions) (string, error)
+	// Periodic enqueues the job on the cron schedule, such as "*/5 * * * *" or "@hourly".
+	// Every instance registers the same schedule, the job is enqueued once per tick.
+	// Ticks of @every schedules depend on the instance start and are not deduplicated.
+	Periodic(name, spec, jobType string, payload []byte) error
+	// Dead returns the last jobs which failed after all retries
+	Dead(ctx context.Context, limit int64) ([]*Job, error)
+	// RetryDead schedules a dead job again
+	RetryDead(ctx context.Context, id string) error
+}
+
+type jobsOptions struct {
+	Workers      int
+	PollInterval time.Duration
+	Visibility   time.Duration
+	MaxRetries   int
+	RetryBackoff time.Duration
+	DeadMax      int64
+}
+
+type periodicJob struct {
+	name     string
+	schedule cron.Schedule
+	jobType  string
+	payload  []byte
+	next     time.Time
+}
+
+type jobs struct {
+	log    logger.Logger
+	client redis.UniversalClient
+	prefix string
+	opts   jobsOptions
+
+	mtx      sync.RWMutex
+	handlers map[string]JobHandler
+	periodic []*periodicJob
+
+	cancel  context.CancelFunc
+	stop    chan struct{}
+	workers sync.WaitGroup
+}
+
+func newJobs(log logger.Logger, client redis.UniversalClient, service string, opts jobsOptions) *jobs {
+	return &jobs{
+		log:    log,
+		client: client,
+		// the hash tag keeps the keys of the queue in one slot for the scripts
+		prefix:   fmt.Sprintf("{%s:jobs}", service),
+		opts:     opts,
+		handlers: make(map[string]JobHandler),
+		stop:     make(chan struct{}),
+	}
+}
+
+func (j *jobs) key(name string) string {
+	return j.prefix + ":" + name
+}
+
+func (j *jobs) uniqueKey(key string) string {
+	return j.key("unique:" + key)
+}
+
+// scheduledKey holds the pending jobs of the type, scored by the time they run at
+func (j *jobs) scheduledKey(jobType string) string {
+	return j.key("scheduled:" + jobType)
+}
+
+func (j *jobs) Handle(jobType string, handler JobHandler) {
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+	j.handlers[jobType] = handler
+}
+
+func (j *jobs) handler(jobType string) (JobHandler, bool) {
+	j.mtx.RLock()
+	defer j.mtx.RUnlock()
+	h, ok := j.handlers[jobType]
+	return h, ok
+}
+
+// handled returns the scheduled keys of the job types with a handler
+func (j *jobs) handled() []string {
+	j.mtx.RLock()
+	defer j.mtx.RUnlock()
+
+	keys := make([]string, 0, len(j.handlers))
+	for jobType := range j.handlers {
+		keys = append(keys, j.scheduledKey(jobType))
+	}
+	return keys
+}
+
+func (j *jobs) Enqueue(ctx context.Context, jobType string, payload []byte, opts *JobOptions) (string, error) {
+	if opts == nil {
+		opts = new(JobOptions)
+	}
+
+	id, err := jobID()
+	if err != nil {
+		return "", err
+	}
+
+	job := &Job{
+		ID:            id,
+		Type:          jobType,
+		Payload:       payload,
+		MaxRetries:    opts.MaxRetries,
+		EnqueuedAt:    time.Now().UTC(),
+		UniqueKey:     opts.UniqueKey,
+		ReleaseUnique: opts.UniqueKey != "" && opts.UniqueFor <= 0,
+	}
+	if job.MaxRetries == 0 {
+		job.MaxRetries = j.opts.MaxRetries
+	}
+
+	runAt := time.Now().Add(opts.Delay)
+	if !opts.At.IsZero() {
+		runAt = opts.At
+	}
+
+	data, err := json.Marshal(job)
+	if err != nil {
+		return "", err
+	}
+
+	var unique string
+	if opts.UniqueKey != "" {
+		unique = fmt.Sprintf("%d", opts.UniqueFor.Milliseconds())
+	}
+
+	res, err := enqueueScript.Run(ctx, j.client,
+		[]string{j.key("jobs"), j.scheduledKey(jobType), j.uniqueKey(opts.UniqueKey)},
+		id, data, runAt.UnixMilli(), unique).Slice()
+	if err != nil {
+		return "", err
+	}
+
+	if res[0].(int64) == 0 {
+		return res[1].(string), ErrDuplicateJob
+	}
+	return id, nil
+}
+
+func (j *jobs) Periodic(name, spec, jobType string, payload []byte) error {
+	schedule, err := cron.ParseStandard(spec)
+	if err != nil {
+		return fmt.Errorf("invalid schedule of %s: %v", name, err)
+	}
+
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+	j.periodic = append(j.periodic, &periodicJob{
+		name:     name,
+		schedule: schedule,
+		jobType:  jobType,
+		payload:  payload,
+		next:     schedule.Next(time.Now()),
+	})
+	return nil
+}
+
+func (j *jobs) Dead(ctx context.Context, limit int64) ([]*Job, error) {
+	if limit <= 0 {
+		limit = 100
+	}
+
+	ids, err := j.client.ZRevRange(ctx, j.key("dead"), 0, limit-1).Result()
+	if err != nil || len(ids) == 0 {
+		return nil, err
+	}
+
+	values, err := j.client.HMGet(ctx, j.key("jobs"), ids...).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]*Job, 0, len(values))
+	for _, v := range values {
+		data, ok := v.(string)
+		if !ok {
+			continue
+		}
+		job := new(Job)
+		if err := json.Unmarshal([]byte(data), job); err != nil {
+			return nil, err
+		}
+		list = append(list, job)
+	}
+	return list, nil
+}
+
+func (j *jobs) RetryDead(ctx context.Context, id string) error {
+	data, err := j.client.HGet(ctx, j.key("jobs"), id).Result()
+	if errors.Is(err, redis.Nil) {
+		return fmt.Errorf("dead job %s not found", id)
+	}
+	if err != nil {
+		return err
+	}
+
+	job := new(Job)
+	if err := json.Unmarshal([]byte(data), job); err != nil {
+		return fmt.Errorf("malformed job %s: %v", id, err)
+	}
+
+	if err := j.client.HDel(ctx, j.key("attempts"), id).Err(); err != nil {
+		return err
+	}
+
+	n, err := retryDeadScript.Run(ctx, j.client, []string{j.key("dead"), j.scheduledKey(job.Type)}, id, time.Now().UnixMilli()).Int()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return fmt.Errorf("dead job %s not found", id)
+	}
+	return nil
+}
+
+// start runs the workers and the scheduler, it is called from PreStart
+func (j *jobs) start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	j.cancel = cancel
+
+	for i := 0; i < j.opts.Workers; i++ {
+		j.workers.Add(1)
+		go j.work(ctx)
+	}
+
+	j.workers.Add(1)
+	go j.schedule()
+}
+
+// drain stops taking new jobs and waits for the running ones. Jobs still running when
+// ctx is done are canceled and taken over by other instances after the visibility timeout.
+func (j *jobs) drain(ctx context.Context) error {
+	if j.cancel == nil {
+		return nil
+	}
+
+	close(j.stop)
+
+	done := make(chan struct{})
+	go func() {
+		j.workers.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		j.cancel()
+		return nil
+	case <-ctx.Done():
+		j.cancel()
+		<-done
+		return ctx.Err()
+	}
+}
+
+func (j *jobs) wait(d time.Duration) bool {
+	select {
+	case <-j.stop:
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
+
+func (j *jobs) work(ctx context.Context) {
+	defer j.workers.Done()
+
+	for {
+		select {
+		case <-j.stop:
+			return
+		default:
+		}
+
+		scheduled := j.handled()
+		if len(scheduled) == 0 {
+			if !j.wait(j.opts.PollInterval) {
+				return
+			}
+			continue
+		}
+
+		job, err := j.reserve(scheduled)
+		if err != nil {
+			j.log.Errorf("redis: can not reserve job: %v", err)
+		}
+		if job == nil {
+			if !j.wait(j.opts.PollInterval) {
+				return
+			}
+			continue
+		}
+
+		j.process(ctx, job)
+	}
+}
+
+func (j *jobs) reserve(scheduled []string) (*Job, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), j.opts.Visibility)
+	defer cancel()
+
+	now := time.Now()
+	keys := append([]string{j.key("inflight"), j.key("jobs"), j.key("attempts")}, scheduled...)
+	res, err := reserveScript.Run(ctx, j.client, keys,
+		now.UnixMilli(), now.Add(j.opts.Visibility).UnixMilli()).Slice()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	job := new(Job)
+	if err := json.Unmarshal([]byte(res[1].(string)), job); err != nil {
+		return nil, fmt.Errorf("malformed job %v: %v", res[0], err)
+	}
+	job.Attempt = int(res[2].(int64))
+	return job, nil
+}
+
+// process runs the handler and extends the visibility deadline while it runs
+func (j *jobs) process(ctx context.Context, job *Job) {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(j.opts.Visibility / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				deadline := time.Now().Add(j.opts.Visibility).UnixMilli()
+				if err := j.client.ZAddXX(context.Background(), j.key("inflight"), redis.Z{Score: float64(deadline), Member: job.ID}).Err(); err != nil {
+					j.log.Warnf("redis: can not extend job %s: %v", job.ID, err)
+				}
+			}
+		}
+	}()
+
+	err := j.call(ctx, job)
+	close(done)
+
+	if err == nil {
+		j.ack(job)
+		return
+	}
+
+	if job.MaxRetries < 0 || job.Attempt > job.MaxRetries {
+		j.bury(job, err)
+		return
+	}
+
+	j.retry(job, err)
+}
+
+func (j *jobs) call(ctx context.Context, job *Job) (err error) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			err = fmt.Errorf("panic: %v", rec)
+			j.log.Errorf("redis: job %s of %s panicked: %v\n%s", job.ID, job.Type, rec, debug.Stack())
+		}
+	}()
+
+	h, ok := j.handler(job.Type)
+	if !ok {
+		return fmt.Errorf("no handler of job type %s", job.Type)
+	}
+	return h(ctx, job)
+}
+
+func (j *jobs) ack(job *Job) {
+	err := ackScript.Run(context.Background(), j.client,
+		[]string{j.key("inflight"), j.key("jobs"), j.key("attempts"), j.uniqueKey(job.UniqueKey)},
+		job.ID, flag(job.ReleaseUnique)).Err()
+	if err != nil {
+		j.log.Errorf("redis: can not ack job %s: %v", job.ID, err)
+	}
+}
+
+func (j *jobs) retry(job *Job, cause error) {
+	delay := j.backoff(job.Attempt)
+	j.log.Warnf("redis: job %s of %s failed on attempt %d, retrying in %s: %v", job.ID, job.Type, job.Attempt, delay, cause)
+
+	err := retryScript.Run(context.Background(), j.client,
+		[]string{j.key("inflight"), j.scheduledKey(job.Type)},
+		job.ID, time.Now().Add(delay).UnixMilli()).Err()
+	if err != nil {
+		j.log.Errorf("redis: can not retry job %s: %v", job.ID, err)
+	}
+}
+
+func (j *jobs) bury(job *Job, cause error) {
+	j.log.Errorf("redis: job %s of %s failed after %d attempts: %v", job.ID, job.Type, job.Attempt, cause)
+
+	job.LastError = cause.Error()
+	data, err := json.Marshal(job)
+	if err != nil {
+		j.log.Errorf("redis: can not encode job %s: %v", job.ID, err)
+		return
+	}
+
+	err = buryScript.Run(context.Background(), j.client,
+		[]string{j.key("inflight"), j.key("dead"), j.key("jobs"), j.key("attempts"), j.uniqueKey(job.UniqueKey)},
+		job.ID, time.Now().UnixMilli(), data, flag(job.ReleaseUnique), j.opts.DeadMax).Err()
+	if err != nil {
+		j.log.Errorf("redis: can not move job %s to dead jobs: %v", job.ID, err)
+	}
+}
+
+// backoff grows exponentially with the attempt up to an hour, with jitter
+func (j *jobs) backoff(attempt int) time.Duration {
+	if attempt > 16 {
+		attempt = 16
+	}
+	d := j.opts.RetryBackoff << uint(attempt-1)
+	if d <= 0 || d > jobsMaxBackoff {
+		d = jobsMaxBackoff
+	}
+	return d/2 + time.Duration(mrand.Int63n(int64(d/2)+1))
+}
+
+// schedule requeues jobs of stopped workers and enqueues the periodic jobs
+func (j *jobs) schedule() {
+	defer j.workers.Done()
+
+	for j.wait(j.opts.PollInterval) {
+		ctx, cancel := context.WithTimeout(context.Background(), j.opts.Visibility)
+
+		n, err := j.requeue(ctx)
+		if err != nil {
+			j.log.Errorf("redis: can not requeue expired jobs: %v", err)
+		} else if n > 0 {
+			j.log.Warnf("redis: %d jobs exceeded the visibility timeout and are requeued", n)
+		}
+
+		j.mtx.Lock()
+		periodic := append([]*periodicJob(nil), j.periodic...)
+		j.mtx.Unlock()
+
+		now := time.Now()
+		for _, p := range periodic {
+			if now.Before(p.next) {
+				continue
+			}
+
+			// the tick is the unique key, so the instances enqueue it once
+			next := p.schedule.Next(now)
+			_, err := j.Enqueue(ctx, p.jobType, p.payload, &JobOptions{
+				UniqueKey: fmt.Sprintf("periodic:%s:%d", p.name, p.next.Unix()),
+				UniqueFor: next.Sub(now) + time.Minute,
+			})
+			if err != nil && !errors.Is(err, ErrDuplicateJob) {
+				j.log.Errorf("redis: can not enqueue periodic job %s: %v", p.name, err)
+				continue
+			}
+			p.next = next
+		}
+
+		cancel()
+	}
+}
+
+// requeue schedules the jobs of stopped workers whose visibility deadline passed
+func (j *jobs) requeue(ctx context.Context) (int, error) {
+	now := time.Now().UnixMilli()
+
+	ids, err := j.client.ZRangeByScore(ctx, j.key("inflight"), &redis.ZRangeBy{
+		Min:   "-inf",
+		Max:   strconv.FormatInt(now, 10),
+		Count: 100,
+	}).Result()
+	if err != nil || len(ids) == 0 {
+		return 0, err
+	}
+
+	// the job type decides the scheduled key the job goes back to
+	values, err := j.client.HMGet(ctx, j.key("jobs"), ids...).Result()
+	if err != nil {
+		return 0, err
+	}
+
+	var n int
+	for i, v := range values {
+		job := new(Job)
+		data, ok := v.(string)
+		if ok {
+			if err := json.Unmarshal([]byte(data), job); err != nil {
+				j.log.Errorf("redis: malformed job %s: %v", ids[i], err)
+				ok = false
+			}
+		}
+		if !ok {
+			// the job is gone or unreadable, it can not run again
+			if err := j.client.ZRem(ctx, j.key("inflight"), ids[i]).Err(); err != nil {
+				return n, err
+			}
+			continue
+		}
+
+		moved, err := requeueScript.Run(ctx, j.client, []string{j.key("inflight"), j.scheduledKey(job.Type)}, ids[i], now).Int()
+		if err != nil {
+			return n, err
+		}
+		n += moved
+	}
+	return n, nil
+}
+
+func flag(v bool) string {
+	if v {
+		return "1"
+	}
+	return "0"
+}
+
+func jobID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,336 @@
+/*
+Copyright [2014] - [2024] The Last.Backend authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package redis
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/lastbackend/toolkit/pkg/runtime/logger/empty"
+	"github.com/redis/go-redis/v9"
+)
+
+func newTestJobs(t *testing.T, opts jobsOptions) (*miniredis.Miniredis, *jobs) {
+	t.Helper()
+	s := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: s.Addr()})
+	t.Cleanup(func() { _ = client.Close() })
+
+	if opts.Visibility == 0 {
+		opts.Visibility = time.Minute
+	}
+	if opts.RetryBackoff == 0 {
+		opts.RetryBackoff = time.Second
+	}
+	if opts.DeadMax == 0 {
+		opts.DeadMax = 100
+	}
+	return s, newJobs(empty.NewLogger(), client, "svc", opts)
+}
+
+func TestJobsReserve(t *testing.T) {
+	ctx := context.Background()
+
+	type enqueued struct {
+		jobType string
+		delay   time.Duration
+	}
+
+	tests := []struct {
+		name     string
+		enqueue  []enqueued
+		handled  []string
+		wantType string
+	}{
+		{name: "due job", enqueue: []enqueued{{"email", 0}}, handled: []string{"email"}, wantType: "email"},
+		{name: "delayed job", enqueue: []enqueued{{"email", time.Hour}}, handled: []string{"email"}},
+		{name: "unhandled type", enqueue: []enqueued{{"sms", 0}}, handled: []string{"email"}},
+		{
+			name:     "earliest of the types",
+			enqueue:  []enqueued{{"email", -time.Second}, {"sms", -time.Minute}, {"push", -time.Hour}},
+			handled:  []string{"email", "sms"},
+			wantType: "sms",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, j := newTestJobs(t, jobsOptions{})
+			for _, jobType := range tt.handled {
+				j.Handle(jobType, func(context.Context, *Job) error { return nil })
+			}
+			for _, e := range tt.enqueue {
+				if _, err := j.Enqueue(ctx, e.jobType, []byte("{}"), &JobOptions{Delay: e.delay}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			job, err := j.reserve(j.handled())
+			if err != nil {
+				t.Fatal(err)
+			}
+			switch {
+			case tt.wantType == "" && job != nil:
+				t.Fatalf("reserved %s, want nothing", job.Type)
+			case tt.wantType != "" && (job == nil || job.Type != tt.wantType):
+				t.Fatalf("reserved %+v, want a job of %s", job, tt.wantType)
+			case job != nil && job.Attempt != 1:
+				t.Errorf("attempt: got %d, want 1", job.Attempt)
+			}
+		})
+	}
+}
+
+func TestJobsUniqueKey(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name string
+		opts JobOptions
+		// process handles the first job before the second is enqueued
+		process bool
+		wantErr error
+	}{
+		{name: "pending", opts: JobOptions{UniqueKey: "report"}, wantErr: ErrDuplicateJob},
+		{name: "released on success", opts: JobOptions{UniqueKey: "report"}, process: true},
+		{name: "kept for the duration", opts: JobOptions{UniqueKey: "report", UniqueFor: time.Hour}, process: true, wantErr: ErrDuplicateJob},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, j := newTestJobs(t, jobsOptions{})
+			j.Handle("report", func(context.Context, *Job) error { return nil })
+
+			first, err := j.Enqueue(ctx, "report", nil, &tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.process {
+				job, err := j.reserve(j.handled())
+				if err != nil || job == nil {
+					t.Fatalf("reserve: %v, %v", job, err)
+				}
+				j.process(ctx, job)
+			}
+
+			id, err := j.Enqueue(ctx, "report", nil, &tt.opts)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("error: got %v, want %v", err, tt.wantErr)
+			}
+			if err != nil && id != first {
+				t.Errorf("duplicate of %s, want %s", id, first)
+			}
+		})
+	}
+}
+
+func TestJobsProcess(t *testing.T) {
+	ctx := context.Background()
+	errFailed := errors.New("failed")
+
+	tests := []struct {
+		name       string
+		handler    JobHandler
+		maxRetries int
+		// attempts is the number of the processed attempts
+		attempts  int
+		wantState string
+	}{
+		{name: "success", handler: func(context.Context, *Job) error { return nil }, attempts: 1, wantState: "done"},
+		{name: "retry", handler: func(context.Context, *Job) error { return errFailed }, maxRetries: 2, attempts: 1, wantState: "scheduled"},
+		{name: "retries exhausted", handler: func(context.Context, *Job) error { return errFailed }, maxRetries: 1, attempts: 2, wantState: "dead"},
+		{name: "retries disabled", handler: func(context.Context, *Job) error { return errFailed }, maxRetries: -1, attempts: 1, wantState: "dead"},
+		{name: "panic", handler: func(context.Context, *Job) error { panic("boom") }, maxRetries: -1, attempts: 1, wantState: "dead"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, j := newTestJobs(t, jobsOptions{RetryBackoff: time.Millisecond})
+			j.Handle("email", tt.handler)
+
+			id, err := j.Enqueue(ctx, "email", nil, &JobOptions{MaxRetries: tt.maxRetries})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for i := 0; i < tt.attempts; i++ {
+				// the retries are scheduled with a backoff of up to a millisecond
+				time.Sleep(2 * time.Millisecond)
+				job, err := j.reserve(j.handled())
+				if err != nil || job == nil {
+					t.Fatalf("attempt %d: reserve %v, %v", i+1, job, err)
+				}
+				if job.Attempt != i+1 {
+					t.Fatalf("attempt: got %d, want %d", job.Attempt, i+1)
+				}
+				j.process(ctx, job)
+			}
+
+			if inflight, _ := s.ZMembers(j.key("inflight")); len(inflight) > 0 {
+				t.Errorf("jobs in flight after processing: %v", inflight)
+			}
+
+			state := "done"
+			if scheduled, _ := s.ZMembers(j.scheduledKey("email")); len(scheduled) > 0 {
+				state = "scheduled"
+			}
+			if dead, _ := s.ZMembers(j.key("dead")); len(dead) > 0 {
+				state = "dead"
+			}
+			if state != tt.wantState {
+				t.Fatalf("state: got %s, want %s", state, tt.wantState)
+			}
+
+			stored := s.HGet(j.key("jobs"), id) != ""
+			if stored != (tt.wantState != "done") {
+				t.Errorf("job stored: got %t in state %s", stored, state)
+			}
+		})
+	}
+}
+
+func TestJobsDead(t *testing.T) {
+	ctx := context.Background()
+	s, j := newTestJobs(t, jobsOptions{DeadMax: 2})
+	j.Handle("email", func(context.Context, *Job) error { return errors.New("failed") })
+
+	var ids []string
+	for i := 0; i < 3; i++ {
+		id, err := j.Enqueue(ctx, "email", nil, &JobOptions{MaxRetries: -1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+
+		job, err := j.reserve(j.handled())
+		if err != nil || job == nil {
+			t.Fatalf("reserve: %v, %v", job, err)
+		}
+		j.process(ctx, job)
+		// the dead jobs are ordered by the millisecond they died at
+		time.Sleep(2 * time.Millisecond)
+	}
+
+	dead, err := j.Dead(ctx, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dead) != 2 || dead[0].ID != ids[2] || dead[1].ID != ids[1] {
+		t.Fatalf("got %d dead jobs, want the last two of %v", len(dead), ids)
+	}
+	if dead[0].LastError != "failed" {
+		t.Errorf("last error: got %q, want failed", dead[0].LastError)
+	}
+	if s.HGet(j.key("jobs"), ids[0]) != "" {
+		t.Error("the dead job over the limit is kept")
+	}
+
+	if err := j.RetryDead(ctx, ids[2]); err != nil {
+		t.Fatal(err)
+	}
+	job, err := j.reserve(j.handled())
+	if err != nil || job == nil || job.ID != ids[2] {
+		t.Fatalf("reserved %+v, %v, want the retried job", job, err)
+	}
+	if job.Attempt != 1 {
+		t.Errorf("attempt: got %d, want 1", job.Attempt)
+	}
+
+	if err := j.RetryDead(ctx, "missing"); err == nil {
+		t.Error("got nil for a missing job, want an error")
+	}
+}
+
+func TestJobsRequeue(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name string
+		// deadline is the visibility deadline of the job in flight, relative to now
+		deadline time.Duration
+		// stored keeps the job data
+		stored        bool
+		want          int
+		wantScheduled bool
+	}{
+		{name: "expired", deadline: -time.Second, stored: true, want: 1, wantScheduled: true},
+		{name: "extended", deadline: time.Minute, stored: true},
+		{name: "without data", deadline: -time.Second},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, j := newTestJobs(t, jobsOptions{})
+			j.Handle("email", func(context.Context, *Job) error { return nil })
+
+			id, err := j.Enqueue(ctx, "email", nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := j.reserve(j.handled()); err != nil {
+				t.Fatal(err)
+			}
+
+			_, _ = s.ZAdd(j.key("inflight"), float64(time.Now().Add(tt.deadline).UnixMilli()), id)
+			if !tt.stored {
+				s.HDel(j.key("jobs"), id)
+			}
+
+			n, err := j.requeue(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != tt.want {
+				t.Errorf("requeued %d, want %d", n, tt.want)
+			}
+
+			scheduled, _ := s.ZMembers(j.scheduledKey("email"))
+			if (len(scheduled) > 0) != tt.wantScheduled {
+				t.Errorf("scheduled: got %v, want %t", scheduled, tt.wantScheduled)
+			}
+			inflight, _ := s.ZMembers(j.key("inflight"))
+			if wantInflight := tt.stored && !tt.wantScheduled; (len(inflight) > 0) != wantInflight {
+				t.Errorf("in flight: got %v, want %t", inflight, wantInflight)
+			}
+		})
+	}
+}
+
+func TestJobsBackoff(t *testing.T) {
+	_, j := newTestJobs(t, jobsOptions{RetryBackoff: time.Second})
+
+	tests := []struct {
+		attempt  int
+		min, max time.Duration
+	}{
+		{attempt: 1, min: 500 * time.Millisecond, max: time.Second},
+		{attempt: 3, min: 2 * time.Second, max: 4 * time.Second},
+		{attempt: 13, min: jobsMaxBackoff / 2, max: jobsMaxBackoff},
+		{attempt: 100, min: jobsMaxBackoff / 2, max: jobsMaxBackoff},
+	}
+
+	for _, tt := range tests {
+		for i := 0; i < 100; i++ {
+			if d := j.backoff(tt.attempt); d < tt.min || d > tt.max {
+				t.Fatalf("attempt %d: got %s, want between %s and %s", tt.attempt, d, tt.min, tt.max)
+			}
+		}
+	}
+}
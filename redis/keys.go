@@ -0,0 +1,500 @@
+/*
+Copyright [2014] - [2024] The Last.Backend authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package redis
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/redis/go-redis/v9"
+)
+
+type tenantKey struct{}
+
+// WithTenant returns a context whose commands are namespaced with the tenant, when key prefixing is enabled.
+// Tenants with braces are rejected, they would change the cluster slot of the keys.
+func WithTenant(ctx context.Context, tenant string) (context.Context, error) {
+	if strings.ContainsAny(tenant, "{}") {
+		return nil, fmt.Errorf("tenant %q must not contain braces", tenant)
+	}
+	return context.WithValue(ctx, tenantKey{}, tenant), nil
+}
+
+// TenantFromContext returns the tenant set with WithTenant
+func TenantFromContext(ctx context.Context) (string, bool) {
+	tenant, ok := ctx.Value(tenantKey{}).(string)
+	return tenant, ok && tenant != ""
+}
+
+// keySpec describes the positions of the keys in the command arguments, as reported by COMMAND INFO.
+// A negative last position counts from the end, -1 is the last argument.
+type keySpec struct {
+	first, last, step int
+	// numkeys is the position of the number of keys, they follow it, e.g. EVAL script numkeys key...
+	numkeys int
+	// fn finds the keys of commands with keywords, e.g. XREAD ... STREAMS key... id...
+	fn func(args []interface{}) []int
+}
+
+var (
+	singleKey = keySpec{first: 1, last: 1, step: 1}
+	allKeys   = keySpec{first: 1, last: -1, step: 1}
+	twoKeys   = keySpec{first: 1, last: 2, step: 1}
+	subKey    = keySpec{first: 2, last: 2, step: 1}
+)
+
+// keySpecs covers the commands with keys, other commands are sent unchanged
+var keySpecs = map[string]keySpec{
+	// strings
+	"get": singleKey, "set": singleKey, "setnx": singleKey, "setex": singleKey, "psetex": singleKey,
+	"append": singleKey, "strlen": singleKey, "incr": singleKey, "decr": singleKey, "incrby": singleKey,
+	"decrby": singleKey, "incrbyfloat": singleKey, "getset": singleKey, "getdel": singleKey, "getex": singleKey,
+	"getrange": singleKey, "setrange": singleKey, "substr": singleKey, "getbit": singleKey, "setbit": singleKey,
+	"bitcount": singleKey, "bitpos": singleKey, "bitfield": singleKey, "bitfield_ro": singleKey,
+	"mget": allKeys, "mset": {first: 1, last: -1, step: 2}, "msetnx": {first: 1, last: -1, step: 2},
+	"bitop": {first: 2, last: -1, step: 1}, "lcs": twoKeys,
+
+	// generic
+	"del": allKeys, "unlink": allKeys, "exists": allKeys, "touch": allKeys, "watch": allKeys,
+	"type": singleKey, "ttl": singleKey, "pttl": singleKey, "expire": singleKey, "pexpire": singleKey,
+	"expireat": singleKey, "pexpireat": singleKey, "expiretime": singleKey, "pexpiretime": singleKey,
+	"persist": singleKey, "dump": singleKey, "restore": singleKey,
+	"rename": twoKeys, "renamenx": twoKeys, "copy": twoKeys,
+	"object": subKey, "memory": subKey,
+	"sort": {fn: sortKeys}, "sort_ro": singleKey,
+
+	// hashes
+	"hset": singleKey, "hsetnx": singleKey, "hget": singleKey, "hmset": singleKey, "hmget": singleKey,
+	"hdel": singleKey, "hlen": singleKey, "hstrlen": singleKey, "hkeys": singleKey, "hvals": singleKey,
+	"hgetall": singleKey, "hexists": singleKey, "hincrby": singleKey, "hincrbyfloat": singleKey,
+	"hscan": singleKey, "hrandfield": singleKey,
+
+	// lists
+	"lpush": singleKey, "rpush": singleKey, "lpushx": singleKey, "rpushx": singleKey, "lpop": singleKey,
+	"rpop": singleKey, "llen": singleKey, "lindex": singleKey, "linsert": singleKey, "lset": singleKey,
+	"lrange": singleKey, "ltrim": singleKey, "lrem": singleKey, "lpos": singleKey,
+	"rpoplpush": twoKeys, "lmove": twoKeys, "brpoplpush": twoKeys, "blmove": twoKeys,
+	"blpop": {first: 1, last: -2, step: 1}, "brpop": {first: 1, last: -2, step: 1},
+	"lmpop": {numkeys: 1}, "blmpop": {numkeys: 2},
+
+	// sets
+	"sadd": singleKey, "srem": singleKey, "smembers": singleKey, "sismember": singleKey,
+	"smismember": singleKey, "scard": singleKey, "spop": singleKey, "srandmember": singleKey, "sscan": singleKey,
+	"sinter": allKeys, "sunion": allKeys, "sdiff": allKeys,
+	"sinterstore": allKeys, "sunionstore": allKeys, "sdiffstore": allKeys, "smove": twoKeys,
+	"sintercard": {numkeys: 1},
+
+	// sorted sets
+	"zadd": singleKey, "zincrby": singleKey, "zrem": singleKey, "zcard": singleKey, "zcount": singleKey,
+	"zlexcount": singleKey, "zscore": singleKey, "zmscore": singleKey, "zrank": singleKey,
+	"zrevrank": singleKey, "zrange": singleKey, "zrangebyscore": singleKey, "zrevrangebyscore": singleKey,
+	"zrangebylex": singleKey, "zrevrangebylex": singleKey, "zrevrange": singleKey,
+	"zremrangebyrank": singleKey, "zremrangebyscore": singleKey, "zremrangebylex": singleKey,
+	"zpopmin": singleKey, "zpopmax": singleKey, "zscan": singleKey, "zrandmember": singleKey,
+	"zrangestore": twoKeys,
+	"bzpopmin":    {first: 1, last: -2, step: 1}, "bzpopmax": {first: 1, last: -2, step: 1},
+	"zunion": {numkeys: 1}, "zinter": {numkeys: 1}, "zdiff": {numkeys: 1}, "zintercard": {numkeys: 1},
+	"zmpop": {numkeys: 1}, "bzmpop": {numkeys: 2},
+	"zunionstore": {first: 1, last: 1, step: 1, numkeys: 2}, "zinterstore": {first: 1, last: 1, step: 1, numkeys: 2},
+	"zdiffstore": {first: 1, last: 1, step: 1, numkeys: 2},
+
+	// hyperloglog and geo
+	"pfadd": singleKey, "pfcount": allKeys, "pfmerge": allKeys,
+	"geoadd": singleKey, "geodist": singleKey, "geohash": singleKey, "geopos": singleKey,
+	"geosearch": singleKey, "geosearchstore": twoKeys, "georadius_ro": singleKey,
+	"georadiusbymember_ro": singleKey, "georadius": {fn: sortKeys}, "georadiusbymember": {fn: sortKeys},
+
+	// streams
+	"xadd": singleKey, "xlen": singleKey, "xrange": singleKey, "xrevrange": singleKey, "xdel": singleKey,
+	"xtrim": singleKey, "xack": singleKey, "xclaim": singleKey, "xautoclaim": singleKey,
+	"xpending": singleKey, "xsetid": singleKey, "xinfo": subKey, "xgroup": subKey,
+	"xread": {fn: streamKeys}, "xreadgroup": {fn: streamKeys},
+
+	// scripts
+	"eval": {numkeys: 2}, "evalsha": {numkeys: 2}, "eval_ro": {numkeys: 2}, "evalsha_ro": {numkeys: 2},
+	"fcall": {numkeys: 2}, "fcall_ro": {numkeys: 2},
+}
+
+// positions returns the positions of the keys in the arguments
+func (s keySpec) positions(args []interface{}) []int {
+	if s.fn != nil {
+		return s.fn(args)
+	}
+
+	var pos []int
+
+	if s.first > 0 {
+		last := s.last
+		if last < 0 {
+			last = len(args) + last
+		}
+		for i := s.first; i <= last && i < len(args); i += s.step {
+			pos = append(pos, i)
+		}
+	}
+
+	if s.numkeys > 0 && s.numkeys < len(args) {
+		n, err := strconv.Atoi(fmt.Sprint(args[s.numkeys]))
+		if err == nil {
+			for i := s.numkeys + 1; i <= s.numkeys+n && i < len(args); i++ {
+				pos = append(pos, i)
+			}
+		}
+	}
+
+	return pos
+}
+
+// sortKeys finds the key and the STORE destination of SORT and GEORADIUS
+func sortKeys(args []interface{}) []int {
+	pos := []int{1}
+	for i := 2; i < len(args)-1; i++ {
+		switch strings.ToLower(fmt.Sprint(args[i])) {
+		case "store", "storedist":
+			pos = append(pos, i+1)
+		}
+	}
+	return pos
+}
+
+// streamKeys finds the streams of XREAD and XREADGROUP, they take the first half of the arguments after STREAMS
+func streamKeys(args []interface{}) []int {
+	for i := 1; i < len(args); i++ {
+		if strings.ToLower(fmt.Sprint(args[i])) != "streams" {
+			continue
+		}
+		n := (len(args) - i - 1) / 2
+		pos := make([]int, 0, n)
+		for j := i + 1; j <= i+n; j++ {
+			pos = append(pos, j)
+		}
+		return pos
+	}
+	return nil
+}
+
+// keyPrefix is a redis.Hook namespacing the keys of the commands as <prefix>:[<tenant>:]<key>.
+// The prefix goes before the key, so the hash tags of the keys keep selecting the cluster slot.
+// With slots, in cluster and ring mode, a key without a hash tag is wrapped in one, e.g.
+// <prefix>:{orders:42}, so it keeps the slot of the keys tagged with it, such as {orders:42}:fence.
+// A key in braces, e.g. {orders:42}, is then the same key as the key without them.
+// With hashTag the prefix is the hash tag instead, all keys of the prefix are in one slot.
+// RANDOMKEY picks from the whole database, a key of another namespace is returned unchanged.
+type keyPrefix struct {
+	prefix  string
+	hashTag bool
+	slots   bool
+}
+
+func newKeyPrefix(prefix string, hashTag, slots bool) (*keyPrefix, error) {
+	if prefix == "" {
+		return nil, fmt.Errorf("key prefix is empty")
+	}
+	if strings.ContainsAny(prefix, "{}") {
+		return nil, fmt.Errorf("key prefix %q must not contain braces, they would change the cluster slot of the keys", prefix)
+	}
+	return &keyPrefix{prefix: prefix, hashTag: hashTag, slots: slots}, nil
+}
+
+// wraps reports whether the keys without a hash tag are wrapped in one
+func (k *keyPrefix) wraps() bool {
+	return k.slots && !k.hashTag
+}
+
+// key namespaces the key
+func (k *keyPrefix) key(ns, key string) string {
+	// a key without a closing brace has no hash tag
+	if k.wraps() && key != "" && !strings.Contains(key, "}") {
+		return ns + "{" + key + "}"
+	}
+	return ns + key
+}
+
+// pattern namespaces the pattern of KEYS and SCAN. The wrapped and the tagged keys
+// can not be matched by one pattern, so with wrapping the server matches the whole
+// namespace and the replies are filtered with the pattern.
+func (k *keyPrefix) pattern(ns, pattern string) string {
+	if k.wraps() {
+		return ns + "*"
+	}
+	return ns + pattern
+}
+
+// unkey returns the key without the namespace, ok is false for the keys of other namespaces
+func (k *keyPrefix) unkey(ns, key string) (string, bool) {
+	key, ok := strings.CutPrefix(key, ns)
+	if !ok {
+		return key, false
+	}
+	if k.wraps() && len(key) > 2 && key[0] == '{' && strings.IndexByte(key, '}') == len(key)-1 {
+		return key[1 : len(key)-1], true
+	}
+	return key, true
+}
+
+// trim removes the namespace from a key of the reply
+func (k *keyPrefix) trim(ns, key string) string {
+	key, _ = k.unkey(ns, key)
+	return key
+}
+
+// namespace returns the prefix of the keys of the context
+func (k *keyPrefix) namespace(ctx context.Context) string {
+	ns := k.prefix
+	if tenant, ok := TenantFromContext(ctx); ok {
+		ns += ":" + tenant
+	}
+	if k.hashTag {
+		return "{" + ns + "}:"
+	}
+	return ns + ":"
+}
+
+func (k *keyPrefix) DialHook(next redis.DialHook) redis.DialHook {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return next(ctx, network, addr)
+	}
+}
+
+func (k *keyPrefix) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		ns := k.namespace(ctx)
+		pattern := k.rewrite(ns, cmd)
+		err := next(ctx, cmd)
+		k.strip(ns, pattern, cmd)
+		return err
+	}
+}
+
+func (k *keyPrefix) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		ns := k.namespace(ctx)
+		patterns := make([]string, len(cmds))
+		for i, cmd := range cmds {
+			patterns[i] = k.rewrite(ns, cmd)
+		}
+		err := next(ctx, cmds)
+		for i, cmd := range cmds {
+			k.strip(ns, patterns[i], cmd)
+		}
+		return err
+	}
+}
+
+// rewrite prefixes the keys in place, the arguments slice is owned by the command.
+// It returns the original pattern of KEYS and SCAN, the reply is filtered with it.
+func (k *keyPrefix) rewrite(ns string, cmd redis.Cmder) string {
+	args := cmd.Args()
+	if len(args) == 0 {
+		return ""
+	}
+
+	name := strings.ToLower(fmt.Sprint(args[0]))
+
+	switch name {
+	case "scan":
+		// SCAN is limited to the namespace with MATCH, the other keys are filtered from the reply
+		pattern := "*"
+		for i := 1; i < len(args)-1; i++ {
+			if strings.ToLower(fmt.Sprint(args[i])) == "match" {
+				pattern = fmt.Sprint(args[i+1])
+				args[i+1] = k.pattern(ns, pattern)
+			}
+		}
+		return pattern
+	case "keys":
+		if len(args) < 2 {
+			return ""
+		}
+		pattern := fmt.Sprint(args[1])
+		args[1] = k.pattern(ns, pattern)
+		return pattern
+	}
+
+	spec, ok := keySpecs[name]
+	if !ok {
+		return ""
+	}
+
+	for _, i := range spec.positions(args) {
+		switch v := args[i].(type) {
+		case string:
+			args[i] = k.key(ns, v)
+		case []byte:
+			args[i] = k.key(ns, string(v))
+		default:
+			args[i] = k.key(ns, fmt.Sprint(v))
+		}
+	}
+	return ""
+}
+
+// strip removes the prefix from the keys in the replies
+func (k *keyPrefix) strip(ns, pattern string, cmd redis.Cmder) {
+	if cmd.Err() != nil {
+		return
+	}
+
+	switch c := cmd.(type) {
+	case *redis.ScanCmd:
+		if cmd.Name() != "scan" {
+			return
+		}
+		keys, cursor := c.Val()
+		c.SetVal(k.match(ns, pattern, keys), cursor)
+	case *redis.StringCmd:
+		if cmd.Name() == "randomkey" {
+			c.SetVal(k.trim(ns, c.Val()))
+		}
+	case *redis.StringSliceCmd:
+		switch cmd.Name() {
+		case "keys":
+			c.SetVal(k.match(ns, pattern, c.Val()))
+		case "blpop", "brpop":
+			if v := c.Val(); len(v) > 0 {
+				v[0] = k.trim(ns, v[0])
+			}
+		}
+	case *redis.ZWithKeyCmd:
+		if v := c.Val(); v != nil {
+			v.Key = k.trim(ns, v.Key)
+		}
+	case *redis.KeyValuesCmd:
+		key, values := c.Val()
+		c.SetVal(k.trim(ns, key), values)
+	case *redis.ZSliceWithKeyCmd:
+		key, values := c.Val()
+		c.SetVal(k.trim(ns, key), values)
+	case *redis.XStreamSliceCmd:
+		streams := c.Val()
+		for i := range streams {
+			streams[i].Stream = k.trim(ns, streams[i].Stream)
+		}
+	}
+}
+
+// match returns the keys of the namespace matching the pattern, without the namespace
+func (k *keyPrefix) match(ns, pattern string, keys []string) []string {
+	own := keys[:0]
+	for _, key := range keys {
+		if key, ok := k.unkey(ns, key); ok && (!k.wraps() || globMatch(pattern, key)) {
+			own = append(own, key)
+		}
+	}
+	return own
+}
+
+// globMatch reports whether the key matches the glob-style pattern of KEYS and SCAN:
+// * and ? wildcards, [abc], [^abc] and [a-z] classes and \ escapes
+func globMatch(pattern, key string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 1 && pattern[1] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 1 {
+				return true
+			}
+			for i := 0; i <= len(key); i++ {
+				if globMatch(pattern[1:], key[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(key) == 0 {
+				return false
+			}
+			key = key[1:]
+			pattern = pattern[1:]
+		case '[':
+			if len(key) == 0 {
+				return false
+			}
+			end := classEnd(pattern)
+			if end < 0 {
+				// an unclosed class is matched literally
+				if key[0] != '[' {
+					return false
+				}
+				key, pattern = key[1:], pattern[1:]
+				continue
+			}
+			class := pattern[1:end]
+			negate := len(class) > 0 && class[0] == '^'
+			if negate {
+				class = class[1:]
+			}
+			if classMatch(class, key[0]) == negate {
+				return false
+			}
+			key, pattern = key[1:], pattern[end+1:]
+		case '\\':
+			if len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if len(key) == 0 || key[0] != pattern[0] {
+				return false
+			}
+			key, pattern = key[1:], pattern[1:]
+		}
+	}
+	return len(key) == 0
+}
+
+// classEnd returns the position of the bracket closing the class at the start of the pattern, skipping escaped brackets
+func classEnd(pattern string) int {
+	for i := 1; i < len(pattern); i++ {
+		switch pattern[i] {
+		case '\\':
+			i++
+		case ']':
+			return i
+		}
+	}
+	return -1
+}
+
+func classMatch(class string, c byte) bool {
+	for i := 0; i < len(class); i++ {
+		switch {
+		case class[i] == '\\' && i+1 < len(class):
+			i++
+			if class[i] == c {
+				return true
+			}
+		case i+2 < len(class) && class[i+1] == '-':
+			lo, hi := class[i], class[i+2]
+			if lo > hi {
+				lo, hi = hi, lo
+			}
+			if c >= lo && c <= hi {
+				return true
+			}
+			i += 2
+		case class[i] == c:
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,346 @@
+/*
+Copyright [2014] - [2024] The Last.Backend authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package redis
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestKeySpecPositions(t *testing.T) {
+	tests := []struct {
+		name string
+		args []interface{}
+		want []int
+	}{
+		{name: "get", args: []interface{}{"get", "a"}, want: []int{1}},
+		{name: "del", args: []interface{}{"del", "a", "b", "c"}, want: []int{1, 2, 3}},
+		{name: "mset", args: []interface{}{"mset", "a", "1", "b", "2"}, want: []int{1, 3}},
+		{name: "bitop", args: []interface{}{"bitop", "and", "dst", "a", "b"}, want: []int{2, 3, 4}},
+		{name: "rename", args: []interface{}{"rename", "a", "b"}, want: []int{1, 2}},
+		{name: "object", args: []interface{}{"object", "encoding", "a"}, want: []int{2}},
+		{name: "blpop", args: []interface{}{"blpop", "a", "b", 0}, want: []int{1, 2}},
+		{name: "lmpop", args: []interface{}{"lmpop", 2, "a", "b", "left"}, want: []int{2, 3}},
+		{name: "eval", args: []interface{}{"eval", "return 1", 2, "a", "b", "arg"}, want: []int{3, 4}},
+		{name: "eval without keys", args: []interface{}{"eval", "return 1", 0, "arg"}},
+		{name: "eval with too few arguments", args: []interface{}{"eval", "return 1", 3, "a"}, want: []int{3}},
+		{name: "zunionstore", args: []interface{}{"zunionstore", "dst", 2, "a", "b", "weights", 1, 2}, want: []int{1, 3, 4}},
+		{name: "sort", args: []interface{}{"sort", "a", "limit", 0, 10}, want: []int{1}},
+		{name: "sort store", args: []interface{}{"sort", "a", "by", "w_*", "store", "dst"}, want: []int{1, 5}},
+		{name: "georadius storedist", args: []interface{}{"georadius", "a", 0, 0, 1, "km", "storedist", "dst"}, want: []int{1, 7}},
+		{name: "xread", args: []interface{}{"xread", "count", 1, "streams", "a", "b", "0", "0"}, want: []int{4, 5}},
+		{name: "xreadgroup", args: []interface{}{"xreadgroup", "group", "g", "c", "streams", "a", ">"}, want: []int{5}},
+		{name: "xread without streams", args: []interface{}{"xread", "count", 1}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spec, ok := keySpecs[tt.args[0].(string)]
+			if !ok {
+				t.Fatalf("no key spec of %s", tt.args[0])
+			}
+			if got := spec.positions(tt.args); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestKeySpecsNoPatterns(t *testing.T) {
+	// KEYS and SCAN take patterns, they are rewritten apart from the keys
+	for _, name := range []string{"keys", "scan"} {
+		if _, ok := keySpecs[name]; ok {
+			t.Errorf("%s has a key spec", name)
+		}
+	}
+}
+
+func TestGlobMatch(t *testing.T) {
+	tests := []struct {
+		pattern, key string
+		want         bool
+	}{
+		{pattern: "*", key: "", want: true},
+		{pattern: "*", key: "orders:42", want: true},
+		{pattern: "orders:*", key: "orders:42", want: true},
+		{pattern: "orders:*", key: "users:42", want: false},
+		{pattern: "*:42", key: "orders:42", want: true},
+		{pattern: "o**s:*2", key: "orders:42", want: true},
+		{pattern: "orders:??", key: "orders:42", want: true},
+		{pattern: "orders:?", key: "orders:42", want: false},
+		{pattern: "orders:[0-9]2", key: "orders:42", want: true},
+		{pattern: "orders:[9-0]2", key: "orders:42", want: true},
+		{pattern: "orders:[^0-9]2", key: "orders:42", want: false},
+		{pattern: "orders:[123]2", key: "orders:42", want: false},
+		{pattern: "orders:[\\]]", key: "orders:]", want: true},
+		{pattern: "orders:\\*", key: "orders:*", want: true},
+		{pattern: "orders:\\*", key: "orders:42", want: false},
+		{pattern: "orders:[4", key: "orders:[4", want: true},
+		{pattern: "orders", key: "orders:42", want: false},
+		{pattern: "orders:42:*", key: "orders:42", want: false},
+	}
+
+	for _, tt := range tests {
+		if got := globMatch(tt.pattern, tt.key); got != tt.want {
+			t.Errorf("%q on %q: got %t, want %t", tt.pattern, tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestKeyPrefixKey(t *testing.T) {
+	tests := []struct {
+		name           string
+		hashTag, slots bool
+		tenant         string
+		key            string
+		want           string
+	}{
+		{name: "plain", key: "orders:42", want: "svc:orders:42"},
+		{name: "tenant", tenant: "acme", key: "orders:42", want: "svc:acme:orders:42"},
+		{name: "hash tag", hashTag: true, key: "orders:42", want: "{svc}:orders:42"},
+		{name: "hash tag and slots", hashTag: true, slots: true, key: "orders:42", want: "{svc}:orders:42"},
+		{name: "hash tag with tenant", hashTag: true, tenant: "acme", key: "a", want: "{svc:acme}:a"},
+		{name: "wrapped", slots: true, key: "orders:42", want: "svc:{orders:42}"},
+		{name: "tagged", slots: true, key: "{orders:42}:fence", want: "svc:{orders:42}:fence"},
+		{name: "braced", slots: true, key: "{orders:42}", want: "svc:{orders:42}"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			k, err := newKeyPrefix("svc", tt.hashTag, tt.slots)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctx := context.Background()
+			if tt.tenant != "" {
+				if ctx, err = WithTenant(ctx, tt.tenant); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			ns := k.namespace(ctx)
+			got := k.key(ns, tt.key)
+			if got != tt.want {
+				t.Fatalf("got %s, want %s", got, tt.want)
+			}
+
+			key, ok := k.unkey(ns, got)
+			if want := tt.key; !ok || (key != want && "{"+key+"}" != want) {
+				t.Errorf("unkey: got %s, %t, want %s", key, ok, want)
+			}
+			if _, ok := k.unkey(ns, "other:"+tt.key); ok {
+				t.Error("unkey: a key of another namespace is matched")
+			}
+		})
+	}
+}
+
+func TestKeyPrefixInvalid(t *testing.T) {
+	if _, err := newKeyPrefix("", false, false); err == nil {
+		t.Error("got nil for an empty prefix, want an error")
+	}
+	if _, err := newKeyPrefix("{svc}", false, false); err == nil {
+		t.Error("got nil for a prefix with braces, want an error")
+	}
+	if _, err := WithTenant(context.Background(), "a{b}"); err == nil {
+		t.Error("got nil for a tenant with braces, want an error")
+	}
+}
+
+func newPrefixedClient(t *testing.T, hashTag, slots bool) (*miniredis.Miniredis, *redis.Client) {
+	t.Helper()
+	s := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: s.Addr()})
+	t.Cleanup(func() { _ = client.Close() })
+
+	k, err := newKeyPrefix("svc", hashTag, slots)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.AddHook(k)
+	return s, client
+}
+
+func TestKeyPrefixCommands(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name           string
+		hashTag, slots bool
+		wantKeys       []string
+	}{
+		{name: "plain", wantKeys: []string{"svc:a", "svc:b", "svc:list", "svc:{orders:42}:fence"}},
+		{name: "hash tag", hashTag: true, wantKeys: []string{"{svc}:a", "{svc}:b", "{svc}:list", "{svc}:{orders:42}:fence"}},
+		{name: "wrapped", slots: true, wantKeys: []string{"svc:{a}", "svc:{b}", "svc:{list}", "svc:{orders:42}:fence"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, client := newPrefixedClient(t, tt.hashTag, tt.slots)
+
+			if err := client.MSet(ctx, "a", "1", "b", "2").Err(); err != nil {
+				t.Fatal(err)
+			}
+			if err := client.RPush(ctx, "list", "x").Err(); err != nil {
+				t.Fatal(err)
+			}
+			if err := client.Set(ctx, "{orders:42}:fence", "1", 0).Err(); err != nil {
+				t.Fatal(err)
+			}
+
+			keys := s.Keys()
+			sort.Strings(keys)
+			if !reflect.DeepEqual(keys, tt.wantKeys) {
+				t.Fatalf("stored keys: got %v, want %v", keys, tt.wantKeys)
+			}
+
+			vals, err := client.MGet(ctx, "a", "b").Result()
+			if err != nil || !reflect.DeepEqual(vals, []interface{}{"1", "2"}) {
+				t.Errorf("mget: got %v, %v", vals, err)
+			}
+
+			n, err := client.Eval(ctx, "return redis.call('GET', KEYS[1])", []string{"b"}).Text()
+			if err != nil || n != "2" {
+				t.Errorf("eval: got %s, %v, want 2", n, err)
+			}
+
+			pop, err := client.BLPop(ctx, 0, "list").Result()
+			if err != nil || !reflect.DeepEqual(pop, []string{"list", "x"}) {
+				t.Errorf("blpop: got %v, %v", pop, err)
+			}
+		})
+	}
+}
+
+func TestKeyPrefixPatterns(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name           string
+		hashTag, slots bool
+		pattern        string
+		want           []string
+	}{
+		{name: "all", pattern: "*", want: []string{"orders:1", "orders:2", "users:1"}},
+		{name: "pattern", pattern: "orders:*", want: []string{"orders:1", "orders:2"}},
+		{name: "hash tag", hashTag: true, pattern: "orders:*", want: []string{"orders:1", "orders:2"}},
+		{name: "wrapped", slots: true, pattern: "orders:*", want: []string{"orders:1", "orders:2"}},
+		{name: "wrapped class", slots: true, pattern: "*:[2-9]", want: []string{"orders:2"}},
+		{name: "wrapped and tagged", slots: true, pattern: "{users:1}*", want: []string{"{users:1}:fence"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, client := newPrefixedClient(t, tt.hashTag, tt.slots)
+
+			for _, key := range []string{"orders:1", "orders:2", "users:1"} {
+				if err := client.Set(ctx, key, "1", 0).Err(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.slots {
+				if err := client.Set(ctx, "{users:1}:fence", "1", 0).Err(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// a key of another namespace is never returned
+			_ = s.Set("other:orders:3", "1")
+
+			keys, err := client.Keys(ctx, tt.pattern).Result()
+			if err != nil {
+				t.Fatal(err)
+			}
+			sort.Strings(keys)
+			if !reflect.DeepEqual(keys, tt.want) {
+				t.Errorf("keys: got %v, want %v", keys, tt.want)
+			}
+
+			var scanned []string
+			iter := client.Scan(ctx, 0, tt.pattern, 10).Iterator()
+			for iter.Next(ctx) {
+				scanned = append(scanned, iter.Val())
+			}
+			if err := iter.Err(); err != nil {
+				t.Fatal(err)
+			}
+			sort.Strings(scanned)
+			if !reflect.DeepEqual(scanned, tt.want) {
+				t.Errorf("scan: got %v, want %v", scanned, tt.want)
+			}
+		})
+	}
+}
+
+func TestKeyPrefixRandomKey(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name  string
+		slots bool
+		key   string
+	}{
+		{name: "plain", key: "orders:1"},
+		{name: "wrapped", slots: true, key: "orders:1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, client := newPrefixedClient(t, false, tt.slots)
+			if err := client.Set(ctx, tt.key, "1", 0).Err(); err != nil {
+				t.Fatal(err)
+			}
+
+			key, err := client.RandomKey(ctx).Result()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if key != tt.key {
+				t.Errorf("got %s, want %s", key, tt.key)
+			}
+		})
+	}
+}
+
+func TestKeyPrefixPipeline(t *testing.T) {
+	ctx := context.Background()
+	_, client := newPrefixedClient(t, false, true)
+
+	var keys *redis.StringSliceCmd
+	var get *redis.StringCmd
+	_, err := client.Pipelined(ctx, func(p redis.Pipeliner) error {
+		p.Set(ctx, "orders:1", "1", 0)
+		p.Set(ctx, "users:1", "2", 0)
+		keys = p.Keys(ctx, "orders:*")
+		get = p.Get(ctx, "users:1")
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := keys.Val(); !reflect.DeepEqual(got, []string{"orders:1"}) {
+		t.Errorf("keys: got %v, want [orders:1]", got)
+	}
+	if got := get.Val(); got != "2" {
+		t.Errorf("get: got %s, want 2", got)
+	}
+}
@@ -0,0 +1,404 @@
+/*
+Copyright [2014] - [2024] The Last.Backend authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package lock implements distributed locks on top of the redis plugin client.
+//
+//	l, err := lock.New(redisPlugin.Client()).Obtain(ctx, "orders:42", 10*time.Second, &lock.Options{
+//		RetryStrategy: lock.LimitRetry(lock.LinearBackoff(100*time.Millisecond), 10),
+//		AutoExtend:    true,
+//	})
+//	if err != nil {
+//		return err
+//	}
+//	defer l.Release(context.Background())
+//
+// Every obtained lock carries a fencing token, which increases on every obtain
+// of the same key. Storages guarded by the lock should reject writes with a token
+// lower than the last one they have seen, so a holder paused past its ttl can not
+// overwrite the changes of the next holder.
+package lock
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+var (
+	// ErrNotObtained is returned when the lock is held by someone else and the retries are exhausted
+	ErrNotObtained = errors.New("lock: not obtained")
+	// ErrNotHeld is returned when the lock has expired or is held by someone else
+	ErrNotHeld = errors.New("lock: not held")
+)
+
+var (
+	obtainScript = redis.NewScript(`
+if redis.call("set", KEYS[1], ARGV[1], "NX", "PX", ARGV[2]) then
+	return redis.call("incr", KEYS[2])
+end
+return 0`)
+
+	refreshScript = redis.NewScript(`
+if redis.call("get", KEYS[1]) == ARGV[1] then
+	return redis.call("pexpire", KEYS[1], ARGV[2])
+end
+return 0`)
+
+	releaseScript = redis.NewScript(`
+if redis.call("get", KEYS[1]) == ARGV[1] then
+	return redis.call("del", KEYS[1])
+end
+return 0`)
+
+	ttlScript = redis.NewScript(`
+if redis.call("get", KEYS[1]) == ARGV[1] then
+	return redis.call("pttl", KEYS[1])
+end
+return 0`)
+)
+
+type Options struct {
+	// RetryStrategy is used while the lock is held by someone else, default is NoRetry.
+	// Strategies count attempts, so every Obtain needs its own.
+	RetryStrategy RetryStrategy
+	// AutoExtend refreshes the lock in background every third of its ttl until it is released.
+	// Lost is closed when the lock can not be refreshed anymore.
+	AutoExtend bool
+}
+
+// Locker obtains locks on one redis instance, or on several independent instances with Redlock
+type Locker struct {
+	clients []redis.UniversalClient
+	quorum  int
+}
+
+// New returns a Locker on a single instance, cluster or ring
+func New(client redis.UniversalClient) *Locker {
+	return &Locker{clients: []redis.UniversalClient{client}, quorum: 1}
+}
+
+// NewRedlock returns a Locker implementing the Redlock algorithm: a lock is held when it is
+// obtained on the majority of the independent instances within its ttl.
+func NewRedlock(clients ...redis.UniversalClient) *Locker {
+	return &Locker{clients: clients, quorum: len(clients)/2 + 1}
+}
+
+// Obtain is a shortcut for New(client).Obtain
+func Obtain(ctx context.Context, client redis.UniversalClient, key string, ttl time.Duration, opts *Options) (*Lock, error) {
+	return New(client).Obtain(ctx, key, ttl, opts)
+}
+
+// Obtain tries to obtain the lock for the ttl, retrying with the retry strategy
+func (l *Locker) Obtain(ctx context.Context, key string, ttl time.Duration, opts *Options) (*Lock, error) {
+	if ttl < time.Millisecond {
+		return nil, errors.New("lock: ttl must be at least a millisecond")
+	}
+	if len(l.clients) == 0 {
+		return nil, errors.New("lock: no redis clients")
+	}
+	if opts == nil {
+		opts = new(Options)
+	}
+
+	retry := opts.RetryStrategy
+	if retry == nil {
+		retry = NoRetry()
+	}
+
+	value, err := randomValue()
+	if err != nil {
+		return nil, err
+	}
+
+	lock := &Lock{
+		locker: l,
+		key:    key,
+		value:  value,
+		ttl:    ttl,
+		stop:   make(chan struct{}),
+		lost:   make(chan struct{}),
+	}
+
+	var timer *time.Timer
+	for {
+		ok, err := lock.obtain(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			break
+		}
+
+		backoff := retry.NextBackoff()
+		if backoff <= 0 {
+			return nil, ErrNotObtained
+		}
+
+		if timer == nil {
+			timer = time.NewTimer(backoff)
+			defer timer.Stop()
+		} else {
+			timer.Reset(backoff)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+
+	if opts.AutoExtend {
+		lock.wg.Add(1)
+		go lock.extend()
+	}
+
+	return lock, nil
+}
+
+type reply struct {
+	n   int64
+	err error
+}
+
+// eval runs the script on every instance in parallel
+func (l *Locker) eval(ctx context.Context, script *redis.Script, keys []string, args ...interface{}) []reply {
+	replies := make([]reply, len(l.clients))
+
+	var wg sync.WaitGroup
+	for i, c := range l.clients {
+		wg.Add(1)
+		go func(i int, c redis.UniversalClient) {
+			defer wg.Done()
+			n, err := script.Run(ctx, c, keys, args...).Int64()
+			replies[i] = reply{n: n, err: err}
+		}(i, c)
+	}
+	wg.Wait()
+
+	return replies
+}
+
+// count returns the number of instances answered with a positive value,
+// the error is set when the failed instances make the quorum unreachable
+func (l *Locker) count(replies []reply) (int, error) {
+	var n, failed int
+	var err error
+	for _, r := range replies {
+		switch {
+		case r.err != nil:
+			failed++
+			err = r.err
+		case r.n > 0:
+			n++
+		}
+	}
+	if failed > len(l.clients)-l.quorum {
+		return n, err
+	}
+	return n, nil
+}
+
+type Lock struct {
+	locker *Locker
+	key    string
+	value  string
+	token  int64
+
+	mtx sync.Mutex
+	ttl time.Duration
+
+	stop     chan struct{}
+	stopOnce sync.Once
+	lost     chan struct{}
+	lostOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+// Key returns the locked key
+func (l *Lock) Key() string {
+	return l.key
+}
+
+// Token returns the fencing token of the lock
+func (l *Lock) Token() int64 {
+	return l.token
+}
+
+// Lost is closed when the automatic extension fails to refresh the lock
+func (l *Lock) Lost() <-chan struct{} {
+	return l.lost
+}
+
+func (l *Lock) obtain(ctx context.Context) (bool, error) {
+	start := time.Now()
+
+	replies := l.locker.eval(ctx, obtainScript, []string{l.key, fenceKey(l.key)}, l.value, l.ttl.Milliseconds())
+
+	var token int64
+	for _, r := range replies {
+		if r.err == nil && r.n > token {
+			// every majority includes an instance which has counted the previous holder,
+			// so the highest counter is higher than the token of the previous holder
+			token = r.n
+		}
+	}
+
+	n, err := l.locker.count(replies)
+
+	valid := true
+	if len(l.locker.clients) > 1 {
+		// the lock has to be valid for a while after the clocks of the instances drifted apart
+		drift := l.ttl/100 + 2*time.Millisecond
+		valid = time.Since(start)+drift < l.ttl
+	}
+
+	if n >= l.locker.quorum && valid {
+		l.token = token
+		return true, nil
+	}
+
+	if n > 0 {
+		// release the instances locked without reaching the quorum
+		rctx, cancel := context.WithTimeout(context.Background(), l.ttl)
+		l.locker.eval(rctx, releaseScript, []string{l.key}, l.value)
+		cancel()
+	}
+
+	return false, err
+}
+
+// Refresh extends the lock to the ttl
+func (l *Lock) Refresh(ctx context.Context, ttl time.Duration) error {
+	if ttl < time.Millisecond {
+		return errors.New("lock: ttl must be at least a millisecond")
+	}
+
+	n, err := l.locker.count(l.locker.eval(ctx, refreshScript, []string{l.key}, l.value, ttl.Milliseconds()))
+	if err != nil {
+		return err
+	}
+	if n < l.locker.quorum {
+		return ErrNotHeld
+	}
+
+	l.mtx.Lock()
+	l.ttl = ttl
+	l.mtx.Unlock()
+	return nil
+}
+
+// TTL returns the remaining time of the lock
+func (l *Lock) TTL(ctx context.Context) (time.Duration, error) {
+	replies := l.locker.eval(ctx, ttlScript, []string{l.key}, l.value)
+
+	n, err := l.locker.count(replies)
+	if err != nil {
+		return 0, err
+	}
+	if n < l.locker.quorum {
+		return 0, ErrNotHeld
+	}
+
+	var ttl int64
+	for _, r := range replies {
+		if r.err == nil && r.n > 0 && (ttl == 0 || r.n < ttl) {
+			ttl = r.n
+		}
+	}
+	return time.Duration(ttl) * time.Millisecond, nil
+}
+
+// Release stops the automatic extension and releases the lock
+func (l *Lock) Release(ctx context.Context) error {
+	l.stopOnce.Do(func() { close(l.stop) })
+	l.wg.Wait()
+
+	n, err := l.locker.count(l.locker.eval(ctx, releaseScript, []string{l.key}, l.value))
+	if err != nil {
+		return err
+	}
+	if n < l.locker.quorum {
+		return ErrNotHeld
+	}
+	return nil
+}
+
+// extend refreshes the lock until it is released. Failed refreshes are retried
+// until the lock expires, the lock is lost when it is held by someone else.
+func (l *Lock) extend() {
+	defer l.wg.Done()
+
+	l.mtx.Lock()
+	ttl := l.ttl
+	l.mtx.Unlock()
+
+	expires := time.Now().Add(ttl)
+	timer := time.NewTimer(ttl / 3)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-timer.C:
+		}
+
+		l.mtx.Lock()
+		ttl = l.ttl
+		l.mtx.Unlock()
+
+		start := time.Now()
+		ctx, cancel := context.WithTimeout(context.Background(), ttl/3)
+		err := l.Refresh(ctx, ttl)
+		cancel()
+
+		switch {
+		case err == nil:
+			expires = start.Add(ttl)
+		case errors.Is(err, ErrNotHeld) || time.Now().After(expires):
+			l.lostOnce.Do(func() { close(l.lost) })
+			return
+		}
+
+		timer.Reset(ttl / 3)
+	}
+}
+
+// fenceKey returns the key of the fencing counter, in the hash slot of the lock key
+// to be updated by the same script in cluster mode. The counter never expires.
+func fenceKey(key string) string {
+	if s := strings.IndexByte(key, '{'); s > -1 {
+		if e := strings.IndexByte(key[s+1:], '}'); e > 0 {
+			return key + ":fence"
+		}
+	}
+	return "{" + key + "}:fence"
+}
+
+func randomValue() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
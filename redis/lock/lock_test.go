@@ -0,0 +1,292 @@
+/*
+Copyright [2014] - [2024] The Last.Backend authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lock
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func newClient(t *testing.T) (*miniredis.Miniredis, redis.UniversalClient) {
+	t.Helper()
+	s := miniredis.RunT(t)
+	c := redis.NewClient(&redis.Options{Addr: s.Addr()})
+	t.Cleanup(func() { _ = c.Close() })
+	return s, c
+}
+
+func TestObtain(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name string
+		// held is obtained before the tested lock, on the key when set
+		held    string
+		key     string
+		opts    *Options
+		wantErr error
+	}{
+		{name: "free", key: "orders:42"},
+		{name: "held", held: "orders:42", key: "orders:42", wantErr: ErrNotObtained},
+		{name: "held with retries", held: "orders:42", key: "orders:42", opts: &Options{RetryStrategy: LimitRetry(LinearBackoff(time.Millisecond), 3)}, wantErr: ErrNotObtained},
+		{name: "other key", held: "orders:41", key: "orders:42"},
+		{name: "tagged key", held: "{orders}:41", key: "{orders}:42"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, c := newClient(t)
+
+			if tt.held != "" {
+				if _, err := Obtain(ctx, c, tt.held, time.Minute, nil); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			l, err := Obtain(ctx, c, tt.key, time.Minute, tt.opts)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("error: got %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && l.Token() < 1 {
+				t.Errorf("token: got %d, want a positive token", l.Token())
+			}
+		})
+	}
+}
+
+func TestObtainInvalidTTL(t *testing.T) {
+	_, c := newClient(t)
+	if _, err := Obtain(context.Background(), c, "orders:42", time.Microsecond, nil); err == nil {
+		t.Error("got nil, want an error for a ttl under a millisecond")
+	}
+}
+
+func TestFencingToken(t *testing.T) {
+	ctx := context.Background()
+	_, c := newClient(t)
+
+	var last int64
+	for i := 0; i < 3; i++ {
+		l, err := Obtain(ctx, c, "orders:42", time.Minute, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if l.Token() <= last {
+			t.Fatalf("token %d after %d, want it to grow", l.Token(), last)
+		}
+		last = l.Token()
+		if err := l.Release(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestLockOperations(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name string
+		// before runs on the server after the lock is obtained
+		before  func(s *miniredis.Miniredis)
+		op      func(l *Lock) error
+		wantErr error
+	}{
+		{name: "release", op: func(l *Lock) error { return l.Release(ctx) }},
+		{name: "refresh", op: func(l *Lock) error { return l.Refresh(ctx, time.Hour) }},
+		{
+			name: "ttl",
+			op: func(l *Lock) error {
+				ttl, err := l.TTL(ctx)
+				if err == nil && (ttl <= 0 || ttl > time.Minute) {
+					return errors.New("ttl out of range")
+				}
+				return err
+			},
+		},
+		{
+			name:    "release expired",
+			before:  func(s *miniredis.Miniredis) { s.FastForward(2 * time.Minute) },
+			op:      func(l *Lock) error { return l.Release(ctx) },
+			wantErr: ErrNotHeld,
+		},
+		{
+			name:    "refresh expired",
+			before:  func(s *miniredis.Miniredis) { s.FastForward(2 * time.Minute) },
+			op:      func(l *Lock) error { return l.Refresh(ctx, time.Minute) },
+			wantErr: ErrNotHeld,
+		},
+		{
+			name:    "release taken over",
+			before:  func(s *miniredis.Miniredis) { _ = s.Set("orders:42", "other") },
+			op:      func(l *Lock) error { return l.Release(ctx) },
+			wantErr: ErrNotHeld,
+		},
+		{
+			name:    "ttl taken over",
+			before:  func(s *miniredis.Miniredis) { _ = s.Set("orders:42", "other") },
+			op:      func(l *Lock) error { _, err := l.TTL(ctx); return err },
+			wantErr: ErrNotHeld,
+		},
+		{
+			name:    "invalid refresh ttl",
+			op:      func(l *Lock) error { return l.Refresh(ctx, 0) },
+			wantErr: errors.New("any"),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, c := newClient(t)
+
+			l, err := Obtain(ctx, c, "orders:42", time.Minute, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.before != nil {
+				tt.before(s)
+			}
+
+			err = tt.op(l)
+			switch {
+			case tt.wantErr == nil && err != nil:
+				t.Fatalf("got %v, want nil", err)
+			case tt.wantErr != nil && err == nil:
+				t.Fatalf("got nil, want %v", tt.wantErr)
+			case errors.Is(tt.wantErr, ErrNotHeld) && !errors.Is(err, ErrNotHeld):
+				t.Fatalf("got %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestReleaseFreesTheKey(t *testing.T) {
+	ctx := context.Background()
+	s, c := newClient(t)
+
+	l, err := Obtain(ctx, c, "orders:42", time.Minute, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Release(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if s.Exists("orders:42") {
+		t.Error("the key is kept after release")
+	}
+	if !s.Exists("{orders:42}:fence") {
+		t.Error("the fencing counter is removed with the lock")
+	}
+}
+
+func TestRedlock(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name    string
+		servers int
+		// down is the number of stopped servers
+		down int
+		// held is the number of servers where the key is held by someone else
+		held    int
+		wantErr bool
+	}{
+		{name: "all up", servers: 3},
+		{name: "minority down", servers: 3, down: 1},
+		{name: "majority down", servers: 3, down: 2, wantErr: true},
+		{name: "minority held", servers: 5, held: 2},
+		{name: "majority held", servers: 5, held: 3, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			servers := make([]*miniredis.Miniredis, tt.servers)
+			clients := make([]redis.UniversalClient, tt.servers)
+			for i := range servers {
+				servers[i], clients[i] = newClient(t)
+			}
+			for i := 0; i < tt.down; i++ {
+				servers[i].Close()
+			}
+			for i := 0; i < tt.held; i++ {
+				_ = servers[i].Set("orders:42", "other")
+			}
+
+			l, err := NewRedlock(clients...).Obtain(ctx, "orders:42", time.Minute, nil)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error: got %v, want error %t", err, tt.wantErr)
+			}
+			if err != nil {
+				// the instances locked without the quorum are released
+				for _, s := range servers[tt.down+tt.held:] {
+					if s.Exists("orders:42") {
+						t.Error("the key is kept on an instance after a failed obtain")
+					}
+				}
+				return
+			}
+			if err := l.Release(ctx); err != nil {
+				t.Errorf("release: %v", err)
+			}
+		})
+	}
+}
+
+func TestAutoExtend(t *testing.T) {
+	ctx := context.Background()
+	s, c := newClient(t)
+
+	l, err := Obtain(ctx, c, "orders:42", 30*time.Millisecond, &Options{AutoExtend: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if _, err := l.TTL(ctx); err != nil {
+		t.Fatalf("the lock is not extended: %v", err)
+	}
+
+	_ = s.Set("orders:42", "other")
+	select {
+	case <-l.Lost():
+	case <-time.After(time.Second):
+		t.Fatal("the lock taken over is not lost")
+	}
+}
+
+func TestFenceKey(t *testing.T) {
+	tests := []struct {
+		key, want string
+	}{
+		{key: "orders:42", want: "{orders:42}:fence"},
+		{key: "{orders}:42", want: "{orders}:42:fence"},
+		{key: "orders:{42}", want: "orders:{42}:fence"},
+		{key: "orders:{42", want: "{orders:{42}:fence"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			if got := fenceKey(tt.key); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,106 @@
+/*
+Copyright [2014] - [2024] The Last.Backend authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lock
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// RetryStrategy returns the delay before the next attempt to obtain a lock.
+// A zero delay stops retrying.
+type RetryStrategy interface {
+	NextBackoff() time.Duration
+}
+
+type noRetry struct{}
+
+func (noRetry) NextBackoff() time.Duration {
+	return 0
+}
+
+// NoRetry fails on the first attempt
+func NoRetry() RetryStrategy {
+	return noRetry{}
+}
+
+type linearBackoff time.Duration
+
+func (d linearBackoff) NextBackoff() time.Duration {
+	return time.Duration(d)
+}
+
+// LinearBackoff retries with the same delay until the context is done
+func LinearBackoff(delay time.Duration) RetryStrategy {
+	return linearBackoff(delay)
+}
+
+type exponentialBackoff struct {
+	mtx      sync.Mutex
+	min, max time.Duration
+	attempt  int
+}
+
+func (b *exponentialBackoff) NextBackoff() time.Duration {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	delay := b.min << uint(b.attempt)
+	if delay <= 0 || delay > b.max {
+		delay = b.max
+	} else {
+		b.attempt++
+	}
+
+	// full jitter spreads out the contenders of the same lock
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// ExponentialBackoff doubles the delay on every attempt from min up to max, with jitter
+func ExponentialBackoff(min, max time.Duration) RetryStrategy {
+	if min <= 0 {
+		min = time.Millisecond
+	}
+	if max < min {
+		max = min
+	}
+	return &exponentialBackoff{min: min, max: max}
+}
+
+type limitRetry struct {
+	mtx      sync.Mutex
+	strategy RetryStrategy
+	max      int
+	attempt  int
+}
+
+func (r *limitRetry) NextBackoff() time.Duration {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	if r.attempt >= r.max {
+		return 0
+	}
+	r.attempt++
+	return r.strategy.NextBackoff()
+}
+
+// LimitRetry stops the strategy after max retries
+func LimitRetry(strategy RetryStrategy, max int) RetryStrategy {
+	return &limitRetry{strategy: strategy, max: max}
+}
@@ -21,10 +21,14 @@ import (
 	"crypto/tls"
 	"fmt"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/lastbackend/toolkit-plugins/redis/cache"
 	"github.com/lastbackend/toolkit/pkg/runtime"
+	"github.com/lastbackend/toolkit/pkg/runtime/logger"
 	"github.com/lastbackend/toolkit/pkg/tools/probes"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/redis/go-redis/v9"
 )
 
@@ -33,10 +37,35 @@ const (
 	defaultEndpoint = ":6379"
 )
 
+const (
+	ModeStandalone = "standalone"
+	ModeCluster    = "cluster"
+	ModeSentinel   = "sentinel"
+	ModeRing       = "ring"
+)
+
 type Config struct {
-	Endpoint string `env:"ENDPOINT" envDefault:":6379" comment:"Endpoint = host:port,host:port addresses of ring shards."`
+	Endpoint string `env:"ENDPOINT" envDefault:":6379" comment:"Endpoint = host:port,host:port addresses of the server, cluster nodes, sentinels or ring shards. Ring shards can be named as name=host:port."`
+
+	Mode string `env:"MODE" comment:"Mode = standalone, cluster, sentinel or ring. Default is standalone, or cluster when CLUSTER is set."`
+
+	Cluster bool `env:"CLUSTER" comment:"Cluster = enable cluster mode. Deprecated, use MODE=cluster."`
+
+	SentinelMasterName string `env:"SENTINEL_MASTER_NAME" comment:"Name of the master monitored by the sentinels. Required in sentinel mode."`
+
+	SentinelUsername string `env:"SENTINEL_USERNAME" comment:"Username to authenticate with the sentinels using the Redis ACL system."`
+
+	SentinelPassword string `env:"SENTINEL_PASSWORD" comment:"Password to authenticate with the sentinels (requirepass in the sentinel configuration)."`
 
-	Cluster bool `env:"CLUSTER" comment:"Cluster = enable cluster mode"`
+	RingHash string `env:"RING_HASH" comment:"Hashing scheme used to distribute keys across ring shards: rendezvous or ketama. Default is rendezvous."`
+
+	ReadOnly bool `env:"READ_ONLY" comment:"Enables read-only commands on replica nodes in cluster mode."`
+
+	RouteByLatency bool `env:"ROUTE_BY_LATENCY" comment:"Routes read-only commands to the closest master or replica node in cluster mode. Enables READ_ONLY."`
+
+	RouteRandomly bool `env:"ROUTE_RANDOMLY" comment:"Routes read-only commands to a random master or replica node in cluster mode. Enables READ_ONLY."`
+
+	ClusterHealthPolicy string `env:"CLUSTER_HEALTH_POLICY" envDefault:"masters" comment:"Which failures of cluster nodes fail the readiness, the others are logged as degraded: all, masters (unreachable masters or failed cluster state) or state (failed cluster state only)."`
 
 	Database int `env:"DATABASE" required:"true" comment:"Database to be selected after connecting to the server."`
 
@@ -64,14 +93,112 @@ type Config struct {
 
 	PoolTimeout time.Duration `env:"POOL_TIMEOUT" comment:"Amount of time client waits for connection if all connections are busy before returning an error. Default is ReadTimeout + 1 second."`
 
-	// TODO: need to implement the ability to install tls
-	// TLS Config to use. When set TLS will be negotiated.
+	CacheNegativeTTL time.Duration `env:"CACHE_NEGATIVE_TTL" comment:"How long missing values reported by cache loaders are cached. Default is 0, missing values are not cached."`
+
+	CacheLocalSize int `env:"CACHE_LOCAL_SIZE" comment:"Number of cache entries kept in process memory. Default is 0, the in-process cache is disabled."`
+
+	CacheLocalTTL time.Duration `env:"CACHE_LOCAL_TTL" comment:"Maximum time cache entries are kept in process memory. Default is 1 minute."`
+
+	CacheLoadTimeout time.Duration `env:"CACHE_LOAD_TIMEOUT" comment:"Maximum duration of a cache loader call, it is not cancelled by the caller. Default is 10 seconds."`
+
+	StreamMaxLen int64 `env:"STREAM_MAX_LEN" envDefault:"100000" comment:"Approximate number of entries streams are trimmed to on publish. 0 disables trimming."`
+
+	StreamBlock time.Duration `env:"STREAM_BLOCK" envDefault:"2s" comment:"How long stream readers wait for new entries in one request."`
+
+	StreamBatchSize int64 `env:"STREAM_BATCH_SIZE" envDefault:"10" comment:"Number of stream entries read in one request."`
+
+	StreamClaimMinIdle time.Duration `env:"STREAM_CLAIM_MIN_IDLE" envDefault:"1m" comment:"Time after which unacknowledged stream entries are delivered again."`
+
+	StreamMaxDeliveries int64 `env:"STREAM_MAX_DELIVERIES" envDefault:"5" comment:"Number of deliveries after which stream entries are moved to the <stream>:dead stream. 0 retries forever."`
+
+	PubSubWorkers int `env:"PUBSUB_WORKERS" envDefault:"1" comment:"Number of concurrent handler calls of a pub/sub subscription. Messages are not ordered with more than one."`
+
+	PubSubBuffer int `env:"PUBSUB_BUFFER" envDefault:"100" comment:"Number of pub/sub messages queued for the handlers of a subscription."`
+
+	PubSubOverflow string `env:"PUBSUB_OVERFLOW" envDefault:"block" comment:"What to do with pub/sub messages received while the queue is full: block, drop_newest or drop_oldest."`
+
+	PubSubCodec string `env:"PUBSUB_CODEC" envDefault:"json" comment:"Codec of published pub/sub messages: json or gob."`
+
+	ElectionTTL time.Duration `env:"ELECTION_TTL" envDefault:"15s" comment:"Lease of the leader. Another instance is elected within this time after the leader is gone."`
+
+	ElectionRenewInterval time.Duration `env:"ELECTION_RENEW_INTERVAL" envDefault:"5s" comment:"How often the leader renews its lease and the other instances campaign. Must be less than ELECTION_TTL."`
+
+	JobsWorkers int `env:"JOBS_WORKERS" envDefault:"1" comment:"Number of jobs handled concurrently by the instance. Jobs are only taken once handlers are registered."`
+
+	JobsPollInterval time.Duration `env:"JOBS_POLL_INTERVAL" envDefault:"1s" comment:"How often idle workers check for due jobs."`
+
+	JobsVisibilityTimeout time.Duration `env:"JOBS_VISIBILITY_TIMEOUT" envDefault:"30s" comment:"Time after which jobs of a stopped instance are run again. Running jobs are extended every half of the timeout."`
+
+	JobsMaxRetries int `env:"JOBS_MAX_RETRIES" envDefault:"5" comment:"Number of retries of failed jobs before they are moved to the dead jobs."`
+
+	JobsRetryBackoff time.Duration `env:"JOBS_RETRY_BACKOFF" envDefault:"1s" comment:"Delay of the first retry, doubled on every next retry up to an hour."`
+
+	JobsDeadMax int64 `env:"JOBS_DEAD_MAX" envDefault:"1000" comment:"Number of dead jobs kept, the oldest are removed."`
+
+	KeyPrefixEnabled bool `env:"KEY_PREFIX_ENABLED" comment:"Namespaces the keys of the commands sent with Client, DB, ClusterDB and RingDB as <prefix>:[<tenant>:]<key>. The tenant is taken from the context set with WithTenant. In cluster and ring mode keys without a hash tag are stored as <prefix>:[<tenant>:]{<key>}, so they keep their slot, KEYS and SCAN match the whole namespace on the server and filter the keys by the pattern, and the prefixed commands are sent with a second client, doubling the connections to every node."`
+
+	KeyPrefix string `env:"KEY_PREFIX" comment:"Prefix of the keys. Default is the service name."`
+
+	KeyPrefixHashTag bool `env:"KEY_PREFIX_HASH_TAG" comment:"Wraps the prefix in a cluster hash tag, so all keys of the prefix and tenant are in one slot and multi-key commands work across them. Hash tags of the keys are ignored."`
+
+	ClientCacheEnabled bool `env:"CLIENT_CACHE_ENABLED" comment:"Enables the client-side cache of ClientCache, invalidated by the server with CLIENT TRACKING. Requires Redis 6 or greater in standalone or sentinel mode."`
+
+	ClientCacheMode string `env:"CLIENT_CACHE_MODE" envDefault:"default" comment:"Tracking mode of the client-side cache: default (the server remembers the keys read) or broadcast (the server reports the changes of all keys with CLIENT_CACHE_PREFIXES)."`
+
+	ClientCachePrefixes string `env:"CLIENT_CACHE_PREFIXES" comment:"Comma separated key prefixes reported in broadcast mode. The key prefix is added when KEY_PREFIX_ENABLED is set, the tenant is not, so the keys of a tenant are cached only when listed as <tenant>:<prefix>. Keys outside the prefixes are read without caching."`
+
+	ClientCacheSize int `env:"CLIENT_CACHE_SIZE" envDefault:"10000" comment:"Number of entries kept by the client-side cache, the least recently used are evicted."`
+
+	ClientCacheTTL time.Duration `env:"CLIENT_CACHE_TTL" envDefault:"5m" comment:"Maximum time entries are kept by the client-side cache, in case an invalidation is lost."`
+
+	MetricsEnabled bool `env:"METRICS_ENABLED" envDefault:"true" comment:"Registers Prometheus metrics of the commands and the connection pool, labeled with the lowercase prefix as client."`
+
+	TracingEnabled bool `env:"TRACING_ENABLED" envDefault:"true" comment:"Creates OpenTelemetry spans of the commands with the global tracer provider."`
+
+	TracingArgs bool `env:"TRACING_ARGS" comment:"Captures the command key in the spans, the other arguments are redacted."`
+
+	TLSEnabled bool `env:"TLS_ENABLED" comment:"Negotiate TLS with the server"`
+
+	TLSCA string `env:"TLS_CA" comment:"CA bundle used to verify the server certificate, PEM content or file path. System roots are used when empty."`
+
+	TLSCert string `env:"TLS_CERT" comment:"Client certificate, PEM content or file path. Files are reloaded when they change."`
+
+	TLSKey string `env:"TLS_KEY" comment:"Client certificate key, PEM content or file path. Files are reloaded when they change."`
+
+	TLSServerName string `env:"TLS_SERVER_NAME" comment:"Server name used to verify the server certificate. Default is the endpoint host."`
+
+	TLSInsecureSkipVerify bool `env:"TLS_INSECURE_SKIP_VERIFY" comment:"Do not verify the server certificate chain and host name."`
+
+	// TLS Config to use. When set TLS will be negotiated and the TLS_* settings are ignored.
 	TLSConfig *tls.Config
 }
 
 type Plugin interface {
+	// Client returns the client of the configured mode
+	Client() redis.UniversalClient
+	// DB returns the client in standalone and sentinel modes
 	DB() *redis.Client
+	// ClusterDB returns the client in cluster mode
 	ClusterDB() *redis.ClusterClient
+	// RingDB returns the client in ring mode
+	RingDB() *redis.Ring
+	// Cache returns the cache namespaced with the service name
+	Cache() *cache.Cache
+	// Streams returns the event broker on Redis Streams
+	Streams() Streams
+	// Subscribe subscribes to the channels, names with glob characters are subscribed as patterns.
+	// The subscription is restored after reconnects until it is closed or ctx is done.
+	Subscribe(ctx context.Context, channels []string, handler MessageHandler, opts *PubSubOptions) (PubSubSubscription, error)
+	// Publish encodes the value with the PUBSUB_CODEC and publishes it to the channel
+	Publish(ctx context.Context, channel string, v interface{}) error
+	// Election returns the leader election of the name among the instances of the service.
+	// The instance campaigns from the first call until it resigns on stop,
+	// a resigned election is replaced by a new one on the next call.
+	Election(name string) Election
+	// Jobs returns the delayed job queue of the service
+	Jobs() Jobs
+	// ClientCache returns the client-side cache, nil unless CLIENT_CACHE_ENABLED is set
+	ClientCache() ClientCache
 	Print()
 }
 
@@ -82,10 +209,39 @@ type Options struct {
 type plugin struct {
 	prefix  string
 	runtime runtime.Runtime
+	service string
+	log     logger.Logger
+
+	opts   Config
+	client redis.UniversalClient
+	// base is the client of the subsystems, which namespace their keys themselves.
+	// It is the client itself unless key prefixing is enabled.
+	base redis.UniversalClient
+	// shared is set when the client uses the connections of base
+	shared bool
+	db     *redis.Client
+	cdb    *redis.ClusterClient
+	rdb    *redis.Ring
+	cache  *cache.Cache
+
+	streams *streams
+	jobs    *jobs
+
+	instrumentation *instrumentation
+	registerer      prometheus.Registerer
 
-	opts Config
-	db   *redis.Client
-	cdb  *redis.ClusterClient
+	healthPolicy  ClusterHealthPolicy
+	clusterHealth *clusterHealth
+
+	clientCache *clientCache
+
+	codec         cache.Codec
+	overflow      OverflowPolicy
+	mtx           sync.Mutex
+	subscriptions map[*pubsub]struct{}
+	elections     map[string]*election
+
+	sentinels []*redis.SentinelClient
 
 	//probe toolkit.Probe
 }
@@ -107,6 +263,10 @@ func NewPlugin(runtime runtime.Runtime, opts *Options) Plugin {
 	return p
 }
 
+func (p *plugin) Client() redis.UniversalClient {
+	return p.client
+}
+
 func (p *plugin) DB() *redis.Client {
 	return p.db
 }
@@ -115,44 +275,503 @@ func (p *plugin) ClusterDB() *redis.ClusterClient {
 	return p.cdb
 }
 
+func (p *plugin) RingDB() *redis.Ring {
+	return p.rdb
+}
+
+func (p *plugin) Cache() *cache.Cache {
+	return p.cache
+}
+
+func (p *plugin) Streams() Streams {
+	return p.streams
+}
+
+func (p *plugin) Jobs() Jobs {
+	return p.jobs
+}
+
+func (p *plugin) ClientCache() ClientCache {
+	if p.clientCache == nil {
+		return nil
+	}
+	return p.clientCache
+}
+
+func (p *plugin) Subscribe(ctx context.Context, channels []string, handler MessageHandler, opts *PubSubOptions) (PubSubSubscription, error) {
+	o := PubSubOptions{
+		Workers:  p.opts.PubSubWorkers,
+		Buffer:   p.opts.PubSubBuffer,
+		Overflow: p.overflow,
+		Codec:    p.codec,
+	}
+	if opts != nil {
+		if opts.Workers > 0 {
+			o.Workers = opts.Workers
+		}
+		if opts.Buffer > 0 {
+			o.Buffer = opts.Buffer
+		}
+		if opts.Overflow != "" {
+			o.Overflow = opts.Overflow
+		}
+		if opts.Codec != nil {
+			o.Codec = opts.Codec
+		}
+	}
+	if o.Workers < 1 {
+		o.Workers = 1
+	}
+	if o.Buffer < 0 {
+		o.Buffer = 0
+	}
+
+	s, err := newPubSub(ctx, p.log, p.base, channels, handler, o, p.track)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (p *plugin) Election(name string) Election {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	if e, ok := p.elections[name]; ok {
+		return e
+	}
+
+	var e *election
+	e = newElection(p.log, p.base, electionKey(p.service, name), electionOptions{
+		TTL:   p.opts.ElectionTTL,
+		Renew: p.opts.ElectionRenewInterval,
+	}, func() {
+		p.mtx.Lock()
+		defer p.mtx.Unlock()
+		if p.elections[name] == e {
+			delete(p.elections, name)
+		}
+	})
+	p.elections[name] = e
+	return e
+}
+
+// track keeps the open subscriptions to close them on stop
+func (p *plugin) track(s *pubsub, active bool) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	if active {
+		p.subscriptions[s] = struct{}{}
+	} else {
+		delete(p.subscriptions, s)
+	}
+}
+
+func (p *plugin) Publish(ctx context.Context, channel string, v interface{}) error {
+	data, err := p.codec.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return p.base.Publish(ctx, channel, data).Err()
+}
+
 func (p *plugin) PreStart(ctx context.Context) (err error) {
+	p.service = p.runtime.Meta().GetName()
+	p.log = p.runtime.Log()
+	p.registerer = prometheus.DefaultRegisterer
+
+	if err := p.initPlugin(ctx); err != nil {
+		return err
+	}
 
-	if p.opts.Cluster {
-		client := redis.NewClusterClient(p.prepareClusterOptions(p.opts))
-		p.runtime.Tools().Probes().RegisterCheck(p.prefix, probes.ReadinessProbe, redisClusterPingChecker(client, 1*time.Second))
-		p.runtime.Tools().Probes().RegisterCheck(p.prefix, probes.LivenessProbe, redisClusterPingChecker(client, 1*time.Second))
+	mode, _ := p.mode()
+	switch mode {
+	case ModeCluster:
+		// every node is visited, a ping through the cluster client reaches one node only
+		p.clusterHealth = newClusterHealth(p.cdb, p.healthPolicy, 1*time.Second, p.log)
+		if p.opts.MetricsEnabled {
+			if err := p.clusterHealth.register(strings.ToLower(p.prefix), p.registerer); err != nil {
+				return err
+			}
+		}
+		p.runtime.Tools().Probes().RegisterCheck(p.prefix, probes.ReadinessProbe, p.clusterHealth.checker())
+		p.runtime.Tools().Probes().RegisterCheck(p.prefix, probes.LivenessProbe, redisPingChecker(p.client, 1*time.Second))
+		return nil
+	case ModeSentinel:
+		p.runtime.Tools().Probes().RegisterCheck(p.prefix+"_sentinel", probes.ReadinessProbe, redisSentinelChecker(p.sentinels, p.opts.SentinelMasterName, 1*time.Second))
+	case ModeRing:
+		// the ring answers a ping with any live shard, its probes check the shards instead
+		shards, _ := ringShards(p.opts.Endpoint)
+		p.runtime.Tools().Probes().RegisterCheck(p.prefix, probes.ReadinessProbe, redisRingChecker(p.rdb, len(shards), 1*time.Second))
+		p.runtime.Tools().Probes().RegisterCheck(p.prefix, probes.LivenessProbe, redisRingChecker(p.rdb, 1, 1*time.Second))
+		return nil
+	}
+
+	p.runtime.Tools().Probes().RegisterCheck(p.prefix, probes.ReadinessProbe, redisPingChecker(p.client, 1*time.Second))
+	p.runtime.Tools().Probes().RegisterCheck(p.prefix, probes.LivenessProbe, redisPingChecker(p.client, 1*time.Second))
+
+	return nil
+}
 
+// initPlugin connects and starts the subsystems, it does not depend on the runtime
+func (p *plugin) initPlugin(ctx context.Context) (err error) {
+
+	mode, err := p.mode()
+	if err != nil {
+		return err
+	}
+
+	if p.overflow, err = parseOverflowPolicy(p.opts.PubSubOverflow); err != nil {
+		return fmt.Errorf("%s_PUBSUB_OVERFLOW: %v", p.prefix, err)
+	}
+	if p.overflow == OverflowDropOldest && p.opts.PubSubBuffer < 1 {
+		return fmt.Errorf("%s_PUBSUB_OVERFLOW: %s requires a positive %s_PUBSUB_BUFFER", p.prefix, OverflowDropOldest, p.prefix)
+	}
+	if p.codec, err = parseCodec(p.opts.PubSubCodec); err != nil {
+		return fmt.Errorf("%s_PUBSUB_CODEC: %v", p.prefix, err)
+	}
+	if p.healthPolicy, err = parseClusterHealthPolicy(p.opts.ClusterHealthPolicy); err != nil {
+		return fmt.Errorf("%s_CLUSTER_HEALTH_POLICY: %v", p.prefix, err)
+	}
+	if p.opts.ElectionRenewInterval <= 0 || p.opts.ElectionRenewInterval >= p.opts.ElectionTTL {
+		return fmt.Errorf("%s_ELECTION_RENEW_INTERVAL must be positive and less than %s_ELECTION_TTL", p.prefix, p.prefix)
+	}
+	if p.opts.JobsPollInterval <= 0 || p.opts.JobsVisibilityTimeout <= 0 {
+		return fmt.Errorf("%s_JOBS_POLL_INTERVAL and %s_JOBS_VISIBILITY_TIMEOUT must be positive", p.prefix, p.prefix)
+	}
+
+	p.subscriptions = make(map[*pubsub]struct{})
+	p.elections = make(map[string]*election)
+
+	if p.base, err = p.newClient(mode); err != nil {
+		return err
+	}
+	p.client = p.base
+
+	if mode == ModeSentinel {
+		// dedicated sentinel connections are used by the probes only
+		tlsConfig := p.base.(*redis.Client).Options().TLSConfig
+		for _, addr := range splitEndpoint(p.opts.Endpoint) {
+			p.sentinels = append(p.sentinels, redis.NewSentinelClient(&redis.Options{
+				Addr:        addr,
+				Username:    p.opts.SentinelUsername,
+				Password:    p.opts.SentinelPassword,
+				DialTimeout: p.opts.DialTimeout,
+				TLSConfig:   tlsConfig,
+			}))
+		}
+	}
+
+	var prefix *keyPrefix
+	if p.opts.KeyPrefixEnabled {
+		name := p.opts.KeyPrefix
+		if name == "" {
+			name = p.service
+		}
+		if prefix, err = newKeyPrefix(name, p.opts.KeyPrefixHashTag, mode == ModeCluster || mode == ModeRing); err != nil {
+			return fmt.Errorf("%s_KEY_PREFIX: %v", p.prefix, err)
+		}
+
+		// the subsystems keep sending keys unchanged through base. Standalone and sentinel
+		// clients share the connections, cluster and ring clients can not be cloned.
+		if base, ok := p.base.(*redis.Client); ok {
+			p.client, p.shared = shareClient(base), true
+		} else if p.client, err = p.newClient(mode); err != nil {
+			return err
+		}
+	}
+
+	switch client := p.client.(type) {
+	case *redis.ClusterClient:
 		p.cdb = client
-	} else {
-		client := redis.NewClient(p.prepareOptions(p.opts))
-		p.runtime.Tools().Probes().RegisterCheck(p.prefix, probes.ReadinessProbe, redisPingChecker(client, 1*time.Second))
-		p.runtime.Tools().Probes().RegisterCheck(p.prefix, probes.LivenessProbe, redisPingChecker(client, 1*time.Second))
+	case *redis.Ring:
+		p.rdb = client
+	case *redis.Client:
 		p.db = client
 	}
 
+	p.instrumentation, err = newInstrumentation(p.pools(), strings.ToLower(p.prefix), instrumentationOptions{
+		Metrics: p.opts.MetricsEnabled,
+		Tracing: p.opts.TracingEnabled,
+		Args:    p.opts.TracingArgs,
+	}, p.registerer)
+	if err != nil {
+		return err
+	}
+	for _, client := range p.clients() {
+		client.AddHook(p.instrumentation)
+	}
+	if prefix != nil {
+		p.client.AddHook(prefix)
+	}
+
+	if p.opts.ClientCacheEnabled {
+		if err := p.initClientCache(ctx, mode, prefix); err != nil {
+			return err
+		}
+	}
+
+	p.cache = cache.New(p.base, &cache.Options{
+		Namespace:   p.service,
+		NegativeTTL: p.opts.CacheNegativeTTL,
+		LocalSize:   p.opts.CacheLocalSize,
+		LocalTTL:    p.opts.CacheLocalTTL,
+		LoadTimeout: p.opts.CacheLoadTimeout,
+	})
+
+	p.streams = newStreams(p.log, p.base, p.service, streamOptions{
+		MaxLen:        p.opts.StreamMaxLen,
+		Block:         p.opts.StreamBlock,
+		BatchSize:     p.opts.StreamBatchSize,
+		ClaimMinIdle:  p.opts.StreamClaimMinIdle,
+		MaxDeliveries: p.opts.StreamMaxDeliveries,
+	})
+
+	p.jobs = newJobs(p.log, p.base, p.service, jobsOptions{
+		Workers:      p.opts.JobsWorkers,
+		PollInterval: p.opts.JobsPollInterval,
+		Visibility:   p.opts.JobsVisibilityTimeout,
+		MaxRetries:   p.opts.JobsMaxRetries,
+		RetryBackoff: p.opts.JobsRetryBackoff,
+		DeadMax:      p.opts.JobsDeadMax,
+	})
+	p.jobs.start()
+
 	return nil
 }
 
-func (p *plugin) OnStop(context.Context) error {
-	if p.db != nil {
-		return p.db.Close()
+func (p *plugin) OnStop(ctx context.Context) error {
+	p.mtx.Lock()
+	elections := make([]*election, 0, len(p.elections))
+	for _, e := range p.elections {
+		elections = append(elections, e)
+	}
+	p.mtx.Unlock()
+
+	// the leadership is handed over right away instead of after the lease expires
+	for _, e := range elections {
+		if err := e.Resign(ctx); err != nil {
+			p.log.Errorf("redis: can not resign from %s: %v", e.key, err)
+		}
+	}
+
+	if p.jobs != nil {
+		if err := p.jobs.drain(ctx); err != nil {
+			p.log.Errorf("redis: can not drain jobs: %v", err)
+		}
+	}
+
+	if p.streams != nil {
+		if err := p.streams.close(ctx); err != nil {
+			p.log.Errorf("redis: can not stop stream readers: %v", err)
+		}
+	}
+
+	p.mtx.Lock()
+	subscriptions := make([]*pubsub, 0, len(p.subscriptions))
+	for s := range p.subscriptions {
+		subscriptions = append(subscriptions, s)
+	}
+	p.mtx.Unlock()
+
+	for _, s := range subscriptions {
+		_ = s.Close()
+	}
+
+	for _, s := range p.sentinels {
+		_ = s.Close()
+	}
+	if p.cache != nil {
+		_ = p.cache.Close()
+	}
+	if p.clientCache != nil {
+		_ = p.clientCache.Close()
+		p.clientCache.unregister(p.registerer)
+	}
+	if p.instrumentation != nil {
+		p.instrumentation.unregister(p.registerer)
+	}
+	if p.clusterHealth != nil {
+		p.clusterHealth.unregister(p.registerer)
+	}
+	if p.shared {
+		return p.base.Close()
+	}
+	if p.base != nil && p.base != p.client {
+		_ = p.base.Close()
+	}
+	if p.client != nil {
+		return p.client.Close()
+	}
+	return nil
+}
+
+// initClientCache starts the client-side cache, its connections are created with the hooks of the client
+func (p *plugin) initClientCache(ctx context.Context, mode string, prefix *keyPrefix) error {
+	if mode != ModeStandalone && mode != ModeSentinel {
+		return fmt.Errorf("%s_CLIENT_CACHE_ENABLED: client-side cache is not supported in %s mode", p.prefix, mode)
+	}
+
+	tracking, err := parseTrackingMode(p.opts.ClientCacheMode)
+	if err != nil {
+		return fmt.Errorf("%s_CLIENT_CACHE_MODE: %v", p.prefix, err)
+	}
+	if p.opts.ClientCacheSize <= 0 || p.opts.ClientCacheTTL <= 0 {
+		return fmt.Errorf("%s_CLIENT_CACHE_SIZE and %s_CLIENT_CACHE_TTL must be positive", p.prefix, p.prefix)
+	}
+
+	var prefixes []string
+	for _, v := range strings.Split(p.opts.ClientCachePrefixes, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			prefixes = append(prefixes, v)
+		}
+	}
+	if prefix != nil {
+		// the server reports the keys as they are stored
+		ns := prefix.namespace(context.Background())
+		for i := range prefixes {
+			prefixes[i] = ns + prefixes[i]
+		}
+		if len(prefixes) == 0 {
+			prefixes = []string{ns}
+		}
+	}
+
+	factory := func(onConnect func(ctx context.Context, cn *redis.Conn) error) (*redis.Client, error) {
+		var client *redis.Client
+		if mode == ModeSentinel {
+			opts, err := p.prepareFailoverOptions(p.opts)
+			if err != nil {
+				return nil, err
+			}
+			opts.OnConnect = onConnect
+			client = redis.NewFailoverClient(opts)
+		} else {
+			opts, err := p.prepareOptions(p.opts)
+			if err != nil {
+				return nil, err
+			}
+			opts.OnConnect = onConnect
+			client = redis.NewClient(opts)
+		}
+
+		client.AddHook(p.instrumentation)
+		if prefix != nil {
+			client.AddHook(prefix)
+		}
+		return client, nil
+	}
+
+	p.clientCache, err = newClientCache(ctx, p.log, clientCacheOptions{
+		Mode:     tracking,
+		Prefixes: prefixes,
+		Size:     p.opts.ClientCacheSize,
+		TTL:      p.opts.ClientCacheTTL,
+	}, prefix, factory)
+	if err != nil {
+		return err
 	}
-	if p.cdb != nil {
-		return p.cdb.Close()
+
+	if p.opts.MetricsEnabled {
+		return p.clientCache.register(strings.ToLower(p.prefix), p.registerer)
 	}
 	return nil
 }
 
-func (p *plugin) prepareOptions(opts Config) *redis.Options {
+// clients returns the client and the client of the subsystems when they differ
+func (p *plugin) clients() []redis.UniversalClient {
+	if p.base == p.client {
+		return []redis.UniversalClient{p.client}
+	}
+	return []redis.UniversalClient{p.client, p.base}
+}
+
+// pools returns the clients with their own connections
+func (p *plugin) pools() []redis.UniversalClient {
+	if p.shared {
+		return []redis.UniversalClient{p.base}
+	}
+	return p.clients()
+}
+
+// shareClient returns a client with its own hooks on the connections of the client.
+// It is created before any hook is added to the client, the hooks are not shared.
+// WithTimeout is the only clone sharing the pool, it gives the clone a copy of the
+// options with both timeouts set to one value, the copy is replaced with the options
+// of the client.
+func shareClient(client *redis.Client) *redis.Client {
+	opts := *client.Options()
+	shared := client.WithTimeout(opts.ReadTimeout)
+	*shared.Options() = opts
+	return shared
+}
+
+// newClient creates the client of the mode
+func (p *plugin) newClient(mode string) (redis.UniversalClient, error) {
+	switch mode {
+	case ModeCluster:
+		opts, err := p.prepareClusterOptions(p.opts)
+		if err != nil {
+			return nil, err
+		}
+		return redis.NewClusterClient(opts), nil
+	case ModeSentinel:
+		opts, err := p.prepareFailoverOptions(p.opts)
+		if err != nil {
+			return nil, err
+		}
+		return redis.NewFailoverClient(opts), nil
+	case ModeRing:
+		opts, err := p.prepareRingOptions(p.opts)
+		if err != nil {
+			return nil, err
+		}
+		return redis.NewRing(opts), nil
+	default:
+		opts, err := p.prepareOptions(p.opts)
+		if err != nil {
+			return nil, err
+		}
+		return redis.NewClient(opts), nil
+	}
+}
+
+// mode returns the configured mode, the CLUSTER flag is kept for compatibility
+func (p *plugin) mode() (string, error) {
+	switch mode := strings.ToLower(p.opts.Mode); mode {
+	case "":
+		if p.opts.Cluster {
+			return ModeCluster, nil
+		}
+		return ModeStandalone, nil
+	case ModeStandalone, ModeCluster, ModeSentinel, ModeRing:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("%s_MODE: unknown mode %q, expected %s, %s, %s or %s",
+			p.prefix, p.opts.Mode, ModeStandalone, ModeCluster, ModeSentinel, ModeRing)
+	}
+}
 
-	addr := defaultEndpoint
-	if len(opts.Endpoint) > 0 {
-		opts.Endpoint = strings.Replace(opts.Endpoint, " ", "", -1)
-		addr = strings.Split(opts.Endpoint, ",")[0]
+func splitEndpoint(endpoint string) []string {
+	endpoint = strings.Replace(endpoint, " ", "", -1)
+	if len(endpoint) == 0 {
+		return []string{defaultEndpoint}
+	}
+	return strings.Split(endpoint, ",")
+}
+
+func (p *plugin) prepareOptions(opts Config) (*redis.Options, error) {
+
+	addr := splitEndpoint(opts.Endpoint)[0]
+
+	tlsConfig, err := prepareTLSConfig(opts)
+	if err != nil {
+		return nil, err
 	}
 
 	return &redis.Options{
 		Addr:            addr,
+		DB:              opts.Database,
 		Username:        opts.Username,
 		Password:        opts.Password,
 		MaxRetries:      opts.MaxRetries,
@@ -164,16 +783,17 @@ func (p *plugin) prepareOptions(opts Config) *redis.Options {
 		PoolSize:        opts.PoolSize,
 		MinIdleConns:    opts.MinIdleConns,
 		PoolTimeout:     opts.PoolTimeout,
-		TLSConfig:       opts.TLSConfig,
-	}
+		TLSConfig:       tlsConfig,
+	}, nil
 }
 
-func (p *plugin) prepareClusterOptions(opts Config) *redis.ClusterOptions {
+func (p *plugin) prepareClusterOptions(opts Config) (*redis.ClusterOptions, error) {
 
-	addrs := []string{defaultEndpoint}
-	if len(opts.Endpoint) > 0 {
-		opts.Endpoint = strings.Replace(opts.Endpoint, " ", "", -1)
-		addrs = strings.Split(opts.Endpoint, ",")
+	addrs := splitEndpoint(opts.Endpoint)
+
+	tlsConfig, err := prepareTLSConfig(opts)
+	if err != nil {
+		return nil, err
 	}
 
 	return &redis.ClusterOptions{
@@ -189,15 +809,90 @@ func (p *plugin) prepareClusterOptions(opts Config) *redis.ClusterOptions {
 		PoolSize:        opts.PoolSize,
 		MinIdleConns:    opts.MinIdleConns,
 		PoolTimeout:     opts.PoolTimeout,
-		TLSConfig:       opts.TLSConfig,
+		ReadOnly:        opts.ReadOnly,
+		RouteByLatency:  opts.RouteByLatency,
+		RouteRandomly:   opts.RouteRandomly,
+		TLSConfig:       tlsConfig,
+	}, nil
+}
+
+func (p *plugin) prepareFailoverOptions(opts Config) (*redis.FailoverOptions, error) {
+
+	if opts.SentinelMasterName == "" {
+		return nil, fmt.Errorf("%s_SENTINEL_MASTER_NAME is required in sentinel mode", p.prefix)
 	}
+
+	tlsConfig, err := prepareTLSConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return &redis.FailoverOptions{
+		MasterName:       opts.SentinelMasterName,
+		SentinelAddrs:    splitEndpoint(opts.Endpoint),
+		SentinelUsername: opts.SentinelUsername,
+		SentinelPassword: opts.SentinelPassword,
+		DB:               opts.Database,
+		Username:         opts.Username,
+		Password:         opts.Password,
+		MaxRetries:       opts.MaxRetries,
+		MinRetryBackoff:  opts.MinRetryBackoff,
+		MaxRetryBackoff:  opts.MaxRetryBackoff,
+		DialTimeout:      opts.DialTimeout,
+		ReadTimeout:      opts.ReadTimeout,
+		WriteTimeout:     opts.WriteTimeout,
+		PoolSize:         opts.PoolSize,
+		MinIdleConns:     opts.MinIdleConns,
+		PoolTimeout:      opts.PoolTimeout,
+		TLSConfig:        tlsConfig,
+	}, nil
+}
+
+func (p *plugin) prepareRingOptions(opts Config) (*redis.RingOptions, error) {
+
+	addrs, err := ringShards(opts.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	hash, err := ringHash(opts.RingHash)
+	if err != nil {
+		return nil, fmt.Errorf("%s_RING_HASH: %v", p.prefix, err)
+	}
+
+	tlsConfig, err := prepareTLSConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return &redis.RingOptions{
+		Addrs:              addrs,
+		NewConsistentHash:  hash,
+		HeartbeatFrequency: opts.HeartbeatFrequency,
+		DB:                 opts.Database,
+		Username:           opts.Username,
+		Password:           opts.Password,
+		MaxRetries:         opts.MaxRetries,
+		MinRetryBackoff:    opts.MinRetryBackoff,
+		MaxRetryBackoff:    opts.MaxRetryBackoff,
+		DialTimeout:        opts.DialTimeout,
+		ReadTimeout:        opts.ReadTimeout,
+		WriteTimeout:       opts.WriteTimeout,
+		PoolSize:           opts.PoolSize,
+		MinIdleConns:       opts.MinIdleConns,
+		PoolTimeout:        opts.PoolTimeout,
+		TLSConfig:          tlsConfig,
+	}, nil
 }
 
 func (p *plugin) Print() {
+	if p.runtime == nil {
+		return
+	}
 	p.runtime.Config().Print(p.opts, p.prefix)
 }
 
-func redisClusterPingChecker(client *redis.ClusterClient, timeout time.Duration) probes.HandleFunc {
+func redisPingChecker(client redis.UniversalClient, timeout time.Duration) probes.HandleFunc {
 	return func() error {
 		ctx, cancel := context.WithTimeout(context.Background(), timeout)
 		defer cancel()
@@ -212,17 +907,43 @@ func redisClusterPingChecker(client *redis.ClusterClient, timeout time.Duration)
 	}
 }
 
-func redisPingChecker(client *redis.Client, timeout time.Duration) probes.HandleFunc {
+// redisSentinelChecker checks that the sentinels still know the master,
+// so the readiness fails when the failover can not happen anymore
+func redisSentinelChecker(sentinels []*redis.SentinelClient, master string, timeout time.Duration) probes.HandleFunc {
+	return func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+
+		var lastErr error
+		for _, s := range sentinels {
+			if lastErr = s.GetMasterAddrByName(ctx, master).Err(); lastErr == nil {
+				return nil
+			}
+		}
+		return fmt.Errorf("no sentinel reports master %s: %v", master, lastErr)
+	}
+}
+
+// redisRingChecker fails when less than min shards are up,
+// the ring keeps serving with down shards by rehashing their keys
+func redisRingChecker(client *redis.Ring, min int, timeout time.Duration) probes.HandleFunc {
 	return func() error {
 		ctx, cancel := context.WithTimeout(context.Background(), timeout)
 		defer cancel()
 		if client == nil {
 			return fmt.Errorf("connection is nil")
 		}
-		_, err := client.Ping(ctx).Result()
+
+		err := client.ForEachShard(ctx, func(ctx context.Context, shard *redis.Client) error {
+			return shard.Ping(ctx).Err()
+		})
 		if err != nil {
 			return err
 		}
+
+		if up := client.Len(); up < min {
+			return fmt.Errorf("%d ring shards are up, %d required", up, min)
+		}
 		return nil
 	}
 }
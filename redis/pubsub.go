@@ -0,0 +1,331 @@
+/*
+Copyright [2014] - [2024] The Last.Backend authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package redis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lastbackend/toolkit-plugins/redis/cache"
+	"github.com/lastbackend/toolkit/pkg/runtime/logger"
+	"github.com/redis/go-redis/v9"
+)
+
+// OverflowPolicy decides what happens to messages received while the worker queue is full
+type OverflowPolicy string
+
+const (
+	// OverflowBlock stops reading until a worker is free. Redis disconnects
+	// subscribers whose output buffer grows over client-output-buffer-limit.
+	OverflowBlock OverflowPolicy = "block"
+	// OverflowDropNewest drops the received message
+	OverflowDropNewest OverflowPolicy = "drop_newest"
+	// OverflowDropOldest drops the oldest queued message to make room for the received one
+	OverflowDropOldest OverflowPolicy = "drop_oldest"
+)
+
+const (
+	pubsubHealthCheck = 30 * time.Second
+	pubsubRetryDelay  = time.Second
+)
+
+// Message is a message received on a subscribed channel
+type Message struct {
+	Channel string
+	// Pattern is the matched pattern for pattern subscriptions
+	Pattern string
+	Payload []byte
+
+	codec cache.Codec
+}
+
+// Decode decodes the payload with the codec of the subscription
+func (m *Message) Decode(v interface{}) error {
+	return m.codec.Unmarshal(m.Payload, v)
+}
+
+// MessageHandler handles a message, returned errors are logged
+type MessageHandler func(ctx context.Context, msg *Message) error
+
+// Typed returns a handler decoding the payload into T
+func Typed[T any](fn func(ctx context.Context, channel string, v T) error) MessageHandler {
+	return func(ctx context.Context, msg *Message) error {
+		var v T
+		if err := msg.Decode(&v); err != nil {
+			return fmt.Errorf("can not decode message of %s: %w", msg.Channel, err)
+		}
+		return fn(ctx, msg.Channel, v)
+	}
+}
+
+type PubSubOptions struct {
+	// Workers is the number of concurrent handler calls, messages are not ordered with more than one
+	Workers int
+	// Buffer is the number of messages queued for the workers
+	Buffer int
+	// Overflow is applied when the queue is full, drop_oldest needs a Buffer
+	Overflow OverflowPolicy
+	// Codec decodes the payloads
+	Codec cache.Codec
+}
+
+type PubSubSubscription interface {
+	// Close unsubscribes and waits for the queued messages to be handled.
+	// It deadlocks when called from the handler, which should cancel
+	// the context passed to Subscribe instead.
+	Close() error
+	// Dropped returns the number of messages dropped by the overflow policy
+	Dropped() uint64
+}
+
+// isPattern reports whether the channel name is a glob-style pattern
+func isPattern(channel string) bool {
+	return strings.ContainsAny(channel, "*?[")
+}
+
+func parseOverflowPolicy(policy string) (OverflowPolicy, error) {
+	switch p := OverflowPolicy(strings.ToLower(policy)); p {
+	case "", OverflowBlock:
+		return OverflowBlock, nil
+	case OverflowDropNewest, OverflowDropOldest:
+		return p, nil
+	default:
+		return "", fmt.Errorf("unknown overflow policy %q, expected %s, %s or %s", policy, OverflowBlock, OverflowDropNewest, OverflowDropOldest)
+	}
+}
+
+func parseCodec(codec string) (cache.Codec, error) {
+	switch strings.ToLower(codec) {
+	case "", "json":
+		return cache.JSON, nil
+	case "gob":
+		return cache.Gob, nil
+	default:
+		return nil, fmt.Errorf("unknown codec %q, expected json or gob", codec)
+	}
+}
+
+// pubsub reads the subscribed channels and dispatches the messages to a worker pool.
+// Lost connections are restored by go-redis, which subscribes to the channels again.
+type pubsub struct {
+	log      logger.Logger
+	ps       *redis.PubSub
+	channels []string
+	handler  MessageHandler
+	opts     PubSubOptions
+
+	queue   chan *Message
+	dropped uint64
+	cancel  context.CancelFunc
+	done    chan struct{}
+	workers sync.WaitGroup
+	once    sync.Once
+	track   func(s *pubsub, active bool)
+}
+
+// newPubSub subscribes to the channels, track is called when the subscription starts and closes
+func newPubSub(ctx context.Context, log logger.Logger, client redis.UniversalClient, channels []string, handler MessageHandler, opts PubSubOptions, track func(s *pubsub, active bool)) (*pubsub, error) {
+	if len(channels) == 0 {
+		return nil, errors.New("no channels to subscribe")
+	}
+	// without a queue there is no oldest message to drop
+	if opts.Overflow == OverflowDropOldest && opts.Buffer < 1 {
+		return nil, fmt.Errorf("overflow policy %s requires a buffer", OverflowDropOldest)
+	}
+
+	var names, patterns []string
+	for _, ch := range channels {
+		if isPattern(ch) {
+			patterns = append(patterns, ch)
+		} else {
+			names = append(names, ch)
+		}
+	}
+
+	ps := client.Subscribe(ctx)
+	if len(names) > 0 {
+		if err := ps.Subscribe(ctx, names...); err != nil {
+			_ = ps.Close()
+			return nil, err
+		}
+	}
+	if len(patterns) > 0 {
+		if err := ps.PSubscribe(ctx, patterns...); err != nil {
+			_ = ps.Close()
+			return nil, err
+		}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+
+	s := &pubsub{
+		log:      log,
+		ps:       ps,
+		channels: channels,
+		handler:  handler,
+		opts:     opts,
+		queue:    make(chan *Message, opts.Buffer),
+		cancel:   cancel,
+		done:     make(chan struct{}),
+		track:    track,
+	}
+
+	if track != nil {
+		track(s, true)
+	}
+
+	for i := 0; i < opts.Workers; i++ {
+		s.workers.Add(1)
+		go s.work()
+	}
+	go s.run(ctx)
+
+	// the subscription is closed with the context passed to Subscribe,
+	// closing the connection interrupts the pending receive
+	go func() {
+		<-ctx.Done()
+		_ = s.Close()
+	}()
+
+	return s, nil
+}
+
+func (s *pubsub) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+func (s *pubsub) Close() error {
+	var err error
+	s.once.Do(func() {
+		s.cancel()
+		err = s.ps.Close()
+		<-s.done
+		s.workers.Wait()
+		if s.track != nil {
+			s.track(s, false)
+		}
+	})
+	return err
+}
+
+func (s *pubsub) run(ctx context.Context) {
+	defer close(s.done)
+	defer close(s.queue)
+
+	var lost time.Time
+
+	for {
+		msg, err := s.ps.ReceiveTimeout(ctx, pubsubHealthCheck)
+		if ctx.Err() != nil {
+			return
+		}
+
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				// nothing received for a while, the ping checks the connection is alive
+				if err = s.ps.Ping(ctx); err == nil {
+					continue
+				}
+			}
+
+			if lost.IsZero() {
+				lost = time.Now()
+				s.log.Warnf("redis: pub/sub connection of %s lost: %v", strings.Join(s.channels, ","), err)
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(pubsubRetryDelay):
+			}
+			continue
+		}
+
+		if !lost.IsZero() {
+			s.log.Warnf("redis: pub/sub of %s restored after %s, messages published meanwhile are lost",
+				strings.Join(s.channels, ","), time.Since(lost).Round(time.Millisecond))
+			lost = time.Time{}
+		}
+
+		if m, ok := msg.(*redis.Message); ok {
+			s.dispatch(ctx, &Message{Channel: m.Channel, Pattern: m.Pattern, Payload: []byte(m.Payload), codec: s.opts.Codec})
+		}
+	}
+}
+
+func (s *pubsub) dispatch(ctx context.Context, msg *Message) {
+	switch s.opts.Overflow {
+	case OverflowDropNewest:
+		select {
+		case s.queue <- msg:
+		default:
+			s.drop(msg)
+		}
+	case OverflowDropOldest:
+		for {
+			select {
+			case s.queue <- msg:
+				return
+			default:
+			}
+			select {
+			case old := <-s.queue:
+				s.drop(old)
+			default:
+			}
+		}
+	default:
+		select {
+		case s.queue <- msg:
+		case <-ctx.Done():
+		}
+	}
+}
+
+func (s *pubsub) drop(msg *Message) {
+	// logged on the first drop and then on every thousandth, not to flood the log with a slow consumer
+	if n := atomic.AddUint64(&s.dropped, 1); n == 1 || n%1000 == 0 {
+		s.log.Warnf("redis: pub/sub queue is full, %d messages dropped, last of %s", n, msg.Channel)
+	}
+}
+
+func (s *pubsub) work() {
+	defer s.workers.Done()
+	for msg := range s.queue {
+		s.call(msg)
+	}
+}
+
+func (s *pubsub) call(msg *Message) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			s.log.Errorf("redis: handler of %s panicked: %v\n%s", msg.Channel, rec, debug.Stack())
+		}
+	}()
+
+	if err := s.handler(context.Background(), msg); err != nil {
+		s.log.Errorf("redis: handler of %s failed: %v", msg.Channel, err)
+	}
+}
@@ -0,0 +1,255 @@
+/*
+Copyright [2014] - [2024] The Last.Backend authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lastbackend/toolkit/pkg/server"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	MiddlewareKind  server.KindMiddleware  = "ratelimit"
+	InterceptorKind server.KindInterceptor = "ratelimit"
+)
+
+// HTTPKeyFunc returns the identity of the caller, requests with an empty identity are not limited
+type HTTPKeyFunc func(r *http.Request) string
+
+// GRPCKeyFunc returns the identity of the caller, calls with an empty identity are not limited
+type GRPCKeyFunc func(ctx context.Context, method string) string
+
+// ClientIP identifies HTTP callers by the remote address. X-Forwarded-For is ignored,
+// callers can set it freely, see ForwardedClientIP for services behind proxies.
+func ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// ForwardedClientIP identifies HTTP callers behind the trusted proxies, given as addresses or CIDR ranges.
+// X-Forwarded-For is read only for requests from a trusted proxy, and its rightmost address
+// which is not a trusted proxy is used, as the entries on its left are set by the caller.
+func ForwardedClientIP(proxies ...string) (HTTPKeyFunc, error) {
+	trusted := make([]netip.Prefix, 0, len(proxies))
+	for _, proxy := range proxies {
+		proxy = strings.TrimSpace(proxy)
+		if strings.Contains(proxy, "/") {
+			prefix, err := netip.ParsePrefix(proxy)
+			if err != nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q: %w", proxy, err)
+			}
+			trusted = append(trusted, prefix.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", proxy, err)
+		}
+		trusted = append(trusted, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+	}
+
+	isTrusted := func(ip string) bool {
+		addr, err := netip.ParseAddr(ip)
+		if err != nil {
+			return false
+		}
+		addr = addr.Unmap()
+		for _, prefix := range trusted {
+			if prefix.Contains(addr) {
+				return true
+			}
+		}
+		return false
+	}
+
+	return func(r *http.Request) string {
+		ip := ClientIP(r)
+		if !isTrusted(ip) {
+			return ip
+		}
+
+		// the headers are joined, a proxy may add a header instead of appending to the last one
+		hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+		for n := len(hops) - 1; n >= 0; n-- {
+			hop := strings.TrimSpace(hops[n])
+			if hop == "" {
+				continue
+			}
+			ip = hop
+			if !isTrusted(hop) {
+				break
+			}
+		}
+		return ip
+	}, nil
+}
+
+// HeaderKey identifies HTTP callers by a header, such as an API key
+func HeaderKey(name string) HTTPKeyFunc {
+	return func(r *http.Request) string {
+		return r.Header.Get(name)
+	}
+}
+
+// PeerIP identifies gRPC callers by their address
+func PeerIP(ctx context.Context, _ string) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.Addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(p.Addr.String())
+	if err != nil {
+		return p.Addr.String()
+	}
+	return host
+}
+
+// MetadataKey identifies gRPC callers by a metadata value, such as an API key
+func MetadataKey(name string) GRPCKeyFunc {
+	return func(ctx context.Context, _ string) string {
+		if v := metadata.ValueFromIncomingContext(ctx, name); len(v) > 0 {
+			return v[0]
+		}
+		return ""
+	}
+}
+
+// HTTPMiddleware limits the requests of every caller. It implements the toolkit http server middleware.
+// Requests are let through when the limiter fails, an unavailable redis does not take the API down.
+type HTTPMiddleware struct {
+	server.DefaultHttpServerMiddleware
+	limiter Limiter
+	key     HTTPKeyFunc
+}
+
+func NewHTTPMiddleware(limiter Limiter, key HTTPKeyFunc) *HTTPMiddleware {
+	if key == nil {
+		key = ClientIP
+	}
+	return &HTTPMiddleware{limiter: limiter, key: key}
+}
+
+func (m *HTTPMiddleware) Kind() server.KindMiddleware {
+	return MiddlewareKind
+}
+
+func (m *HTTPMiddleware) Apply(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := m.key(r)
+		if key == "" {
+			h(w, r)
+			return
+		}
+
+		res, err := m.limiter.Allow(r.Context(), key)
+		if err != nil {
+			h(w, r)
+			return
+		}
+
+		w.Header().Set("X-RateLimit-Limit", strconv.Itoa(res.Limit.Rate))
+		w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(res.Remaining))
+		w.Header().Set("X-RateLimit-Reset", seconds(res.ResetAfter))
+
+		if !res.Allowed {
+			if res.RetryAfter > 0 {
+				w.Header().Set("Retry-After", seconds(res.RetryAfter))
+			}
+			http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+			return
+		}
+
+		h(w, r)
+	}
+}
+
+// GRPCInterceptor limits the calls of every caller. It implements the toolkit grpc server interceptor.
+// Calls are let through when the limiter fails, an unavailable redis does not take the API down.
+type GRPCInterceptor struct {
+	limiter Limiter
+	key     GRPCKeyFunc
+}
+
+func NewGRPCInterceptor(limiter Limiter, key GRPCKeyFunc) *GRPCInterceptor {
+	if key == nil {
+		key = PeerIP
+	}
+	return &GRPCInterceptor{limiter: limiter, key: key}
+}
+
+func (i *GRPCInterceptor) Kind() server.KindInterceptor {
+	return InterceptorKind
+}
+
+func (i *GRPCInterceptor) Order() int {
+	return 0
+}
+
+func (i *GRPCInterceptor) Interceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if err := i.allow(ctx, info.FullMethod); err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+// StreamInterceptor limits the streams opened by every caller
+func (i *GRPCInterceptor) StreamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if err := i.allow(ss.Context(), info.FullMethod); err != nil {
+		return err
+	}
+	return handler(srv, ss)
+}
+
+func (i *GRPCInterceptor) allow(ctx context.Context, method string) error {
+	key := i.key(ctx, method)
+	if key == "" {
+		return nil
+	}
+
+	res, err := i.limiter.Allow(ctx, key)
+	if err != nil || res.Allowed {
+		return nil
+	}
+
+	if res.RetryAfter <= 0 {
+		return status.Error(codes.ResourceExhausted, "rate limit exceeded")
+	}
+
+	_ = grpc.SetHeader(ctx, metadata.Pairs("retry-after", seconds(res.RetryAfter)))
+	return status.Errorf(codes.ResourceExhausted, "rate limit exceeded, retry in %s", res.RetryAfter.Round(time.Millisecond))
+}
+
+// seconds formats the duration in whole seconds, rounded up
+func seconds(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
@@ -0,0 +1,165 @@
+/*
+Copyright [2014] - [2024] The Last.Backend authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestForwardedClientIP(t *testing.T) {
+	key, err := ForwardedClientIP("10.0.0.1", "192.168.0.0/16", "::1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		remote string
+		xff    []string
+		want   string
+	}{
+		{name: "untrusted remote", remote: "203.0.113.7:1234", xff: []string{"198.51.100.1"}, want: "203.0.113.7"},
+		{name: "trusted remote without header", remote: "10.0.0.1:1234", want: "10.0.0.1"},
+		{name: "trusted remote", remote: "10.0.0.1:1234", xff: []string{"198.51.100.1"}, want: "198.51.100.1"},
+		{name: "spoofed hops on the left", remote: "10.0.0.1:1234", xff: []string{"1.1.1.1, 198.51.100.1"}, want: "198.51.100.1"},
+		{name: "trusted hops are skipped", remote: "10.0.0.1:1234", xff: []string{"198.51.100.1, 192.168.1.1"}, want: "198.51.100.1"},
+		{name: "several headers", remote: "10.0.0.1:1234", xff: []string{"1.1.1.1", "198.51.100.1"}, want: "198.51.100.1"},
+		{name: "only trusted hops", remote: "10.0.0.1:1234", xff: []string{"192.168.1.1"}, want: "192.168.1.1"},
+		{name: "ipv6 trusted remote", remote: "[::1]:1234", xff: []string{"2001:db8::1"}, want: "2001:db8::1"},
+		{name: "mapped ipv4 remote", remote: "[::ffff:10.0.0.1]:1234", xff: []string{"198.51.100.1"}, want: "198.51.100.1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tt.remote
+			for _, v := range tt.xff {
+				r.Header.Add("X-Forwarded-For", v)
+			}
+			if got := key(r); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestForwardedClientIPInvalidProxy(t *testing.T) {
+	for _, proxy := range []string{"10.0.0.1/33", "proxy.local"} {
+		if _, err := ForwardedClientIP(proxy); err == nil {
+			t.Errorf("got nil for %q, want an error", proxy)
+		}
+	}
+}
+
+func TestClientIPIgnoresForwardedFor(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = "203.0.113.7:1234"
+	r.Header.Set("X-Forwarded-For", "198.51.100.1")
+	if got := ClientIP(r); got != "203.0.113.7" {
+		t.Errorf("got %s, want 203.0.113.7", got)
+	}
+}
+
+// fakeLimiter returns the result or the error for every call
+type fakeLimiter struct {
+	res *Result
+	err error
+}
+
+func (f *fakeLimiter) Allow(ctx context.Context, key string) (*Result, error) {
+	return f.AllowN(ctx, key, 1)
+}
+
+func (f *fakeLimiter) AllowN(context.Context, string, int) (*Result, error) {
+	return f.res, f.err
+}
+
+func TestHTTPMiddleware(t *testing.T) {
+	limit := PerSecond(10)
+
+	tests := []struct {
+		name       string
+		limiter    *fakeLimiter
+		key        HTTPKeyFunc
+		wantStatus int
+		wantRetry  string
+	}{
+		{name: "allowed", limiter: &fakeLimiter{res: &Result{Limit: limit, Allowed: true, Remaining: 9}}, wantStatus: http.StatusOK},
+		{name: "denied", limiter: &fakeLimiter{res: &Result{Limit: limit, RetryAfter: 1500 * time.Millisecond}}, wantStatus: http.StatusTooManyRequests, wantRetry: "2"},
+		{name: "denied for good", limiter: &fakeLimiter{res: &Result{Limit: limit, RetryAfter: -1}}, wantStatus: http.StatusTooManyRequests},
+		{name: "limiter failure", limiter: &fakeLimiter{err: errors.New("down")}, wantStatus: http.StatusOK},
+		{name: "anonymous", limiter: &fakeLimiter{res: &Result{Limit: limit}}, key: HeaderKey("X-Api-Key"), wantStatus: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := NewHTTPMiddleware(tt.limiter, tt.key).Apply(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			})
+
+			w := httptest.NewRecorder()
+			h(w, httptest.NewRequest(http.MethodGet, "/", nil))
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("status: got %d, want %d", w.Code, tt.wantStatus)
+			}
+			if got := w.Header().Get("Retry-After"); got != tt.wantRetry {
+				t.Errorf("Retry-After: got %q, want %q", got, tt.wantRetry)
+			}
+		})
+	}
+}
+
+func TestGRPCInterceptor(t *testing.T) {
+	tests := []struct {
+		name     string
+		limiter  *fakeLimiter
+		key      GRPCKeyFunc
+		wantCode codes.Code
+	}{
+		{name: "allowed", limiter: &fakeLimiter{res: &Result{Allowed: true}}, wantCode: codes.OK},
+		{name: "denied", limiter: &fakeLimiter{res: &Result{RetryAfter: time.Second}}, wantCode: codes.ResourceExhausted},
+		{name: "denied for good", limiter: &fakeLimiter{res: &Result{RetryAfter: -1}}, wantCode: codes.ResourceExhausted},
+		{name: "limiter failure", limiter: &fakeLimiter{err: errors.New("down")}, wantCode: codes.OK},
+		{name: "anonymous", limiter: &fakeLimiter{res: &Result{}}, wantCode: codes.OK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key := tt.key
+			if key == nil && tt.name != "anonymous" {
+				key = func(context.Context, string) string { return "user:1" }
+			}
+			i := NewGRPCInterceptor(tt.limiter, key)
+
+			_, err := i.Interceptor(context.Background(), nil, &grpc.UnaryServerInfo{FullMethod: "/svc/Method"},
+				func(ctx context.Context, req interface{}) (interface{}, error) { return nil, nil })
+			if code := status.Code(err); code != tt.wantCode {
+				t.Errorf("code: got %s, want %s", code, tt.wantCode)
+			}
+		})
+	}
+}
@@ -0,0 +1,278 @@
+/*
+Copyright [2014] - [2024] The Last.Backend authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package ratelimit implements rate limiters shared by all replicas of a service.
+//
+// Every limiter is a single Lua script reading the clock of the redis server,
+// so replicas with drifting clocks still count against the same windows.
+// Keys are wrapped in a hash tag to keep working in cluster mode.
+//
+//	limiter := ratelimit.NewGCRA(redisPlugin.Client(), ratelimit.PerSecond(10), nil)
+//	res, err := limiter.Allow(ctx, "user:"+id)
+//	if err == nil && !res.Allowed {
+//		return status.Errorf(codes.ResourceExhausted, "retry in %s", res.RetryAfter)
+//	}
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const defaultPrefix = "ratelimit"
+
+// Limit is the number of requests allowed in a period, Burst applies to GCRA only
+type Limit struct {
+	Rate   int
+	Period time.Duration
+	Burst  int
+}
+
+func PerSecond(rate int) Limit {
+	return Limit{Rate: rate, Period: time.Second, Burst: rate}
+}
+
+func PerMinute(rate int) Limit {
+	return Limit{Rate: rate, Period: time.Minute, Burst: rate}
+}
+
+func PerHour(rate int) Limit {
+	return Limit{Rate: rate, Period: time.Hour, Burst: rate}
+}
+
+type Result struct {
+	// Limit is the limit the request was checked against
+	Limit Limit
+	// Allowed reports whether the request fits the limit
+	Allowed bool
+	// Remaining is the number of requests left in the limit
+	Remaining int
+	// RetryAfter is the time until the denied request would be allowed, 0 when allowed.
+	// It is negative when the request exceeds the limit and can never be allowed.
+	RetryAfter time.Duration
+	// ResetAfter is the time until the limit is fully available again
+	ResetAfter time.Duration
+}
+
+type Limiter interface {
+	// Allow takes one request from the limit of the key
+	Allow(ctx context.Context, key string) (*Result, error)
+	// AllowN takes n requests from the limit of the key, none are taken when they do not fit
+	AllowN(ctx context.Context, key string, n int) (*Result, error)
+}
+
+type Options struct {
+	// Prefix of the keys, default is "ratelimit"
+	Prefix string
+}
+
+// slidingLogScript counts the requests of the last period in a sorted set
+var slidingLogScript = redis.NewScript(`
+redis.replicate_commands()
+
+local key = KEYS[1]
+local limit = tonumber(ARGV[1])
+local period = tonumber(ARGV[2])
+local n = tonumber(ARGV[3])
+local nonce = ARGV[4]
+
+local t = redis.call("TIME")
+local now = tonumber(t[1]) * 1000000 + tonumber(t[2])
+
+redis.call("ZREMRANGEBYSCORE", key, "-inf", now - period)
+local count = redis.call("ZCARD", key)
+
+if count + n > limit then
+	local retry_after = -1
+	if n <= limit then
+		-- the request fits once the oldest requests exceeding the limit leave the window
+		local oldest = redis.call("ZRANGE", key, count + n - limit - 1, count + n - limit - 1, "WITHSCORES")
+		retry_after = tonumber(oldest[2]) + period - now
+	end
+	local newest = redis.call("ZRANGE", key, -1, -1, "WITHSCORES")
+	local reset_after = 0
+	if newest[2] then
+		reset_after = tonumber(newest[2]) + period - now
+	end
+	return {0, limit - count, retry_after, reset_after}
+end
+
+for i = 1, n do
+	redis.call("ZADD", key, now, now .. ":" .. nonce .. ":" .. i)
+end
+redis.call("PEXPIRE", key, math.ceil(period / 1000))
+
+return {1, limit - count - n, 0, period}
+`)
+
+// fixedWindowScript counts the requests in a window starting with the first request
+var fixedWindowScript = redis.NewScript(`
+local key = KEYS[1]
+local limit = tonumber(ARGV[1])
+local period = tonumber(ARGV[2])
+local n = tonumber(ARGV[3])
+
+local count = tonumber(redis.call("GET", key) or "0")
+local ttl = redis.call("PTTL", key)
+if ttl < 0 then
+	count = 0
+	ttl = period
+end
+
+if count + n > limit then
+	local retry_after = ttl
+	if n > limit then
+		retry_after = -1
+	end
+	return {0, limit - count, retry_after, ttl}
+end
+
+count = redis.call("INCRBY", key, n)
+if count == n then
+	redis.call("PEXPIRE", key, period)
+end
+
+return {1, limit - count, 0, ttl}
+`)
+
+// gcraScript implements the generic cell rate algorithm, it stores the theoretical
+// arrival time of the next request, in microseconds
+var gcraScript = redis.NewScript(`
+redis.replicate_commands()
+
+local key = KEYS[1]
+local rate = tonumber(ARGV[1])
+local period = tonumber(ARGV[2])
+local burst = tonumber(ARGV[3])
+local n = tonumber(ARGV[4])
+
+local t = redis.call("TIME")
+local now = tonumber(t[1]) * 1000000 + tonumber(t[2])
+
+local interval = period / rate
+local increment = interval * n
+local burst_offset = interval * burst
+
+local tat = tonumber(redis.call("GET", key) or "0")
+if tat < now then
+	tat = now
+end
+
+local new_tat = tat + increment
+local diff = now - (new_tat - burst_offset)
+-- the epsilon absorbs the rounding of fractional intervals
+local remaining = math.floor(diff / interval + 1e-6)
+
+if remaining < 0 then
+	local retry_after = -diff
+	if increment > burst_offset then
+		retry_after = -1
+	end
+	return {0, math.floor((now - (tat - burst_offset)) / interval + 1e-6), math.ceil(retry_after), math.ceil(tat - now)}
+end
+
+local reset_after = new_tat - now
+redis.call("SET", key, string.format("%d", new_tat), "PX", math.ceil(reset_after / 1000))
+
+return {1, remaining, 0, math.ceil(reset_after)}
+`)
+
+type limiter struct {
+	client redis.UniversalClient
+	limit  Limit
+	prefix string
+	run    func(ctx context.Context, key string, n int) ([]interface{}, error)
+	// unit is the time unit of the durations returned by the script
+	unit time.Duration
+}
+
+// NewSlidingLog returns a limiter counting the requests of the last period exactly.
+// It stores every request, so it suits low limits.
+func NewSlidingLog(client redis.UniversalClient, limit Limit, opts *Options) Limiter {
+	l := newLimiter(client, limit, opts, time.Microsecond)
+	l.run = func(ctx context.Context, key string, n int) ([]interface{}, error) {
+		// the nonce keeps the members of concurrent requests in the same microsecond apart
+		nonce := rand.Int63()
+		return slidingLogScript.Run(ctx, l.client, []string{key}, limit.Rate, limit.Period.Microseconds(), n, nonce).Slice()
+	}
+	return l
+}
+
+// NewFixedWindow returns a limiter counting the requests in windows of the period,
+// started by the first request. It allows up to twice the rate around the window edge.
+func NewFixedWindow(client redis.UniversalClient, limit Limit, opts *Options) Limiter {
+	l := newLimiter(client, limit, opts, time.Millisecond)
+	l.run = func(ctx context.Context, key string, n int) ([]interface{}, error) {
+		return fixedWindowScript.Run(ctx, l.client, []string{key}, limit.Rate, limit.Period.Milliseconds(), n).Slice()
+	}
+	return l
+}
+
+// NewGCRA returns a limiter spreading the requests evenly over the period with bursts
+// of up to Burst requests. It stores a single value per key.
+func NewGCRA(client redis.UniversalClient, limit Limit, opts *Options) Limiter {
+	if limit.Burst <= 0 {
+		limit.Burst = 1
+	}
+	l := newLimiter(client, limit, opts, time.Microsecond)
+	l.run = func(ctx context.Context, key string, n int) ([]interface{}, error) {
+		return gcraScript.Run(ctx, l.client, []string{key}, limit.Rate, limit.Period.Microseconds(), limit.Burst, n).Slice()
+	}
+	return l
+}
+
+func newLimiter(client redis.UniversalClient, limit Limit, opts *Options, unit time.Duration) *limiter {
+	l := &limiter{client: client, limit: limit, prefix: defaultPrefix, unit: unit}
+	if opts != nil && opts.Prefix != "" {
+		l.prefix = opts.Prefix
+	}
+	return l
+}
+
+func (l *limiter) Allow(ctx context.Context, key string) (*Result, error) {
+	return l.AllowN(ctx, key, 1)
+}
+
+func (l *limiter) AllowN(ctx context.Context, key string, n int) (*Result, error) {
+	if l.limit.Rate <= 0 || l.limit.Period <= 0 {
+		return nil, errors.New("ratelimit: rate and period must be positive")
+	}
+
+	// the hash tag keeps the keys of a caller in one slot of a cluster
+	res, err := l.run(ctx, l.prefix+":{"+key+"}", n)
+	if err != nil {
+		return nil, err
+	}
+	if len(res) != 4 {
+		return nil, errors.New("ratelimit: unexpected script result")
+	}
+
+	r := &Result{
+		Limit:      l.limit,
+		Allowed:    res[0].(int64) == 1,
+		Remaining:  int(res[1].(int64)),
+		RetryAfter: time.Duration(res[2].(int64)) * l.unit,
+		ResetAfter: time.Duration(res[3].(int64)) * l.unit,
+	}
+	if r.Remaining < 0 {
+		r.Remaining = 0
+	}
+	return r, nil
+}
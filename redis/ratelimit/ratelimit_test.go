@@ -0,0 +1,193 @@
+/*
+Copyright [2014] - [2024] The Last.Backend authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+type step struct {
+	// after advances the server clock before the call
+	after         time.Duration
+	n             int
+	allowed       bool
+	remaining     int
+	retryPositive bool
+	retryNever    bool
+}
+
+func runSteps(t *testing.T, newLimiter func(client redis.UniversalClient) Limiter, steps []step) {
+	t.Helper()
+
+	s := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: s.Addr()})
+	t.Cleanup(func() { _ = client.Close() })
+
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	s.SetTime(now)
+
+	l := newLimiter(client)
+
+	for i, st := range steps {
+		if st.after > 0 {
+			now = now.Add(st.after)
+			s.SetTime(now)
+			s.FastForward(st.after)
+		}
+
+		n := st.n
+		if n == 0 {
+			n = 1
+		}
+
+		res, err := l.AllowN(context.Background(), "user:1", n)
+		if err != nil {
+			t.Fatalf("step %d: %v", i, err)
+		}
+		if res.Allowed != st.allowed || res.Remaining != st.remaining {
+			t.Fatalf("step %d: got allowed %t, remaining %d, want %t, %d", i, res.Allowed, res.Remaining, st.allowed, st.remaining)
+		}
+		switch {
+		case st.retryNever && res.RetryAfter >= 0:
+			t.Fatalf("step %d: retry after %s, want never", i, res.RetryAfter)
+		case st.retryPositive && res.RetryAfter <= 0:
+			t.Fatalf("step %d: retry after %s, want positive", i, res.RetryAfter)
+		case st.allowed && res.RetryAfter != 0:
+			t.Fatalf("step %d: retry after %s for an allowed request", i, res.RetryAfter)
+		}
+	}
+}
+
+func TestLimiters(t *testing.T) {
+	limit := Limit{Rate: 3, Period: time.Second, Burst: 3}
+
+	tests := []struct {
+		name  string
+		new   func(client redis.UniversalClient) Limiter
+		steps []step
+	}{
+		{
+			name: "sliding log",
+			new:  func(c redis.UniversalClient) Limiter { return NewSlidingLog(c, limit, nil) },
+			steps: []step{
+				{allowed: true, remaining: 2},
+				{after: 400 * time.Millisecond, allowed: true, remaining: 1},
+				{allowed: true, remaining: 0},
+				{allowed: false, remaining: 0, retryPositive: true},
+				// the first request leaves the window
+				{after: 700 * time.Millisecond, allowed: true, remaining: 0},
+				{n: 4, allowed: false, remaining: 0, retryNever: true},
+			},
+		},
+		{
+			name: "sliding log batch",
+			new:  func(c redis.UniversalClient) Limiter { return NewSlidingLog(c, limit, nil) },
+			steps: []step{
+				{n: 2, allowed: true, remaining: 1},
+				{n: 2, allowed: false, remaining: 1, retryPositive: true},
+				{n: 1, allowed: true, remaining: 0},
+			},
+		},
+		{
+			name: "fixed window",
+			new:  func(c redis.UniversalClient) Limiter { return NewFixedWindow(c, limit, nil) },
+			steps: []step{
+				{allowed: true, remaining: 2},
+				{after: 400 * time.Millisecond, allowed: true, remaining: 1},
+				{allowed: true, remaining: 0},
+				{allowed: false, remaining: 0, retryPositive: true},
+				// the window started by the first request ends
+				{after: 700 * time.Millisecond, allowed: true, remaining: 2},
+				{n: 4, allowed: false, remaining: 2, retryNever: true},
+			},
+		},
+		{
+			name: "gcra",
+			new:  func(c redis.UniversalClient) Limiter { return NewGCRA(c, limit, nil) },
+			steps: []step{
+				{allowed: true, remaining: 2},
+				{allowed: true, remaining: 1},
+				{allowed: true, remaining: 0},
+				{allowed: false, remaining: 0, retryPositive: true},
+				// one request is released every third of a second
+				{after: 340 * time.Millisecond, allowed: true, remaining: 0},
+				{after: 700 * time.Millisecond, allowed: true, remaining: 1},
+				{n: 4, allowed: false, remaining: 1, retryNever: true},
+			},
+		},
+		{
+			name: "gcra without burst",
+			new: func(c redis.UniversalClient) Limiter {
+				return NewGCRA(c, Limit{Rate: 2, Period: time.Second}, nil)
+			},
+			steps: []step{
+				{allowed: true, remaining: 0},
+				{allowed: false, remaining: 0, retryPositive: true},
+				{after: 500 * time.Millisecond, allowed: true, remaining: 0},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runSteps(t, tt.new, tt.steps)
+		})
+	}
+}
+
+func TestLimiterKeys(t *testing.T) {
+	s := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: s.Addr()})
+	defer client.Close()
+
+	tests := []struct {
+		name string
+		l    Limiter
+		want string
+	}{
+		{name: "default prefix", l: NewFixedWindow(client, PerMinute(1), nil), want: "ratelimit:{user:1}"},
+		{name: "prefix", l: NewFixedWindow(client, PerMinute(1), &Options{Prefix: "api"}), want: "api:{user:1}"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := tt.l.Allow(context.Background(), "user:1"); err != nil {
+				t.Fatal(err)
+			}
+			if !s.Exists(tt.want) {
+				t.Errorf("%s does not exist, keys are %v", tt.want, s.Keys())
+			}
+		})
+	}
+}
+
+func TestInvalidLimit(t *testing.T) {
+	s := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: s.Addr()})
+	defer client.Close()
+
+	for _, limit := range []Limit{{Rate: 0, Period: time.Second}, {Rate: 1}} {
+		if _, err := NewFixedWindow(client, limit, nil).Allow(context.Background(), "user:1"); err == nil {
+			t.Errorf("got nil for %+v, want an error", limit)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+/*
+Copyright [2014] - [2024] The Last.Backend authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package redistest starts redis test plugins on an in-process server,
+// so the services importing the redis plugin do not link the server.
+//
+//	func TestOrders(t *testing.T) {
+//		p := redistest.NewPlugin(t, redis.TestConfig{})
+//		...
+//	}
+package redistest
+
+import (
+	"context"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/lastbackend/toolkit-plugins/redis"
+)
+
+// NewServer starts an in-process server, it is closed when the test ends
+func NewServer(t testing.TB) *miniredis.Miniredis {
+	t.Helper()
+	return miniredis.RunT(t)
+}
+
+// NewPlugin creates a test plugin on a new in-process server, unless cfg has a server.
+// The plugin is closed when the test ends.
+func NewPlugin(t testing.TB, cfg redis.TestConfig) redis.TestPlugin {
+	t.Helper()
+
+	if cfg.Server == nil {
+		cfg.Server = NewServer(t)
+	}
+
+	p, err := redis.NewTestPlugin(context.Background(), cfg)
+	if err != nil {
+		t.Fatalf("can not create redis test plugin: %v", err)
+	}
+
+	t.Cleanup(func() {
+		if err := p.Close(context.Background()); err != nil {
+			t.Errorf("can not close redis test plugin: %v", err)
+		}
+	})
+
+	return p
+}
@@ -0,0 +1,239 @@
+/*
+Copyright [2014] - [2024] The Last.Backend authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package redistest_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/lastbackend/toolkit-plugins/redis"
+	"github.com/lastbackend/toolkit-plugins/redis/redistest"
+)
+
+// eventually waits for the condition, the subsystems run in the background
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestNewPlugin(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name    string
+		cfg     redis.TestConfig
+		wantKey string
+	}{
+		{name: "default", wantKey: "orders:1"},
+		{
+			name:    "key prefix",
+			cfg:     redis.TestConfig{Config: redis.Config{KeyPrefixEnabled: true}, Service: "orders"},
+			wantKey: "orders:orders:1",
+		},
+		{
+			name:    "key prefix and tag",
+			cfg:     redis.TestConfig{Config: redis.Config{KeyPrefixEnabled: true, KeyPrefixHashTag: true, KeyPrefix: "svc"}},
+			wantKey: "{svc}:orders:1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := redistest.NewServer(t)
+			tt.cfg.Server = s
+			p := redistest.NewPlugin(t, tt.cfg)
+
+			if p.Endpoint() != s.Addr() {
+				t.Errorf("endpoint: got %s, want %s", p.Endpoint(), s.Addr())
+			}
+
+			if err := p.Client().Set(ctx, "orders:1", "1", time.Minute).Err(); err != nil {
+				t.Fatal(err)
+			}
+			if !s.Exists(tt.wantKey) {
+				t.Fatalf("got keys %v, want %s", s.Keys(), tt.wantKey)
+			}
+
+			if err := p.FastForward(time.Minute); err != nil {
+				t.Fatal(err)
+			}
+			if n, err := p.Client().Exists(ctx, "orders:1").Result(); err != nil || n != 0 {
+				t.Errorf("exists after the ttl: got %d, %v, want 0", n, err)
+			}
+
+			if err := p.Client().Set(ctx, "orders:2", "1", 0).Err(); err != nil {
+				t.Fatal(err)
+			}
+			if err := p.Flush(ctx); err != nil {
+				t.Fatal(err)
+			}
+			if keys := s.Keys(); len(keys) != 0 {
+				t.Errorf("keys after flush: got %v", keys)
+			}
+		})
+	}
+}
+
+func TestNewTestPluginInvalid(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name string
+		cfg  redis.Config
+	}{
+		{name: "overflow", cfg: redis.Config{PubSubOverflow: "drop_all"}},
+		{name: "codec", cfg: redis.Config{PubSubCodec: "xml"}},
+		{name: "prefix", cfg: redis.Config{KeyPrefixEnabled: true, KeyPrefix: "{svc}"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := redis.NewTestPlugin(ctx, redis.TestConfig{Config: tt.cfg, Server: redistest.NewServer(t)})
+			if err == nil {
+				_ = p.Close(ctx)
+				t.Fatal("got nil, want an error")
+			}
+		})
+	}
+}
+
+func TestTimeTravel(t *testing.T) {
+	ctx := context.Background()
+
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	p := redistest.NewPlugin(t, redis.TestConfig{})
+	if err := p.SetTime(now); err != nil {
+		t.Fatal(err)
+	}
+	got, err := p.Client().Time(ctx).Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.Equal(now) {
+		t.Errorf("time: got %s, want %s", got, now)
+	}
+}
+
+func TestSubsystems(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	p := redistest.NewPlugin(t, redis.TestConfig{
+		Config: redis.Config{
+			StreamBlock:           10 * time.Millisecond,
+			JobsPollInterval:      10 * time.Millisecond,
+			ElectionTTL:           time.Second,
+			ElectionRenewInterval: 100 * time.Millisecond,
+		},
+		Service: "orders",
+	})
+
+	t.Run("pubsub", func(t *testing.T) {
+		type order struct{ ID int }
+		got := make(chan order, 1)
+		sub, err := p.Subscribe(ctx, []string{"orders.*"}, redis.Typed(func(_ context.Context, _ string, v order) error {
+			got <- v
+			return nil
+		}), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer sub.Close()
+
+		// the subscription is confirmed in the background, publish until it is
+		deadline := time.After(5 * time.Second)
+		for {
+			if err := p.Publish(ctx, "orders.created", order{ID: 42}); err != nil {
+				t.Fatal(err)
+			}
+			select {
+			case v := <-got:
+				if v.ID != 42 {
+					t.Errorf("got %d, want 42", v.ID)
+				}
+				return
+			case <-time.After(20 * time.Millisecond):
+			case <-deadline:
+				t.Fatal("timed out waiting for the message")
+			}
+		}
+	})
+
+	t.Run("streams", func(t *testing.T) {
+		got := make(chan string, 1)
+		sub, err := p.Streams().Subscribe("orders", "created", func(ctx context.Context, payload []byte) {
+			got <- string(payload)
+			_ = p.Streams().Ack(ctx)
+		}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer sub.Unsubscribe()
+
+		if err := p.Streams().Publish(ctx, "created", []byte("42"), nil); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case v := <-got:
+			if v != "42" {
+				t.Errorf("got %s, want 42", v)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for the entry")
+		}
+	})
+
+	t.Run("election", func(t *testing.T) {
+		e := p.Election("scheduler")
+		eventually(t, "the election", e.IsLeader)
+		if e.Term() <= 0 {
+			t.Errorf("term: got %d, want a positive token", e.Term())
+		}
+		if err := e.Resign(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if e.IsLeader() {
+			t.Error("leader after resigning")
+		}
+	})
+
+	t.Run("jobs", func(t *testing.T) {
+		got := make(chan string, 1)
+		p.Jobs().Handle("email", func(_ context.Context, job *redis.Job) error {
+			got <- string(job.Payload)
+			return nil
+		})
+		if _, err := p.Jobs().Enqueue(ctx, "email", []byte("hello"), nil); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case v := <-got:
+			if v != "hello" {
+				t.Errorf("got %s, want hello", v)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for the job")
+		}
+	})
+}
@@ -0,0 +1,107 @@
+/*
+Copyright [2014] - [2024] The Last.Backend authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package redis
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	RingHashRendezvous = "rendezvous"
+	RingHashKetama     = "ketama"
+
+	// ketamaReplicas is the number of points of every shard on the ring
+	ketamaReplicas = 160
+)
+
+// ketama is a consistent hash ring with virtual nodes. Unlike rendezvous
+// hashing, used by go-redis by default, its lookups do not depend on the
+// number of shards. The points are xxhash sums, not the MD5 of classic ketama,
+// so the key distribution matches only other instances of this plugin.
+type ketama struct {
+	points []uint64
+	shards map[uint64]string
+}
+
+func newKetama(shards []string) redis.ConsistentHash {
+	k := &ketama{
+		points: make([]uint64, 0, len(shards)*ketamaReplicas),
+		shards: make(map[uint64]string, len(shards)*ketamaReplicas),
+	}
+
+	for _, shard := range shards {
+		for i := 0; i < ketamaReplicas; i++ {
+			point := xxhash.Sum64String(fmt.Sprintf("%s-%d", shard, i))
+			k.points = append(k.points, point)
+			k.shards[point] = shard
+		}
+	}
+
+	sort.Slice(k.points, func(i, j int) bool { return k.points[i] < k.points[j] })
+
+	return k
+}
+
+func (k *ketama) Get(key string) string {
+	if len(k.points) == 0 {
+		return ""
+	}
+
+	hash := xxhash.Sum64String(key)
+	i := sort.Search(len(k.points), func(i int) bool { return k.points[i] >= hash })
+	if i == len(k.points) {
+		i = 0
+	}
+
+	return k.shards[k.points[i]]
+}
+
+func ringHash(name string) (func(shards []string) redis.ConsistentHash, error) {
+	switch strings.ToLower(name) {
+	case "", RingHashRendezvous:
+		// nil keeps the go-redis default
+		return nil, nil
+	case RingHashKetama:
+		return newKetama, nil
+	default:
+		return nil, fmt.Errorf("unknown ring hash %q, expected %s or %s", name, RingHashRendezvous, RingHashKetama)
+	}
+}
+
+// ringShards parses name=host:port pairs, shards without a name are named by their address
+func ringShards(endpoint string) (map[string]string, error) {
+	shards := make(map[string]string)
+
+	for _, shard := range splitEndpoint(endpoint) {
+		name, addr := shard, shard
+		if parts := strings.SplitN(shard, "=", 2); len(parts) == 2 {
+			name, addr = parts[0], parts[1]
+		}
+
+		if _, ok := shards[name]; ok {
+			return nil, fmt.Errorf("duplicate ring shard %s", name)
+		}
+		shards[name] = addr
+	}
+
+	return shards, nil
+}
@@ -0,0 +1,141 @@
+/*
+Copyright [2014] - [2024] The Last.Backend authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package redis
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestKetama(t *testing.T) {
+	tests := []struct {
+		name   string
+		shards []string
+	}{
+		{name: "one shard", shards: []string{"a"}},
+		{name: "three shards", shards: []string{"a", "b", "c"}},
+		{name: "ten shards", shards: []string{"a", "b", "c", "d", "e", "f", "g", "h", "i", "j"}},
+	}
+
+	const keys = 20000
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ring := newKetama(tt.shards)
+
+			counts := make(map[string]int)
+			for i := 0; i < keys; i++ {
+				counts[ring.Get(fmt.Sprintf("key:%d", i))]++
+			}
+
+			// every shard gets its share of the keys within a half of it
+			share := keys / len(tt.shards)
+			for _, shard := range tt.shards {
+				if n := counts[shard]; n < share/2 || n > share*3/2 {
+					t.Errorf("shard %s got %d keys, want about %d", shard, n, share)
+				}
+			}
+			if len(counts) != len(tt.shards) {
+				t.Errorf("keys went to %v, want only %v", counts, tt.shards)
+			}
+		})
+	}
+}
+
+func TestKetamaStability(t *testing.T) {
+	tests := []struct {
+		name          string
+		before, after []string
+		// moved is the shard the moved keys may go to or come from
+		moved string
+	}{
+		{name: "shard added", before: []string{"a", "b", "c"}, after: []string{"a", "b", "c", "d"}, moved: "d"},
+		{name: "shard removed", before: []string{"a", "b", "c", "d"}, after: []string{"a", "b", "c"}, moved: "d"},
+		{name: "order does not matter", before: []string{"a", "b", "c"}, after: []string{"c", "a", "b"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before, after := newKetama(tt.before), newKetama(tt.after)
+
+			for i := 0; i < 10000; i++ {
+				key := fmt.Sprintf("key:%d", i)
+				b, a := before.Get(key), after.Get(key)
+				if b != a && b != tt.moved && a != tt.moved {
+					t.Fatalf("key %s moved from %s to %s", key, b, a)
+				}
+			}
+		})
+	}
+}
+
+func TestKetamaEmpty(t *testing.T) {
+	if shard := newKetama(nil).Get("key"); shard != "" {
+		t.Errorf("got %q, want no shard", shard)
+	}
+}
+
+func TestRingHash(t *testing.T) {
+	tests := []struct {
+		name    string
+		wantNil bool
+		wantErr bool
+	}{
+		{name: "", wantNil: true},
+		{name: "rendezvous", wantNil: true},
+		{name: "KETAMA"},
+		{name: "maglev", wantNil: true, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fn, err := ringHash(tt.name)
+			if (err != nil) != tt.wantErr || (fn == nil) != tt.wantNil {
+				t.Errorf("got %v, %v, want nil %t, error %t", fn != nil, err, tt.wantNil, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRingShards(t *testing.T) {
+	tests := []struct {
+		endpoint string
+		want     map[string]string
+		wantErr  bool
+	}{
+		{endpoint: "a=10.0.0.1:6379,b=10.0.0.2:6379", want: map[string]string{"a": "10.0.0.1:6379", "b": "10.0.0.2:6379"}},
+		{endpoint: "10.0.0.1:6379", want: map[string]string{"10.0.0.1:6379": "10.0.0.1:6379"}},
+		{endpoint: "a=10.0.0.1:6379,a=10.0.0.2:6379", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.endpoint, func(t *testing.T) {
+			got, err := ringShards(tt.endpoint)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error: got %v, want error %t", err, tt.wantErr)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+			for k, v := range tt.want {
+				if got[k] != v {
+					t.Errorf("got %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,528 @@
+/*
+Copyright [2014] - [2024] The Last.Backend authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package redis
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lastbackend/toolkit/pkg/runtime/logger"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	streamFieldEvent   = "event"
+	streamFieldPayload = "payload"
+	streamHeaderPrefix = "h:"
+)
+
+type streamAck struct{}
+type streamReject struct{}
+
+// StreamHandler receives the payload of an event, the headers are passed in ctx under the "headers" key
+type StreamHandler func(ctx context.Context, payload []byte)
+
+type StreamPublishOptions struct {
+	Headers map[string]string
+	// MaxLen overrides STREAM_MAX_LEN for this event
+	MaxLen int64
+}
+
+type StreamSubscribeOptions struct {
+	// ManualAck leaves entries pending until the handler calls Ack,
+	// unacknowledged entries are delivered again after STREAM_CLAIM_MIN_IDLE
+	ManualAck bool
+}
+
+type StreamSubscriber interface {
+	Unsubscribe() error
+}
+
+// Streams is an event broker on Redis Streams. Every service publishes to its own stream,
+// subscribers of a service share a consumer group, so each event is handled once per service.
+type Streams interface {
+	// Publish appends the event to the stream of this service
+	Publish(ctx context.Context, event string, payload []byte, opts *StreamPublishOptions) error
+	// Subscribe handles the event published by the service
+	Subscribe(service, event string, handler StreamHandler, opts *StreamSubscribeOptions) (StreamSubscriber, error)
+	// Ack acknowledges the entry passed to the handler with ctx
+	Ack(ctx context.Context) error
+	// Reject leaves the entry passed to the handler with ctx pending, it is delivered
+	// again after STREAM_CLAIM_MIN_IDLE and dead-lettered after STREAM_MAX_DELIVERIES
+	Reject(ctx context.Context) error
+}
+
+type streamOptions struct {
+	MaxLen        int64
+	Block         time.Duration
+	BatchSize     int64
+	ClaimMinIdle  time.Duration
+	MaxDeliveries int64
+}
+
+type streams struct {
+	log      logger.Logger
+	client   redis.UniversalClient
+	service  string
+	consumer string
+	opts     streamOptions
+
+	mtx     sync.Mutex
+	readers map[string]*streamReader
+}
+
+func newStreams(log logger.Logger, client redis.UniversalClient, service string, opts streamOptions) *streams {
+	return &streams{
+		log:      log,
+		client:   client,
+		service:  service,
+		consumer: consumerName(),
+		opts:     opts,
+		readers:  make(map[string]*streamReader),
+	}
+}
+
+func streamKey(service string) string {
+	return fmt.Sprintf("%s:events", service)
+}
+
+func (s *streams) Publish(ctx context.Context, event string, payload []byte, opts *StreamPublishOptions) error {
+	if opts == nil {
+		opts = new(StreamPublishOptions)
+	}
+
+	values := []interface{}{streamFieldEvent, event, streamFieldPayload, payload}
+	for k, v := range opts.Headers {
+		values = append(values, streamHeaderPrefix+k, v)
+	}
+
+	maxLen := s.opts.MaxLen
+	if opts.MaxLen > 0 {
+		maxLen = opts.MaxLen
+	}
+
+	return s.client.XAdd(ctx, &redis.XAddArgs{
+		Stream: streamKey(s.service),
+		MaxLen: maxLen,
+		Approx: true,
+		Values: values,
+	}).Err()
+}
+
+func (s *streams) Subscribe(service, event string, handler StreamHandler, opts *StreamSubscribeOptions) (StreamSubscriber, error) {
+	if opts == nil {
+		opts = new(StreamSubscribeOptions)
+	}
+
+	stream := streamKey(service)
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	r, ok := s.readers[stream]
+	if !ok {
+		r = &streamReader{
+			streams:  s,
+			stream:   stream,
+			group:    s.service,
+			handlers: make(map[string][]*streamSubscription),
+		}
+		if err := r.createGroup(context.Background()); err != nil {
+			return nil, err
+		}
+		r.start()
+		s.readers[stream] = r
+	}
+
+	sub := &streamSubscription{reader: r, event: event, handler: handler, opts: *opts}
+	r.add(sub)
+
+	return sub, nil
+}
+
+func (s *streams) Ack(ctx context.Context) error {
+	fn, ok := ctx.Value(streamAck{}).(func() error)
+	if !ok {
+		return errors.New("no acknowledged")
+	}
+	return fn()
+}
+
+func (s *streams) Reject(ctx context.Context) error {
+	fn, ok := ctx.Value(streamReject{}).(func() error)
+	if !ok {
+		return errors.New("no rejected")
+	}
+	return fn()
+}
+
+// close stops the readers and waits for the handlers in progress
+func (s *streams) close(ctx context.Context) error {
+	s.mtx.Lock()
+	readers := make([]*streamReader, 0, len(s.readers))
+	for _, r := range s.readers {
+		readers = append(readers, r)
+	}
+	s.readers = make(map[string]*streamReader)
+	s.mtx.Unlock()
+
+	for _, r := range readers {
+		if err := r.stop(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type streamSubscription struct {
+	reader  *streamReader
+	event   string
+	handler StreamHandler
+	opts    StreamSubscribeOptions
+}
+
+func (s *streamSubscription) Unsubscribe() error {
+	r := s.reader
+
+	r.streams.mtx.Lock()
+	last := r.remove(s)
+	if last && r.streams.readers[r.stream] == r {
+		delete(r.streams.readers, r.stream)
+	}
+	r.streams.mtx.Unlock()
+
+	if last {
+		return r.stop(context.Background())
+	}
+	return nil
+}
+
+// streamReader consumes one stream within the consumer group of the service
+// and dispatches the entries to the subscriptions by event name
+type streamReader struct {
+	streams *streams
+	stream  string
+	group   string
+
+	mtx      sync.RWMutex
+	handlers map[string][]*streamSubscription
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func (r *streamReader) add(sub *streamSubscription) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.handlers[sub.event] = append(r.handlers[sub.event], sub)
+}
+
+// remove returns true when the last subscription is removed
+func (r *streamReader) remove(sub *streamSubscription) bool {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	subs := r.handlers[sub.event]
+	for i, s := range subs {
+		if s == sub {
+			r.handlers[sub.event] = append(subs[:i], subs[i+1:]...)
+			break
+		}
+	}
+	if len(r.handlers[sub.event]) == 0 {
+		delete(r.handlers, sub.event)
+	}
+	return len(r.handlers) == 0
+}
+
+func (r *streamReader) subscriptions(event string) []*streamSubscription {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	return append([]*streamSubscription(nil), r.handlers[event]...)
+}
+
+// createGroup creates the group reading new entries only, an existing group is kept
+func (r *streamReader) createGroup(ctx context.Context) error {
+	err := r.streams.client.XGroupCreateMkStream(ctx, r.stream, r.group, "$").Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return err
+	}
+	return nil
+}
+
+func (r *streamReader) start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	r.cancel = cancel
+	r.done = make(chan struct{})
+	go r.run(ctx)
+}
+
+func (r *streamReader) stop(ctx context.Context) error {
+	r.cancel()
+
+	select {
+	case <-r.done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	// the consumer is removed from the group only without pending entries,
+	// removing it would drop them
+	pending, err := r.streams.client.XPendingExt(ctx, &redis.XPendingExtArgs{
+		Stream:   r.stream,
+		Group:    r.group,
+		Start:    "-",
+		End:      "+",
+		Count:    1,
+		Consumer: r.streams.consumer,
+	}).Result()
+	if err == nil && len(pending) == 0 {
+		return r.streams.client.XGroupDelConsumer(ctx, r.stream, r.group, r.streams.consumer).Err()
+	}
+	return nil
+}
+
+func (r *streamReader) run(ctx context.Context) {
+	defer close(r.done)
+
+	var claimed time.Time
+
+	for ctx.Err() == nil {
+		if time.Since(claimed) >= r.streams.opts.ClaimMinIdle {
+			r.claim(ctx)
+			claimed = time.Now()
+		}
+
+		res, err := r.streams.client.XReadGroup(ctx, &redis.XReadGroupArgs{
+			Group:    r.group,
+			Consumer: r.streams.consumer,
+			Streams:  []string{r.stream, ">"},
+			Count:    r.streams.opts.BatchSize,
+			Block:    r.streams.opts.Block,
+		}).Result()
+		switch {
+		case ctx.Err() != nil:
+			return
+		case err == redis.Nil:
+			continue
+		case err != nil:
+			r.failed(ctx, err)
+			continue
+		}
+
+		for _, s := range res {
+			for _, msg := range s.Messages {
+				r.handle(msg)
+			}
+		}
+	}
+}
+
+// failed recreates the group removed with the stream, other errors are retried after a pause
+func (r *streamReader) failed(ctx context.Context, err error) {
+	if strings.HasPrefix(err.Error(), "NOGROUP") {
+		if err = r.createGroup(ctx); err == nil {
+			return
+		}
+	}
+
+	r.streams.log.Errorf("redis: can not read stream %s: %v", r.stream, err)
+
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+	}
+}
+
+// claim takes over the entries left pending by failed handlers and stopped consumers,
+// entries delivered too many times are moved to the dead-letter stream
+func (r *streamReader) claim(ctx context.Context) {
+	start := "0-0"
+	for {
+		msgs, next, err := r.streams.client.XAutoClaim(ctx, &redis.XAutoClaimArgs{
+			Stream:   r.stream,
+			Group:    r.group,
+			Consumer: r.streams.consumer,
+			MinIdle:  r.streams.opts.ClaimMinIdle,
+			Start:    start,
+			Count:    r.streams.opts.BatchSize,
+		}).Result()
+		if err != nil {
+			if ctx.Err() == nil && !strings.HasPrefix(err.Error(), "NOGROUP") {
+				r.streams.log.Errorf("redis: can not claim pending entries of stream %s: %v", r.stream, err)
+			}
+			return
+		}
+
+		if len(msgs) > 0 {
+			deliveries := r.deliveries(ctx, msgs)
+			for _, msg := range msgs {
+				if n := deliveries[msg.ID]; r.streams.opts.MaxDeliveries > 0 && n > r.streams.opts.MaxDeliveries {
+					r.deadLetter(ctx, msg, n)
+					continue
+				}
+				r.handle(msg)
+			}
+		}
+
+		if next == "0-0" || next == "" || ctx.Err() != nil {
+			return
+		}
+		start = next
+	}
+}
+
+// deliveries returns the delivery count of the claimed entries
+func (r *streamReader) deliveries(ctx context.Context, msgs []redis.XMessage) map[string]int64 {
+	counts := make(map[string]int64, len(msgs))
+
+	pending, err := r.streams.client.XPendingExt(ctx, &redis.XPendingExtArgs{
+		Stream:   r.stream,
+		Group:    r.group,
+		Start:    msgs[0].ID,
+		End:      msgs[len(msgs)-1].ID,
+		Count:    int64(len(msgs)),
+		Consumer: r.streams.consumer,
+	}).Result()
+	if err != nil {
+		r.streams.log.Errorf("redis: can not get pending entries of stream %s: %v", r.stream, err)
+		return counts
+	}
+
+	for _, p := range pending {
+		counts[p.ID] = p.RetryCount
+	}
+	return counts
+}
+
+func (r *streamReader) deadLetter(ctx context.Context, msg redis.XMessage, deliveries int64) {
+	values := make([]interface{}, 0, len(msg.Values)*2+6)
+	for k, v := range msg.Values {
+		values = append(values, k, v)
+	}
+	values = append(values, streamHeaderPrefix+"x-original-id", msg.ID,
+		streamHeaderPrefix+"x-group", r.group,
+		streamHeaderPrefix+"x-deliveries", deliveries)
+
+	dead := r.stream + ":dead"
+	if err := r.streams.client.XAdd(ctx, &redis.XAddArgs{Stream: dead, Values: values}).Err(); err != nil {
+		r.streams.log.Errorf("redis: can not move entry %s to %s: %v", msg.ID, dead, err)
+		return
+	}
+
+	r.streams.log.Warnf("redis: entry %s of stream %s moved to %s after %d deliveries", msg.ID, r.stream, dead, deliveries)
+
+	if err := r.ack(ctx, msg.ID); err != nil {
+		r.streams.log.Errorf("redis: can not ack entry %s of stream %s: %v", msg.ID, r.stream, err)
+	}
+}
+
+func (r *streamReader) ack(ctx context.Context, id string) error {
+	return r.streams.client.XAck(ctx, r.stream, r.group, id).Err()
+}
+
+// handle passes the entry to the subscriptions of its event. It is acknowledged when all
+// handlers return without Reject or a panic, unless a subscription acknowledges manually.
+// Entries of events without subscriptions are acknowledged right away.
+func (r *streamReader) handle(msg redis.XMessage) {
+	event, _ := msg.Values[streamFieldEvent].(string)
+	payload, _ := msg.Values[streamFieldPayload].(string)
+
+	headers := make(map[string]string)
+	for k, v := range msg.Values {
+		if strings.HasPrefix(k, streamHeaderPrefix) {
+			headers[strings.TrimPrefix(k, streamHeaderPrefix)] = fmt.Sprint(v)
+		}
+	}
+
+	var (
+		mtx    sync.Mutex
+		acked  bool
+		failed bool
+		manual bool
+	)
+
+	ack := func() error {
+		mtx.Lock()
+		defer mtx.Unlock()
+		if acked {
+			return nil
+		}
+		acked = true
+		return r.ack(context.Background(), msg.ID)
+	}
+	reject := func() error {
+		mtx.Lock()
+		defer mtx.Unlock()
+		failed = true
+		return nil
+	}
+
+	for _, sub := range r.subscriptions(event) {
+		manual = manual || sub.opts.ManualAck
+
+		ctx := context.WithValue(context.Background(), "headers", headers)
+		ctx = context.WithValue(ctx, streamAck{}, ack)
+		ctx = context.WithValue(ctx, streamReject{}, reject)
+
+		if r.call(ctx, sub.handler, event, []byte(payload)) {
+			_ = reject()
+		}
+	}
+
+	mtx.Lock()
+	settle := !failed && !manual
+	mtx.Unlock()
+
+	if settle {
+		if err := ack(); err != nil {
+			r.streams.log.Errorf("redis: can not ack entry %s of stream %s: %v", msg.ID, r.stream, err)
+		}
+	}
+}
+
+// call runs the handler and recovers its panic, the entry stays pending to be delivered again
+func (r *streamReader) call(ctx context.Context, h StreamHandler, event string, payload []byte) (panicked bool) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			panicked = true
+			r.streams.log.Errorf("redis: handler of %s panicked: %v\n%s", event, rec, debug.Stack())
+		}
+	}()
+
+	h(ctx, payload)
+	return false
+}
+
+// consumerName identifies the instance in the consumer groups
+func consumerName() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "consumer"
+	}
+	b := make([]byte, 4)
+	_, _ = rand.Read(b)
+	return fmt.Sprintf("%s-%s", host, hex.EncodeToString(b))
+}
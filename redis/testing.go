@@ -0,0 +1,358 @@
+/*
+Copyright [2014] - [2024] The Last.Backend authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package redis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/caarlos0/env/v7"
+	"github.com/lastbackend/toolkit/pkg/runtime/logger"
+	"github.com/lastbackend/toolkit/pkg/runtime/logger/empty"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/redis/go-redis/v9"
+)
+
+// testLockKey marks a database claimed by a test plugin with IsolationDatabase
+const testLockKey = "toolkit:test:lock"
+
+// ErrTimeTravel is returned by the time helpers of test plugins connected to an external server
+var ErrTimeTravel = errors.New("time travel requires an in-process server")
+
+// TestIsolation decides how a test plugin connected to an external server keeps tests apart
+type TestIsolation string
+
+const (
+	// IsolationPrefix namespaces all keys with the unique service name, see KEY_PREFIX_ENABLED
+	IsolationPrefix TestIsolation = "prefix"
+	// IsolationFlush flushes the database on start and on close
+	IsolationFlush TestIsolation = "flush"
+	// IsolationDatabase claims an empty database, it is flushed and released on close
+	IsolationDatabase TestIsolation = "database"
+)
+
+// TestServer is an in-process server, such as the one started by the redistest package
+type TestServer interface {
+	Addr() string
+	FlushAll()
+	FastForward(d time.Duration)
+	SetTime(t time.Time)
+	Close()
+}
+
+// TestConfig extends Config with additional testing-specific options.
+// The env defaults of Config are applied to the zero fields, except the booleans,
+// so a field can not be set to zero when its default is not, e.g. PubSubBuffer
+// or StreamMaxLen are always at least their defaults.
+type TestConfig struct {
+	Config
+
+	// Server is the in-process server the plugin connects to, it is closed with the plugin.
+	// Without a server the plugin connects to Endpoint.
+	Server TestServer
+	// Isolation applies to external servers, every in-process server is used by one plugin only.
+	// Default is IsolationPrefix.
+	Isolation TestIsolation
+	// Service is the service name the subsystems are namespaced with, default is a unique name
+	Service string
+	// Logger receives the logs of the subsystems, they are discarded by default
+	Logger logger.Logger
+}
+
+// TestPlugin is the plugin with helpers for tests
+type TestPlugin interface {
+	Plugin
+	// Endpoint returns the address of the server
+	Endpoint() string
+	// Flush removes all keys of the database
+	Flush(ctx context.Context) error
+	// FastForward decreases the TTL of all keys by the duration, expiring the keys whose TTL runs out
+	FastForward(d time.Duration) error
+	// SetTime sets the time returned by the TIME command, which is used by the rate limiters
+	SetTime(t time.Time) error
+	// Close stops the plugin and the in-process server, it must be called when the test ends
+	Close(ctx context.Context) error
+}
+
+type testPlugin struct {
+	*plugin
+	server    TestServer
+	isolation TestIsolation
+	once      sync.Once
+	closed    chan struct{}
+}
+
+// NewTestPlugin creates a plugin instance configured for testing, it does not need a runtime.
+// The plugin is closed by Close or when ctx is done. See the redistest package for
+// a plugin on an in-process server closed with the test.
+func NewTestPlugin(ctx context.Context, cfg TestConfig) (TestPlugin, error) {
+	if err := cfg.Config.setTestDefaults(); err != nil {
+		return nil, err
+	}
+
+	tp := &testPlugin{
+		server:    cfg.Server,
+		isolation: cfg.Isolation,
+		closed:    make(chan struct{}),
+	}
+	if tp.isolation == "" {
+		tp.isolation = IsolationPrefix
+	}
+
+	external := tp.server == nil
+	if !external {
+		cfg.Endpoint = tp.server.Addr()
+		cfg.Mode = ModeStandalone
+		cfg.Cluster = false
+		cfg.Database = 0
+	}
+
+	if cfg.Service == "" {
+		id, err := jobID()
+		if err != nil {
+			tp.stopServer()
+			return nil, err
+		}
+		cfg.Service = "test-" + id[:12]
+	}
+
+	if external && tp.isolation == IsolationPrefix {
+		cfg.KeyPrefixEnabled = true
+	}
+
+	if cfg.Logger == nil {
+		cfg.Logger = empty.NewLogger()
+	}
+
+	if external && tp.isolation == IsolationDatabase {
+		db, err := claimDatabase(ctx, cfg.Config)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Database = db
+	}
+
+	tp.plugin = &plugin{
+		prefix:     defaultPrefix,
+		opts:       cfg.Config,
+		service:    cfg.Service,
+		log:        cfg.Logger,
+		registerer: prometheus.NewRegistry(),
+	}
+
+	if err := tp.initPlugin(ctx); err != nil {
+		tp.stopServer()
+		if external && tp.isolation == IsolationDatabase {
+			if e := releaseDatabase(ctx, cfg.Config); e != nil {
+				cfg.Logger.Errorf("redis: can not release test database %d: %v", cfg.Database, e)
+			}
+		}
+		return nil, err
+	}
+
+	if external && tp.isolation == IsolationFlush {
+		if err := tp.Flush(ctx); err != nil {
+			_ = tp.Close(ctx)
+			return nil, err
+		}
+	}
+
+	// Handle cleanup on context cancellation
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-tp.closed:
+			return
+		}
+		if err := tp.Close(context.Background()); err != nil {
+			tp.log.Errorf("redis: can not close test plugin: %v", err)
+		}
+	}()
+
+	return tp, nil
+}
+
+func (tp *testPlugin) Endpoint() string {
+	return splitEndpoint(tp.opts.Endpoint)[0]
+}
+
+func (tp *testPlugin) Flush(ctx context.Context) error {
+	if tp.server != nil {
+		tp.server.FlushAll()
+		return nil
+	}
+
+	if cdb, ok := tp.client.(*redis.ClusterClient); ok {
+		return cdb.ForEachMaster(ctx, func(ctx context.Context, node *redis.Client) error {
+			return node.FlushDB(ctx).Err()
+		})
+	}
+	if rdb, ok := tp.client.(*redis.Ring); ok {
+		return rdb.ForEachShard(ctx, func(ctx context.Context, shard *redis.Client) error {
+			return shard.FlushDB(ctx).Err()
+		})
+	}
+	return tp.client.FlushDB(ctx).Err()
+}
+
+func (tp *testPlugin) FastForward(d time.Duration) error {
+	if tp.server == nil {
+		return ErrTimeTravel
+	}
+	tp.server.FastForward(d)
+	return nil
+}
+
+func (tp *testPlugin) SetTime(t time.Time) error {
+	if tp.server == nil {
+		return ErrTimeTravel
+	}
+	tp.server.SetTime(t)
+	return nil
+}
+
+func (tp *testPlugin) Close(ctx context.Context) error {
+	var err error
+	tp.once.Do(func() {
+		close(tp.closed)
+		// the database is flushed before the subsystems stop, they are not used anymore
+		if tp.server == nil && (tp.isolation == IsolationFlush || tp.isolation == IsolationDatabase) {
+			err = tp.Flush(ctx)
+		}
+		if e := tp.OnStop(ctx); e != nil && err == nil {
+			err = e
+		}
+		tp.stopServer()
+	})
+	return err
+}
+
+func (tp *testPlugin) stopServer() {
+	if tp.server != nil {
+		tp.server.Close()
+	}
+}
+
+// claimDatabase finds an empty database and marks it, the mark expires in case the test never closes the plugin
+func claimDatabase(ctx context.Context, cfg Config) (int, error) {
+	p := &plugin{prefix: defaultPrefix, opts: cfg}
+
+	mode, err := p.mode()
+	if err != nil {
+		return 0, err
+	}
+	if mode == ModeCluster || mode == ModeRing {
+		return 0, fmt.Errorf("database isolation is not supported in %s mode", mode)
+	}
+
+	for db := 0; db < 16; db++ {
+		cfg.Database = db
+
+		client, err := p.databaseClient(mode, cfg)
+		if err != nil {
+			return 0, err
+		}
+
+		claimed, err := claim(ctx, client)
+		if err != nil {
+			return 0, err
+		}
+		if claimed {
+			return db, nil
+		}
+	}
+
+	return 0, errors.New("no empty database to claim")
+}
+
+// releaseDatabase removes the mark of a database claimed by claimDatabase
+func releaseDatabase(ctx context.Context, cfg Config) error {
+	p := &plugin{prefix: defaultPrefix, opts: cfg}
+
+	mode, err := p.mode()
+	if err != nil {
+		return err
+	}
+
+	client, err := p.databaseClient(mode, cfg)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	return client.Del(ctx, testLockKey).Err()
+}
+
+// databaseClient connects to the database of cfg in standalone or sentinel mode
+func (p *plugin) databaseClient(mode string, cfg Config) (*redis.Client, error) {
+	if mode == ModeSentinel {
+		opts, err := p.prepareFailoverOptions(cfg)
+		if err != nil {
+			return nil, err
+		}
+		return redis.NewFailoverClient(opts), nil
+	}
+
+	opts, err := p.prepareOptions(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return redis.NewClient(opts), nil
+}
+
+// claim marks the database when it is empty
+func claim(ctx context.Context, client *redis.Client) (bool, error) {
+	defer client.Close()
+
+	ok, err := client.SetNX(ctx, testLockKey, time.Now().String(), time.Hour).Result()
+	if err != nil || !ok {
+		return false, err
+	}
+
+	size, err := client.DBSize(ctx).Result()
+	if err != nil {
+		return false, err
+	}
+	if size > 1 {
+		// the database is used by something else
+		return false, client.Del(ctx, testLockKey).Err()
+	}
+	return true, nil
+}
+
+// setTestDefaults applies the env defaults to the zero fields. The booleans are kept,
+// their zero value can not be told apart from false.
+func (c *Config) setTestDefaults() error {
+	var defaults Config
+	if err := env.Parse(&defaults, env.Options{Environment: map[string]string{}}); err != nil {
+		return fmt.Errorf("can not parse config defaults: %v", err)
+	}
+
+	cv, dv := reflect.ValueOf(c).Elem(), reflect.ValueOf(defaults)
+	for i := 0; i < cv.NumField(); i++ {
+		f := cv.Field(i)
+		if f.Kind() == reflect.Bool || !f.CanSet() || !f.IsZero() {
+			continue
+		}
+		f.Set(dv.Field(i))
+	}
+	return nil
+}
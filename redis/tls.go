@@ -0,0 +1,217 @@
+/*
+Copyright [2014] - [2024] The Last.Backend authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package redis
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// pemSource is a PEM value set either as the content itself or as a path to a file
+type pemSource struct {
+	value string
+	file  bool
+}
+
+func newPEMSource(value string) pemSource {
+	return pemSource{
+		value: value,
+		file:  value != "" && !strings.Contains(value, "-----BEGIN"),
+	}
+}
+
+func (s pemSource) empty() bool {
+	return s.value == ""
+}
+
+// modTime returns the modification time of the file, content never changes
+func (s pemSource) modTime() (time.Time, error) {
+	if !s.file {
+		return time.Time{}, nil
+	}
+	info, err := os.Stat(s.value)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return info.ModTime(), nil
+}
+
+func (s pemSource) read() ([]byte, error) {
+	if !s.file {
+		return []byte(s.value), nil
+	}
+	return os.ReadFile(s.value)
+}
+
+// tlsReloader loads the client certificate and the CA bundle and loads them
+// again when their files are modified, so rotated certificates are picked up
+// by new connections without a restart.
+type tlsReloader struct {
+	mtx sync.Mutex
+
+	ca   pemSource
+	cert pemSource
+	key  pemSource
+
+	caMod   time.Time
+	certMod time.Time
+	keyMod  time.Time
+
+	pool *x509.CertPool
+	pair *tls.Certificate
+}
+
+func (r *tlsReloader) certificate() (*tls.Certificate, error) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	certMod, err := r.cert.modTime()
+	if err != nil {
+		return nil, err
+	}
+	keyMod, err := r.key.modTime()
+	if err != nil {
+		return nil, err
+	}
+
+	if r.pair != nil && certMod.Equal(r.certMod) && keyMod.Equal(r.keyMod) {
+		return r.pair, nil
+	}
+
+	cert, err := r.cert.read()
+	if err != nil {
+		return nil, err
+	}
+	key, err := r.key.read()
+	if err != nil {
+		return nil, err
+	}
+
+	pair, err := tls.X509KeyPair(cert, key)
+	if err != nil {
+		return nil, err
+	}
+
+	r.pair, r.certMod, r.keyMod = &pair, certMod, keyMod
+	return r.pair, nil
+}
+
+func (r *tlsReloader) rootCAs() (*x509.CertPool, error) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	caMod, err := r.ca.modTime()
+	if err != nil {
+		return nil, err
+	}
+
+	if r.pool != nil && caMod.Equal(r.caMod) {
+		return r.pool, nil
+	}
+
+	ca, err := r.ca.read()
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("no certificates found in TLS CA")
+	}
+
+	r.pool, r.caMod = pool, caMod
+	return r.pool, nil
+}
+
+// verify checks the server certificate chain against the current CA bundle
+func (r *tlsReloader) verify(cs tls.ConnectionState) error {
+	if len(cs.PeerCertificates) == 0 {
+		return fmt.Errorf("server did not present a certificate")
+	}
+
+	pool, err := r.rootCAs()
+	if err != nil {
+		return err
+	}
+
+	opts := x509.VerifyOptions{
+		DNSName:       cs.ServerName,
+		Roots:         pool,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, cert := range cs.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+
+	_, err = cs.PeerCertificates[0].Verify(opts)
+	return err
+}
+
+// prepareTLSConfig builds the tls.Config from the TLS_* settings.
+// A TLSConfig set in code takes precedence over them.
+func prepareTLSConfig(opts Config) (*tls.Config, error) {
+	if opts.TLSConfig != nil {
+		return opts.TLSConfig, nil
+	}
+
+	if !opts.TLSEnabled {
+		return nil, nil
+	}
+
+	r := &tlsReloader{
+		ca:   newPEMSource(opts.TLSCA),
+		cert: newPEMSource(opts.TLSCert),
+		key:  newPEMSource(opts.TLSKey),
+	}
+
+	config := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         opts.TLSServerName,
+		InsecureSkipVerify: opts.TLSInsecureSkipVerify,
+	}
+
+	if r.cert.empty() != r.key.empty() {
+		return nil, fmt.Errorf("both TLS_CERT and TLS_KEY must be set")
+	}
+
+	if !r.cert.empty() {
+		// load once to fail on start instead of on the first connection
+		if _, err := r.certificate(); err != nil {
+			return nil, fmt.Errorf("failed to load TLS certificate: %v", err)
+		}
+		config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return r.certificate()
+		}
+	}
+
+	if !r.ca.empty() && !opts.TLSInsecureSkipVerify {
+		if _, err := r.rootCAs(); err != nil {
+			return nil, fmt.Errorf("failed to load TLS CA: %v", err)
+		}
+		// the standard verification uses a fixed RootCAs pool, the chain is
+		// verified in VerifyConnection instead to use the reloaded CA bundle
+		config.InsecureSkipVerify = true
+		config.VerifyConnection = r.verify
+	}
+
+	return config, nil
+}
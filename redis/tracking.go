@@ -0,0 +1,496 @@
+/*
+Copyright [2014] - [2024] The Last.Backend authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package redis
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lastbackend/toolkit/pkg/runtime/logger"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/redis/go-redis/v9"
+)
+
+// TrackingMode is the CLIENT TRACKING mode of the client-side cache
+type TrackingMode string
+
+const (
+	// TrackingDefault makes the server remember the keys read by the client and report their changes
+	TrackingDefault TrackingMode = "default"
+	// TrackingBroadcast makes the server report the changes of all keys with the configured prefixes
+	TrackingBroadcast TrackingMode = "broadcast"
+)
+
+const invalidateChannel = "__redis__:invalidate"
+
+// ErrClientCacheUnavailable is returned by the client-side cache while it has no tracking connections
+var ErrClientCacheUnavailable = errors.New("client cache connections are not available")
+
+// ClientCache keeps the values of read-heavy keys in process memory. The server reports
+// the changes of the cached keys (CLIENT TRACKING) and the entries are dropped right away.
+type ClientCache interface {
+	// Get returns the string value of the key, redis.Nil when the key does not exist
+	Get(ctx context.Context, key string) (string, error)
+	// HGetAll returns the fields of the hash, the map is shared and must not be modified
+	HGetAll(ctx context.Context, key string) (map[string]string, error)
+	// Len returns the number of cached entries
+	Len() int
+}
+
+func parseTrackingMode(mode string) (TrackingMode, error) {
+	switch m := TrackingMode(strings.ToLower(mode)); m {
+	case "", TrackingDefault:
+		return TrackingDefault, nil
+	case TrackingBroadcast:
+		return m, nil
+	default:
+		return "", fmt.Errorf("unknown tracking mode %q, expected %s or %s", mode, TrackingDefault, TrackingBroadcast)
+	}
+}
+
+type clientCacheOptions struct {
+	Mode TrackingMode
+	// Prefixes limits the broadcast mode to the keys with the prefixes
+	Prefixes []string
+	Size     int
+	// TTL bounds the life of the entries, in case an invalidation is lost
+	TTL time.Duration
+}
+
+// trackingClientFunc creates a client calling onConnect on every new connection
+type trackingClientFunc func(onConnect func(ctx context.Context, cn *redis.Conn) error) (*redis.Client, error)
+
+type clientCacheEntry struct {
+	key string
+	// kind is the reading command, the key is read again when read with another one
+	kind    string
+	value   interface{}
+	expires time.Time
+}
+
+// clientCache tracks the keys with the redirect mode of CLIENT TRACKING, which works with RESP2 and RESP3.
+// The reading connections redirect the invalidation messages to a connection subscribed to
+// __redis__:invalidate. When that connection is restored, it has a new id, so the reading
+// connections are replaced and the entries are dropped, as the invalidations meanwhile are lost.
+type clientCache struct {
+	log     logger.Logger
+	opts    clientCacheOptions
+	keys    *keyPrefix
+	factory trackingClientFunc
+
+	invalidations *redis.Client
+	ps            *redis.PubSub
+
+	mtx      sync.Mutex
+	redirect int64
+	client   *redis.Client
+	entries  map[string]*list.Element
+	lru      *list.List
+	// pending holds the generation of the keys being read. An invalidation received
+	// meanwhile removes the key, so the value read before the change is not cached.
+	pending map[string]uint64
+	gen     uint64
+
+	hits          prometheus.Counter
+	misses        prometheus.Counter
+	evictions     prometheus.Counter
+	invalidated   prometheus.Counter
+	entriesMetric prometheus.GaugeFunc
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func newClientCache(ctx context.Context, log logger.Logger, opts clientCacheOptions, keys *keyPrefix, factory trackingClientFunc) (*clientCache, error) {
+	c := &clientCache{
+		log:     log,
+		opts:    opts,
+		keys:    keys,
+		factory: factory,
+		entries: make(map[string]*list.Element, opts.Size),
+		lru:     list.New(),
+		pending: make(map[string]uint64),
+		done:    make(chan struct{}),
+	}
+
+	// the id of the subscribed connection is taken on every connect, before it subscribes
+	invalidations, err := factory(func(ctx context.Context, cn *redis.Conn) error {
+		id, err := cn.ClientID(ctx).Result()
+		if err != nil {
+			return err
+		}
+		c.redirectTo(id)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	c.invalidations = invalidations
+
+	c.ps = invalidations.Subscribe(ctx)
+	if err := c.ps.Subscribe(ctx, invalidateChannel); err != nil {
+		_ = c.ps.Close()
+		_ = invalidations.Close()
+		return nil, err
+	}
+
+	ctx, c.cancel = context.WithCancel(context.Background())
+	go c.run(ctx)
+
+	return c, nil
+}
+
+// register exposes the cache metrics
+func (c *clientCache) register(name string, registerer prometheus.Registerer) error {
+	labels := prometheus.Labels{"client": name}
+
+	c.hits = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "redis_client_cache_hits_total", Help: "Number of reads served from the client-side cache.", ConstLabels: labels,
+	})
+	c.misses = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "redis_client_cache_misses_total", Help: "Number of reads sent to the server by the client-side cache.", ConstLabels: labels,
+	})
+	c.evictions = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "redis_client_cache_evictions_total", Help: "Number of entries evicted from the client-side cache by its size limit.", ConstLabels: labels,
+	})
+	c.invalidated = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "redis_client_cache_invalidations_total", Help: "Number of keys invalidated by the server.", ConstLabels: labels,
+	})
+	c.entriesMetric = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "redis_client_cache_entries", Help: "Number of entries in the client-side cache.", ConstLabels: labels,
+	}, func() float64 { return float64(c.Len()) })
+
+	for _, m := range []prometheus.Collector{c.hits, c.misses, c.evictions, c.invalidated, c.entriesMetric} {
+		if err := registerer.Register(m); err != nil {
+			return fmt.Errorf("can not register redis client cache metrics: %v", err)
+		}
+	}
+	return nil
+}
+
+func (c *clientCache) unregister(registerer prometheus.Registerer) {
+	if c.hits == nil {
+		return
+	}
+	for _, m := range []prometheus.Collector{c.hits, c.misses, c.evictions, c.invalidated, c.entriesMetric} {
+		registerer.Unregister(m)
+	}
+}
+
+func (c *clientCache) Get(ctx context.Context, key string) (string, error) {
+	v, err := c.read(ctx, key, "get", func(client *redis.Client) (interface{}, error) {
+		return client.Get(ctx, key).Result()
+	})
+	if err != nil {
+		return "", err
+	}
+	return v.(string), nil
+}
+
+func (c *clientCache) HGetAll(ctx context.Context, key string) (map[string]string, error) {
+	v, err := c.read(ctx, key, "hgetall", func(client *redis.Client) (interface{}, error) {
+		return client.HGetAll(ctx, key).Result()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(map[string]string), nil
+}
+
+func (c *clientCache) Len() int {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.lru.Len()
+}
+
+// read returns the cached value or reads it with the tracking client. Missing keys are cached
+// as redis.Nil, their creation is reported as well.
+func (c *clientCache) read(ctx context.Context, key, kind string, fn func(client *redis.Client) (interface{}, error)) (interface{}, error) {
+	// the server reports the keys as they are stored, with the namespace
+	stored := key
+	if c.keys != nil {
+		stored = c.keys.key(c.keys.namespace(ctx), key)
+	}
+
+	if !c.tracked(stored) {
+		// the changes of the key are not reported, it is read without caching
+		c.count(c.misses)
+		c.mtx.Lock()
+		client := c.client
+		c.mtx.Unlock()
+		if client == nil {
+			return nil, ErrClientCacheUnavailable
+		}
+		return fn(client)
+	}
+
+	c.mtx.Lock()
+	if el, ok := c.entries[stored]; ok {
+		entry := el.Value.(*clientCacheEntry)
+		if entry.kind == kind && time.Now().Before(entry.expires) {
+			c.lru.MoveToFront(el)
+			c.mtx.Unlock()
+			c.count(c.hits)
+			if entry.value == nil {
+				return nil, redis.Nil
+			}
+			return entry.value, nil
+		}
+		c.remove(el)
+	}
+
+	client := c.client
+	if client == nil {
+		c.mtx.Unlock()
+		return nil, ErrClientCacheUnavailable
+	}
+	c.gen++
+	gen := c.gen
+	c.pending[stored] = gen
+	c.mtx.Unlock()
+
+	c.count(c.misses)
+
+	v, err := fn(client)
+	if errors.Is(err, redis.ErrClosed) {
+		// the client was replaced after the invalidation connection was restored
+		c.mtx.Lock()
+		client = c.client
+		c.mtx.Unlock()
+		if client == nil {
+			err = ErrClientCacheUnavailable
+		} else {
+			v, err = fn(client)
+		}
+	}
+
+	if err != nil && !errors.Is(err, redis.Nil) {
+		c.mtx.Lock()
+		if c.pending[stored] == gen {
+			delete(c.pending, stored)
+		}
+		c.mtx.Unlock()
+		return nil, err
+	}
+
+	if err != nil {
+		v = nil
+	}
+
+	c.mtx.Lock()
+	if c.pending[stored] == gen {
+		delete(c.pending, stored)
+		c.set(stored, kind, v)
+	}
+	c.mtx.Unlock()
+
+	if err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// tracked reports whether the server reports the changes of the stored key. In broadcast
+// mode only the keys with the prefixes are reported.
+func (c *clientCache) tracked(stored string) bool {
+	if c.opts.Mode != TrackingBroadcast || len(c.opts.Prefixes) == 0 {
+		return true
+	}
+	for _, prefix := range c.opts.Prefixes {
+		if strings.HasPrefix(stored, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// set stores the value, the least recently used entries over the size are evicted
+func (c *clientCache) set(key, kind string, value interface{}) {
+	expires := time.Now().Add(c.opts.TTL)
+
+	if el, ok := c.entries[key]; ok {
+		entry := el.Value.(*clientCacheEntry)
+		entry.kind, entry.value, entry.expires = kind, value, expires
+		c.lru.MoveToFront(el)
+		return
+	}
+
+	c.entries[key] = c.lru.PushFront(&clientCacheEntry{key: key, kind: kind, value: value, expires: expires})
+
+	for c.lru.Len() > c.opts.Size {
+		c.remove(c.lru.Back())
+		c.count(c.evictions)
+	}
+}
+
+func (c *clientCache) remove(el *list.Element) {
+	c.lru.Remove(el)
+	delete(c.entries, el.Value.(*clientCacheEntry).key)
+}
+
+func (c *clientCache) invalidate(keys []string) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	for _, key := range keys {
+		delete(c.pending, key)
+		if el, ok := c.entries[key]; ok {
+			c.remove(el)
+		}
+		c.count(c.invalidated)
+	}
+}
+
+// flush drops all entries, the reads in progress are not cached
+func (c *clientCache) flush() {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	c.entries = make(map[string]*list.Element, c.opts.Size)
+	c.lru.Init()
+	c.pending = make(map[string]uint64)
+}
+
+// redirectTo is called when the invalidation connection connects. The reading connections
+// redirecting to the previous connection are replaced, they would not report changes anymore.
+func (c *clientCache) redirectTo(id int64) {
+	c.mtx.Lock()
+	if c.redirect == id {
+		c.mtx.Unlock()
+		return
+	}
+	c.redirect = id
+	c.mtx.Unlock()
+
+	client, err := c.factory(c.track)
+	if err != nil {
+		// the connections redirecting to the previous connection would not report changes,
+		// the cache is unavailable until the next connect
+		c.log.Errorf("redis: can not create client cache connections: %v", err)
+		client = nil
+	}
+
+	c.mtx.Lock()
+	old := c.client
+	c.client = client
+	if client == nil {
+		c.redirect = 0
+	}
+	c.entries = make(map[string]*list.Element, c.opts.Size)
+	c.lru.Init()
+	c.pending = make(map[string]uint64)
+	c.mtx.Unlock()
+
+	if old != nil {
+		_ = old.Close()
+	}
+}
+
+// track enables the tracking on a new reading connection
+func (c *clientCache) track(ctx context.Context, cn *redis.Conn) error {
+	c.mtx.Lock()
+	redirect := c.redirect
+	c.mtx.Unlock()
+
+	args := []interface{}{"client", "tracking", "on", "redirect", redirect}
+	if c.opts.Mode == TrackingBroadcast {
+		args = append(args, "bcast")
+		for _, prefix := range c.opts.Prefixes {
+			args = append(args, "prefix", prefix)
+		}
+	}
+	return cn.Process(ctx, redis.NewStatusCmd(ctx, args...))
+}
+
+func (c *clientCache) run(ctx context.Context) {
+	defer close(c.done)
+
+	var lost bool
+
+	for {
+		msg, err := c.ps.ReceiveTimeout(ctx, pubsubHealthCheck)
+		if ctx.Err() != nil {
+			return
+		}
+
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				if err = c.ps.Ping(ctx); err == nil {
+					continue
+				}
+			}
+
+			// the invalidations may be lost, the entries can not be trusted anymore.
+			// A flush of the server is reported with an empty payload, which go-redis fails to parse.
+			c.flush()
+			if !lost {
+				lost = true
+				c.log.Warnf("redis: client cache invalidations interrupted, entries dropped: %v", err)
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(pubsubRetryDelay):
+			}
+			continue
+		}
+		lost = false
+
+		m, ok := msg.(*redis.Message)
+		if !ok || m.Channel != invalidateChannel {
+			continue
+		}
+
+		switch {
+		case len(m.PayloadSlice) > 0:
+			c.invalidate(m.PayloadSlice)
+		case m.Payload != "":
+			c.invalidate([]string{m.Payload})
+		default:
+			c.flush()
+		}
+	}
+}
+
+func (c *clientCache) count(counter prometheus.Counter) {
+	if counter != nil {
+		counter.Inc()
+	}
+}
+
+func (c *clientCache) Close() error {
+	c.cancel()
+	err := c.ps.Close()
+	<-c.done
+	_ = c.invalidations.Close()
+
+	c.mtx.Lock()
+	client := c.client
+	c.mtx.Unlock()
+	if client != nil {
+		_ = client.Close()
+	}
+	return err
+}